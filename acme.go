@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// With tls.acme enabled, certificates for the mail hostname and the other
+// configured names are requested from an ACME CA the first time a client
+// asks for them and renewed before they expire. Challenges are answered
+// with HTTP-01 on the web listener and TLS-ALPN-01 on the HTTPS one. Names
+// ACME does not cover, and handshakes while a certificate cannot be
+// obtained, fall back to the certificate in cert_file.
+
+func (s *EmailServer) createACMETables() error {
+	acmeTable := `
+	CREATE TABLE IF NOT EXISTS acme_cache (
+		key TEXT PRIMARY KEY,
+		data BLOB NOT NULL,
+		updated DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err := s.db.Exec(acmeTable)
+	return err
+}
+
+// dbCertCache keeps the ACME account key and issued certificates in the
+// database.
+type dbCertCache struct {
+	db *sql.DB
+}
+
+func (c dbCertCache) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := c.db.QueryRowContext(ctx, "SELECT data FROM acme_cache WHERE key = ?", key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
+}
+
+func (c dbCertCache) Put(ctx context.Context, key string, data []byte) error {
+	_, err := c.db.ExecContext(ctx, `INSERT INTO acme_cache (key, data, updated) VALUES (?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET data = excluded.data, updated = excluded.updated`,
+		key, data, time.Now().UTC().Format(sqliteTimeLayout))
+	return err
+}
+
+func (c dbCertCache) Delete(ctx context.Context, key string) error {
+	_, err := c.db.ExecContext(ctx, "DELETE FROM acme_cache WHERE key = ?", key)
+	return err
+}
+
+// enableACME makes the store hand out ACME certificates for hostname and
+// the configured hosts.
+func (c *certStore) enableACME(config ACMEConfig, hostname string, cache autocert.Cache) error {
+	client := &acme.Client{DirectoryURL: config.DirectoryURL}
+	if config.CAFile != "" {
+		data, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates in %s", config.CAFile)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+	}
+
+	c.hostname = hostname
+	c.acme = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      cache,
+		HostPolicy: autocert.HostWhitelist(append([]string{hostname}, config.Hosts...)...),
+		Client:     client,
+		Email:      config.Email,
+	}
+	return nil
+}
+
+// acmeCertificate answers a handshake with an ACME certificate. ok is false
+// if the name is not one ACME covers or no certificate could be obtained,
+// and the configured certificate should be used instead. Mail clients
+// often send no server name; they get the mail hostname's certificate.
+func (c *certStore) acmeCertificate(hello *tls.ClientHelloInfo) (cert *tls.Certificate, ok bool, err error) {
+	for _, proto := range hello.SupportedProtos {
+		if proto == acme.ALPNProto {
+			cert, err := c.acme.GetCertificate(hello)
+			return cert, true, err
+		}
+	}
+
+	if hello.ServerName == "" {
+		named := *hello
+		named.ServerName = c.hostname
+		hello = &named
+	}
+	if c.acme.HostPolicy(hello.Context(), hello.ServerName) != nil {
+		return nil, false, nil
+	}
+
+	cert, err = c.acme.GetCertificate(hello)
+	if err != nil {
+		log.Printf("ACME certificate for %s unavailable, using %s: %v", hello.ServerName, c.certFile, err)
+		return nil, false, nil
+	}
+	return cert, true, nil
+}
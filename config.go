@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Config holds the settings that can be overridden through a JSON file. The
+// file is read from $EMAIL_SERVER_CONFIG, or config.json if that is unset;
+// a missing file means every default applies.
+type Config struct {
+	// Hostname is the name this server uses in SMTP greetings, Message-IDs
+	// and bounce messages.
+	Hostname string `json:"hostname"`
+
+	// Admins are the addresses of users who may open the admin pages,
+	// such as the DKIM keys.
+	Admins []string `json:"admins"`
+
+	Outbound   OutboundConfig   `json:"outbound"`
+	Relay      RelayConfig      `json:"relay"`
+	Sessions   SessionConfig    `json:"sessions"`
+	TLS        TLSConfig        `json:"tls"`
+	Submission SubmissionConfig `json:"submission"`
+	SMTP       SMTPConfig       `json:"smtp"`
+	DMARC      DMARCConfig      `json:"dmarc"`
+	Spam       SpamConfig       `json:"spam"`
+	Blocklists BlocklistConfig  `json:"blocklists"`
+}
+
+// BlocklistConfig decides which clients the MX listener takes mail from.
+type BlocklistConfig struct {
+	// Allow and Deny are IP addresses and CIDR ranges. Clients in Deny are
+	// refused; clients in Allow skip every check, including Deny.
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	// Zones are DNSBLs the client's IP is looked up in, such as
+	// zen.spamhaus.org.
+	Zones []string `json:"zones"`
+	// DomainZones are RHSBLs the MAIL FROM domain is looked up in, such as
+	// dbl.spamhaus.org.
+	DomainZones []string `json:"domain_zones"`
+	// CacheTTL is how long a lookup result is reused.
+	CacheTTL Duration `json:"cache_ttl"`
+}
+
+// SpamConfig controls the scoring of mail received from other servers.
+type SpamConfig struct {
+	Enabled bool `json:"enabled"`
+	// Threshold is the score from which a message is filed in the
+	// recipient's Junk mailbox.
+	Threshold float64 `json:"threshold"`
+}
+
+// DMARCConfig controls DMARC aggregate reports: the ones we send to the
+// domains we receive mail from, and the ones sent to us about our own.
+type DMARCConfig struct {
+	// SendReports mails each sender domain whose DMARC record has a rua
+	// tag a daily report of the results we saw for it. ReportFrom has to
+	// be in a hosted domain, so the reports can be DKIM-signed.
+	SendReports bool `json:"send_reports"`
+	// ReportFrom is the address reports are sent from; empty means
+	// dmarc-reports@ followed by the hostname.
+	ReportFrom string `json:"report_from"`
+	// ReportMailbox is a local account whose mail is read as aggregate
+	// reports about our domains. Use it as the rua address in their DMARC
+	// records.
+	ReportMailbox string `json:"report_mailbox"`
+}
+
+// SMTPConfig holds limits shared by the MX and submission listeners.
+type SMTPConfig struct {
+	// MaxRecipients is the most RCPT TO commands accepted for one message;
+	// further ones get a temporary 452 so the client sends them separately.
+	MaxRecipients int `json:"max_recipients"`
+}
+
+// SubmissionConfig sets up the port mail clients send through. Unlike the
+// MX port, :2525, it requires a login and accepts mail for any recipient.
+type SubmissionConfig struct {
+	Addr string `json:"addr"`
+}
+
+// TLSConfig sets the certificate and the implicit TLS listeners. The same
+// certificate is used for STARTTLS on the SMTP and IMAP ports, and
+// cleartext logins are refused on connections without TLS.
+type TLSConfig struct {
+	// CertFile and KeyFile are PEM files with the certificate chain and
+	// its private key. If neither exists on startup, a self-signed
+	// certificate for Hostname is written to them. Send SIGHUP to reload
+	// them after a renewal.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// SMTPSAddr, IMAPSAddr and HTTPSAddr are the implicit TLS listeners
+	// for submission, IMAP and the web UI; an empty address turns that
+	// listener off.
+	SMTPSAddr string `json:"smtps_addr"`
+	IMAPSAddr string `json:"imaps_addr"`
+	HTTPSAddr string `json:"https_addr"`
+
+	ACME ACMEConfig `json:"acme"`
+}
+
+// ACMEConfig has certificates for the mail hostname and Hosts issued and
+// renewed by an ACME CA such as Let's Encrypt. The CA must be able to reach
+// the web listener on port 80 for HTTP-01 or the HTTPS listener on port
+// 443 for TLS-ALPN-01, directly or through port forwarding.
+type ACMEConfig struct {
+	Enabled bool `json:"enabled"`
+	// DirectoryURL is the CA's directory; empty means Let's Encrypt. Point
+	// it at a local Pebble instance for testing, with CAFile set to the
+	// certificate Pebble serves its API with.
+	DirectoryURL string `json:"directory_url"`
+	CAFile       string `json:"ca_file"`
+	// Email is the contact address registered with the CA account.
+	Email string `json:"email"`
+	// Hosts are names to get certificates for besides Hostname, such as
+	// the web UI's.
+	Hosts []string `json:"hosts"`
+	// CacheDir keeps the account key and certificates in a directory
+	// instead of the database.
+	CacheDir string `json:"cache_dir"`
+}
+
+// SessionConfig controls web login sessions.
+type SessionConfig struct {
+	// Lifetime is how long a login lasts before the user has to sign in
+	// again.
+	Lifetime Duration `json:"lifetime"`
+	// SecureCookie marks the session cookie Secure even on plain HTTP
+	// requests, for deployments behind a TLS-terminating proxy. Requests
+	// that arrive over TLS always get a Secure cookie.
+	SecureCookie bool `json:"secure_cookie"`
+}
+
+// OutboundConfig controls delivery of mail to domains we don't host.
+type OutboundConfig struct {
+	// Port is the port remote mail exchangers are contacted on.
+	Port string `json:"port"`
+	// RetryInterval is the delay before the first retry; it doubles on each
+	// further attempt up to MaxRetryInterval.
+	RetryInterval    Duration `json:"retry_interval"`
+	MaxRetryInterval Duration `json:"max_retry_interval"`
+	// GiveUpAfter is how long a message may sit in the queue before it is
+	// bounced back to the sender.
+	GiveUpAfter Duration `json:"give_up_after"`
+}
+
+// RelayConfig sends non-local mail through smarthosts instead of straight to
+// the recipient's MX. Routes pick a smarthost by sender domain; mail that
+// matches no route uses Default, and an empty Default means direct delivery.
+type RelayConfig struct {
+	Smarthosts map[string]SmarthostConfig `json:"smarthosts"`
+	Default    string                     `json:"default"`
+	Routes     []RelayRoute               `json:"routes"`
+}
+
+// SmarthostConfig describes one relay server.
+type SmarthostConfig struct {
+	Host string `json:"host"`
+	Port string `json:"port"`
+	// TLS is "starttls" (the default), "implicit" or "none".
+	TLS                string `json:"tls"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// Auth is "plain" (the default) or "login"; it is only used when
+	// Username is set.
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// RelayRoute sends mail from SenderDomain through the named smarthost. The
+// special name "direct" bypasses the smarthosts for that domain.
+type RelayRoute struct {
+	SenderDomain string `json:"sender_domain"`
+	Smarthost    string `json:"smarthost"`
+}
+
+// Duration is a time.Duration that reads from JSON strings like "15m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Hostname: "localhost",
+		Outbound: OutboundConfig{
+			Port:             "25",
+			RetryInterval:    Duration(5 * time.Minute),
+			MaxRetryInterval: Duration(4 * time.Hour),
+			GiveUpAfter:      Duration(5 * 24 * time.Hour),
+		},
+		Sessions: SessionConfig{
+			Lifetime: Duration(30 * 24 * time.Hour),
+		},
+		TLS: TLSConfig{
+			CertFile:  "tls/cert.pem",
+			KeyFile:   "tls/key.pem",
+			SMTPSAddr: ":465",
+			IMAPSAddr: ":993",
+			HTTPSAddr: ":8443",
+		},
+		Submission: SubmissionConfig{
+			Addr: ":587",
+		},
+		SMTP: SMTPConfig{
+			MaxRecipients: 100,
+		},
+		Spam: SpamConfig{
+			Enabled:   true,
+			Threshold: 5,
+		},
+		Blocklists: BlocklistConfig{
+			CacheTTL: Duration(30 * time.Minute),
+		},
+	}
+}
+
+func loadConfig() (*Config, error) {
+	config := defaultConfig()
+
+	path := os.Getenv("EMAIL_SERVER_CONFIG")
+	if path == "" {
+		path = "config.json"
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return config, nil
+}
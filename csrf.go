@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// State-changing web requests must carry a CSRF token. Logged-in users get
+// one per session, kept next to it in the sessions table; the login and
+// register pages, which have no session yet, use a random token held in a
+// cookie and echoed back by the page. Every page puts its token in a
+// <meta name="csrf-token"> tag and /static/csrf.js sends it with each htmx
+// request as X-CSRF-Token.
+
+const (
+	csrfCookieName = "csrf"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+)
+
+// csrfToken returns the token the page being rendered should send back,
+// setting the pre-login cookie if the browser does not have one yet.
+func (s *EmailServer) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if token := s.expectedCSRFToken(r); token != "" {
+		return token
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		log.Printf("Failed to create CSRF token: %v", err)
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || s.config.Sessions.SecureCookie,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// expectedCSRFToken returns the token a request must carry: the session's
+// if it has one, otherwise the pre-login cookie's. It is empty if there is
+// neither.
+func (s *EmailServer) expectedCSRFToken(r *http.Request) string {
+	if sessionID, _ := s.currentSession(r); sessionID != 0 {
+		token, err := s.sessionCSRFToken(sessionID)
+		if err != nil {
+			log.Printf("Failed to load CSRF token: %v", err)
+		}
+		return token
+	}
+	if cookie, err := r.Cookie(csrfCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// sessionCSRFToken returns the session's CSRF token, creating it for
+// sessions started before tokens were stored.
+func (s *EmailServer) sessionCSRFToken(sessionID int64) (string, error) {
+	var token string
+	if err := s.db.QueryRow("SELECT csrf_token FROM sessions WHERE id = ?", sessionID).Scan(&token); err != nil {
+		return "", err
+	}
+	if token != "" {
+		return token, nil
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := s.db.Exec("UPDATE sessions SET csrf_token = ? WHERE id = ?", token, sessionID); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// csrfProtect rejects state-changing requests that come from another site
+// or lack the right token, before they reach the router.
+func (s *EmailServer) csrfProtect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !sameOrigin(r) {
+			log.Printf("CSRF: rejected %s %s from origin %q referer %q", r.Method, r.URL.Path, r.Header.Get("Origin"), r.Referer())
+			csrfFailure(w, "This request came from another site and was blocked.")
+			return
+		}
+
+		token := r.Header.Get(csrfHeaderName)
+		if token == "" {
+			token = r.PostFormValue(csrfFormField)
+		}
+		expected := s.expectedCSRFToken(r)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			log.Printf("CSRF: rejected %s %s with a missing or invalid token", r.Method, r.URL.Path)
+			csrfFailure(w, "Your session has changed since this page was loaded. Reload the page and try again.")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin reports whether the request's Origin, or failing that its
+// Referer, names this host. Requests with neither are left to the token
+// check.
+func sameOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Referer()
+	}
+	if source == "" {
+		return true
+	}
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		// Includes the opaque "null" origin of sandboxed frames.
+		return false
+	}
+	return u.Host == r.Host
+}
+
+// csrfFailure answers a rejected request with an error fragment. The pages
+// tell htmx to swap it in even though the status is 403.
+func csrfFailure(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "text/html")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, `<div class="alert alert-error bg-red-100 border border-red-400 text-red-700 px-4 py-3 rounded" role="alert">
+		<span class="material-icons" style="vertical-align: middle; margin-right: 8px;">gpp_bad</span>
+		%s
+	</div>`, message)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFProtect(t *testing.T) {
+	const preLogin = "pre-login-token"
+	tests := []struct {
+		name     string
+		method   string
+		signedIn bool
+		header   string // X-CSRF-Token, or "session" for the session's token
+		form     string // csrf_token, likewise
+		cookie   string // pre-login csrf cookie
+		origin   string
+		referer  string
+		want     int
+	}{
+		{"get without token", "GET", true, "", "", "", "", "", http.StatusOK},
+		{"header token", "POST", true, "session", "", "", "", "", http.StatusOK},
+		{"form token", "POST", true, "", "session", "", "", "", http.StatusOK},
+		{"same origin", "POST", true, "session", "", "", "http://mail.example.com", "", http.StatusOK},
+		{"missing token", "POST", true, "", "", "", "", "", http.StatusForbidden},
+		{"bad token", "POST", true, "forged", "", "", "", "", http.StatusForbidden},
+		{"pre-login token instead of the session's", "POST", true, preLogin, "", preLogin, "", "", http.StatusForbidden},
+		{"cross-origin", "POST", true, "session", "", "", "https://evil.example", "", http.StatusForbidden},
+		{"cross-origin referer", "POST", true, "session", "", "", "", "https://evil.example/page", http.StatusForbidden},
+		{"null origin", "POST", true, "session", "", "", "null", "", http.StatusForbidden},
+		{"pre-login form token", "POST", false, "", preLogin, preLogin, "", "", http.StatusOK},
+		{"pre-login without cookie", "POST", false, "", preLogin, "", "", "", http.StatusForbidden},
+		{"pre-login bad token", "POST", false, "", "forged", preLogin, "", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestEmailServer(t)
+			handler := s.csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+			r := httptest.NewRequest(tt.method, "http://mail.example.com/emails/delete", nil)
+			sessionToken := ""
+			if tt.signedIn {
+				signIn(t, s, r, newTestUser(t, s.db, "bob@localhost.com"))
+				sessionID, _ := s.currentSession(r)
+				var err error
+				if sessionToken, err = s.sessionCSRFToken(sessionID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			token := func(v string) string {
+				if v == "session" {
+					return sessionToken
+				}
+				return v
+			}
+
+			if tt.form != "" {
+				body := url.Values{csrfFormField: {token(tt.form)}}.Encode()
+				r.Body = io.NopCloser(strings.NewReader(body))
+				r.ContentLength = int64(len(body))
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if tt.header != "" {
+				r.Header.Set(csrfHeaderName, token(tt.header))
+			}
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.cookie})
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
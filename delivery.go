@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-msgauth/dmarc"
+)
+
+// Delivery routes a message to its recipients: addresses on one of our
+// domains are filed locally, everything else goes to the outbound queue.
+// Both the SMTP backend and the web compose form deliver through it.
+type Delivery struct {
+	db      *sql.DB
+	domains []string
+	queue   *OutboundQueue
+	events  *EventBus
+}
+
+func NewDelivery(db *sql.DB, domains []string, queue *OutboundQueue, events *EventBus) *Delivery {
+	return &Delivery{db: db, domains: domains, queue: queue, events: events}
+}
+
+// IsLocal reports whether addr belongs to one of the hosted domains.
+func (d *Delivery) IsLocal(addr string) bool {
+	domain := addressDomain(addr)
+	for _, hosted := range d.domains {
+		if strings.EqualFold(domain, hosted) {
+			return true
+		}
+	}
+	return false
+}
+
+// errNoAccount is returned for a local address that no user has.
+var errNoAccount = errors.New("no account for this address")
+
+// Recipient returns addr as it is delivered to: local addresses are
+// lowercased, as createEmailAddress makes them, and must belong to a user;
+// remote ones are passed on as given.
+func (d *Delivery) Recipient(addr string) (string, error) {
+	if !d.IsLocal(addr) {
+		return addr, nil
+	}
+	addr = strings.ToLower(addr)
+	exists, err := d.HasAccount(addr)
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return "", errNoAccount
+	}
+	return addr, nil
+}
+
+// HasAccount reports whether a local address belongs to a user.
+func (d *Delivery) HasAccount(addr string) (bool, error) {
+	var count int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM users WHERE email = lower(?)", addr).Scan(&count)
+	return count > 0, err
+}
+
+// Deliver files raw for the local recipients and queues it for the rest.
+func (d *Delivery) Deliver(from string, recipients []string, raw []byte) error {
+	return d.deliver(from, recipients, raw, 0, nil, nil)
+}
+
+// Receive files mail from another server for local recipients, recording
+// how it fared in the SPF, DKIM and DMARC checks. Mail the From domain's
+// policy quarantines goes to the recipients' Junk mailbox, and so does
+// mail for the recipients in junk.
+func (d *Delivery) Receive(from string, recipients []string, raw []byte, auth *MessageAuth, junk map[string]bool) error {
+	return d.deliver(from, recipients, raw, 0, auth, junk)
+}
+
+// Send delivers mail written by a local user and files a copy of it in
+// their Sent mailbox.
+func (d *Delivery) Send(userID int, from string, recipients []string, raw []byte) error {
+	return d.deliver(from, recipients, raw, userID, nil, nil)
+}
+
+func (d *Delivery) deliver(from string, recipients []string, raw []byte, senderID int, auth *MessageAuth, junk map[string]bool) error {
+	var local, remote []string
+	for _, to := range recipients {
+		if d.IsLocal(to) {
+			local = append(local, to)
+		} else {
+			remote = append(remote, to)
+		}
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The raw message is stored once and shared by every copy.
+	messageID, err := storeMessage(tx, raw)
+	if err != nil {
+		return err
+	}
+	quarantine := false
+	if auth != nil {
+		if err := storeMessageAuth(tx, messageID, auth); err != nil {
+			return err
+		}
+		quarantine = auth.Disposition == string(dmarc.PolicyQuarantine)
+	}
+
+	// Mailboxes that got a copy, to announce once committed.
+	var filed []int64
+	for _, to := range local {
+		file := fileInInbox
+		if quarantine || junk[strings.ToLower(to)] {
+			file = fileInJunk
+		}
+		mailboxID, err := file(tx, messageID, from, to)
+		if err != nil {
+			return err
+		}
+		filed = append(filed, mailboxID)
+	}
+
+	if len(remote) > 0 {
+		if err := d.queue.enqueue(tx, messageID, from, remote); err != nil {
+			return err
+		}
+	}
+
+	if senderID != 0 {
+		sent, err := getSpecialMailbox(tx, senderID, imap.SentAttr)
+		if err != nil {
+			return err
+		}
+		if err := fileMessage(tx, messageID, from, from, sent.ID); err != nil {
+			return err
+		}
+		filed = append(filed, sent.ID)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, mailboxID := range filed {
+		d.events.MessagesAdded(mailboxID, false)
+	}
+	if len(remote) > 0 {
+		d.queue.Wake()
+	}
+	return nil
+}
+
+// addressDomain returns the lowercased part of addr after the last "@".
+func addressDomain(addr string) string {
+	addr = strings.Trim(addr, "<>")
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(addr[at+1:])
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/gorilla/mux"
+)
+
+// Every hosted domain has its own DKIM keys in dkim_keys, an RSA-2048 and
+// an Ed25519 key under separate selectors. Mail our users send is signed
+// with both active keys of its From domain. Rotating a domain creates new
+// keys that are pending until an admin activates them, once their DNS
+// records are published; the old keys sign until then. Activation retires
+// the old keys, which stay listed until deleted so their DNS records can
+// remain published while mail signed with them is still in transit.
+
+func (s *EmailServer) createDKIMTables() error {
+	dkimTable := `
+	CREATE TABLE IF NOT EXISTS dkim_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		domain TEXT NOT NULL,
+		selector TEXT NOT NULL,
+		algorithm TEXT NOT NULL,
+		private_key BLOB NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		pending BOOLEAN NOT NULL DEFAULT FALSE,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (domain, selector)
+	);`
+
+	if _, err := s.db.Exec(dkimTable); err != nil {
+		return err
+	}
+	return addColumnIfMissing(s.db, "dkim_keys", "pending", "BOOLEAN NOT NULL DEFAULT FALSE")
+}
+
+var errDKIMRotationPending = errors.New("new DKIM keys are already waiting to be activated")
+
+// dkimHeaderKeys are the header fields covered by our signatures, after
+// RFC 6376 section 5.4.1. Listed fields that a message lacks are signed as
+// absent, so they cannot be added later.
+var dkimHeaderKeys = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// DKIMKey is one selector of a domain.
+type DKIMKey struct {
+	ID        int64
+	Domain    string
+	Selector  string
+	Algorithm string // "rsa" or "ed25519"
+	Active    bool
+	Pending   bool // generated by Rotate, not yet activated
+	Created   time.Time
+
+	signer crypto.Signer
+}
+
+// DNSName is where the key's TXT record is published.
+func (k *DKIMKey) DNSName() string {
+	return k.Selector + "._domainkey." + k.Domain
+}
+
+// TXTRecord returns the key record to publish, split into the strings of at
+// most 255 bytes a TXT record is made of.
+func (k *DKIMKey) TXTRecord() ([]string, error) {
+	var public []byte
+	switch pub := k.signer.Public().(type) {
+	case ed25519.PublicKey:
+		public = pub
+	default:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			return nil, err
+		}
+		public = der
+	}
+
+	record := fmt.Sprintf("v=DKIM1; k=%s; p=%s", k.Algorithm, base64.StdEncoding.EncodeToString(public))
+	var chunks []string
+	for len(record) > 255 {
+		chunks = append(chunks, record[:255])
+		record = record[255:]
+	}
+	return append(chunks, record), nil
+}
+
+// DKIMSigner keeps the DKIM keys and signs outgoing mail with them.
+type DKIMSigner struct {
+	db *sql.DB
+}
+
+func NewDKIMSigner(db *sql.DB) *DKIMSigner {
+	return &DKIMSigner{db: db}
+}
+
+// EnsureKeys generates the first keys of every domain that has none active.
+// They sign right away, as the domain's mail was unsigned before.
+func (d *DKIMSigner) EnsureKeys(domains []string) error {
+	for _, domain := range domains {
+		var count int
+		if err := d.db.QueryRow("SELECT COUNT(*) FROM dkim_keys WHERE domain = ? AND active", domain).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			if err := d.generate(domain, false); err != nil {
+				return fmt.Errorf("generating DKIM keys for %s: %v", domain, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Rotate generates a new RSA and Ed25519 key for domain under new
+// selectors. They wait for Activate, so the keys in use keep signing until
+// the new DNS records are published.
+func (d *DKIMSigner) Rotate(domain string) error {
+	var pending int
+	if err := d.db.QueryRow("SELECT COUNT(*) FROM dkim_keys WHERE domain = ? AND pending", domain).Scan(&pending); err != nil {
+		return err
+	}
+	if pending > 0 {
+		return errDKIMRotationPending
+	}
+	return d.generate(domain, true)
+}
+
+// Activate starts signing with the keys Rotate generated for domain and
+// retires the ones in use until now.
+func (d *DKIMSigner) Activate(domain string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var pending int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM dkim_keys WHERE domain = ? AND pending", domain).Scan(&pending); err != nil {
+		return err
+	}
+	if pending == 0 {
+		return fmt.Errorf("no new DKIM keys to activate for %s", domain)
+	}
+	if _, err := tx.Exec("UPDATE dkim_keys SET active = FALSE WHERE domain = ? AND active", domain); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE dkim_keys SET active = TRUE, pending = FALSE WHERE domain = ? AND pending", domain); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// generate adds an RSA and an Ed25519 key for domain, either pending or
+// signing at once.
+func (d *DKIMSigner) generate(domain string, pending bool) error {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Selectors carry the date and a random tag, shared by both keys of a
+	// rotation, that no earlier key of the domain has used.
+	now := time.Now().UTC()
+	var tag string
+	for {
+		b := make([]byte, 3)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		tag = now.Format("20060102") + "-" + hex.EncodeToString(b)
+		var taken int
+		err := tx.QueryRow("SELECT COUNT(*) FROM dkim_keys WHERE domain = ? AND selector LIKE ?",
+			domain, "%-"+tag).Scan(&taken)
+		if err != nil {
+			return err
+		}
+		if taken == 0 {
+			break
+		}
+	}
+
+	for _, key := range []struct {
+		algorithm string
+		private   crypto.Signer
+	}{{"rsa", rsaKey}, {"ed25519", edKey}} {
+		der, err := x509.MarshalPKCS8PrivateKey(key.private)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO dkim_keys (domain, selector, algorithm, private_key, active, pending, created)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`, domain, key.algorithm+"-"+tag, key.algorithm, der, !pending, pending,
+			now.Format(sqliteTimeLayout))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Keys returns all keys of domain: active ones first, then pending ones,
+// and newest first within each.
+func (d *DKIMSigner) Keys(domain string) ([]*DKIMKey, error) {
+	return d.query(`SELECT id, domain, selector, algorithm, private_key, active, pending, created FROM dkim_keys
+		WHERE domain = ? ORDER BY active DESC, pending DESC, created DESC, id`, domain)
+}
+
+// DeleteRetired removes a key that is not used for signing: a retired one,
+// or a pending one to call off a rotation.
+func (d *DKIMSigner) DeleteRetired(id int64) error {
+	_, err := d.db.Exec("DELETE FROM dkim_keys WHERE id = ? AND NOT active", id)
+	return err
+}
+
+func (d *DKIMSigner) query(query string, args ...interface{}) ([]*DKIMKey, error) {
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*DKIMKey
+	for rows.Next() {
+		key := &DKIMKey{}
+		var der []byte
+		var created string
+		if err := rows.Scan(&key.ID, &key.Domain, &key.Selector, &key.Algorithm, &der, &key.Active, &key.Pending, &created); err != nil {
+			return nil, err
+		}
+		private, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			return nil, fmt.Errorf("DKIM key %s: %v", key.Selector, err)
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("DKIM key %s: unsupported key type %T", key.Selector, private)
+		}
+		key.signer = signer
+		key.Created = parseTimestamp(created)
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// Sign adds a DKIM-Signature for every active key of the message's From
+// domain. Messages without a From address or from domains without keys
+// are returned as they are.
+func (d *DKIMSigner) Sign(raw []byte) ([]byte, error) {
+	header, _, err := parseMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	from, err := mail.ParseAddress(header.Get("From"))
+	if err != nil {
+		// Without a From domain there is no key to sign with.
+		return raw, nil
+	}
+
+	keys, err := d.query(`SELECT id, domain, selector, algorithm, private_key, active, pending, created FROM dkim_keys
+		WHERE domain = ? AND active ORDER BY id`, addressDomain(from.Address))
+	if err != nil || len(keys) == 0 {
+		return raw, err
+	}
+
+	var signatures bytes.Buffer
+	for _, key := range keys {
+		signer, err := dkim.NewSigner(&dkim.SignOptions{
+			Domain:                 key.Domain,
+			Selector:               key.Selector,
+			Signer:                 key.signer,
+			Hash:                   crypto.SHA256,
+			HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+			BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+			HeaderKeys:             dkimHeaderKeys,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := signer.Write(raw); err != nil {
+			signer.Close()
+			return nil, err
+		}
+		if err := signer.Close(); err != nil {
+			return nil, err
+		}
+		signatures.WriteString(signer.Signature())
+	}
+	return append(signatures.Bytes(), raw...), nil
+}
+
+// isAdmin reports whether the user is listed in the admins setting.
+func (s *EmailServer) isAdmin(userID int) bool {
+	var email string
+	if err := s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		return false
+	}
+	for _, admin := range s.config.Admins {
+		if strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// dkimDomain is one hosted domain on the DKIM admin page.
+type dkimDomain struct {
+	Name    string
+	Keys    []dkimKeyView
+	Pending bool // has keys waiting to be activated
+}
+
+type dkimKeyView struct {
+	*DKIMKey
+	TXT string
+}
+
+// dkimAdminHandler lists every domain's keys with the DNS records to
+// publish for them.
+func (s *EmailServer) dkimAdminHandler(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserID(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var user User
+	s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&user.Email)
+
+	var domains []dkimDomain
+	for _, name := range s.domains {
+		keys, err := s.dkim.Keys(name)
+		if err != nil {
+			http.Error(w, "Error loading DKIM keys", http.StatusInternalServerError)
+			return
+		}
+		domain := dkimDomain{Name: name}
+		for _, key := range keys {
+			record, err := key.TXTRecord()
+			if err != nil {
+				http.Error(w, "Error loading DKIM keys", http.StatusInternalServerError)
+				return
+			}
+			domain.Keys = append(domain.Keys, dkimKeyView{key, `"` + strings.Join(record, `" "`) + `"`})
+			domain.Pending = domain.Pending || key.Pending
+		}
+		domains = append(domains, domain)
+	}
+
+	tmpl := template.Must(template.New("dkim").Funcs(template.FuncMap{
+		"when": func(t time.Time) string { return t.Local().Format("Jan 2, 2006 15:04") },
+	}).Parse(`
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="csrf-token" content="{{.CSRFToken}}">
+    <title>DKIM Keys - Email Server</title>
+    <script src="https://unpkg.com/htmx.org@1.9.6"></script>
+    <script src="/static/csrf.js"></script>
+    <link rel="stylesheet" href="/static/style.css">
+    <link href="https://fonts.googleapis.com/css2?family=Google+Sans:wght@400;500;600&display=swap" rel="stylesheet">
+    <link href="https://fonts.googleapis.com/icon?family=Material+Icons" rel="stylesheet">
+</head>
+<body>
+    <!-- Header -->
+    <div class="header">
+        <div class="header-content">
+            <a href="/dashboard" class="logo">
+                <span class="material-icons">email</span>
+                Email
+            </a>
+            <div class="user-info">
+                <span>{{.Email}}</span>
+                <a href="/dashboard" class="btn btn-secondary">
+                    <span class="material-icons">arrow_back</span>
+                    <span class="hidden-mobile">Back to Inbox</span>
+                </a>
+            </div>
+        </div>
+    </div>
+
+    <!-- Main Content -->
+    <div class="container" style="margin-top: 20px;">
+        {{range .Domains}}
+        <div class="card" style="margin-bottom: 20px;">
+            <div class="card-body">
+                <div style="display: flex; align-items: center; justify-content: space-between; margin-bottom: 16px;">
+                    <h1 style="font-size: 22px; font-weight: 500; margin: 0; display: flex; align-items: center; gap: 8px;">
+                        <span class="material-icons">key</span>
+                        {{.Name}}
+                    </h1>
+                    {{if .Pending}}
+                    <button class="btn btn-primary" hx-post="/admin/dkim/{{.Name}}/activate"
+                            hx-confirm="Sign {{.Name}} mail with the new keys? Their TXT records must be published first.">
+                        <span class="material-icons">published_with_changes</span>
+                        Activate new keys
+                    </button>
+                    {{else}}
+                    <button class="btn btn-secondary" hx-post="/admin/dkim/{{.Name}}/rotate"
+                            hx-confirm="Generate new keys for {{.Name}}? The current keys keep signing until you publish the new records and activate them.">
+                        <span class="material-icons">autorenew</span>
+                        Rotate keys
+                    </button>
+                    {{end}}
+                </div>
+
+                {{range .Keys}}
+                <div style="padding: 12px 0; border-top: 1px solid var(--border-color);">
+                    <div style="display: flex; align-items: center; justify-content: space-between;">
+                        <div style="font-weight: 500;">
+                            {{.Selector}}
+                            {{if .Active}}<span class="unread-badge">Signing</span>{{else if .Pending}}<span style="font-size: 12px; color: var(--text-secondary);">Publish, then activate</span>{{else}}<span style="font-size: 12px; color: var(--text-secondary);">Retired</span>{{end}}
+                        </div>
+                        {{if not .Active}}
+                        <button class="btn btn-secondary" hx-post="/admin/dkim/keys/{{.ID}}/delete"
+                                hx-confirm="Delete {{.Selector}}? Remove its DNS record as well.">
+                            <span class="material-icons" style="font-size: 16px;">delete</span>
+                            Delete
+                        </button>
+                        {{end}}
+                    </div>
+                    <div style="font-size: 12px; color: var(--text-secondary);">{{.Algorithm}} &middot; created {{when .Created}}</div>
+                    <div style="font-size: 13px; margin-top: 8px;">TXT record for <code>{{.DNSName}}</code>:</div>
+                    <pre style="white-space: pre-wrap; word-break: break-all; font-size: 12px; background: var(--background-light); padding: 8px; border-radius: var(--border-radius);">{{.TXT}}</pre>
+                </div>
+                {{else}}
+                <p style="color: var(--text-secondary);">No keys yet.</p>
+                {{end}}
+            </div>
+        </div>
+        {{end}}
+    </div>
+</body>
+</html>`))
+
+	tmpl.Execute(w, struct {
+		Email     string
+		Domains   []dkimDomain
+		CSRFToken string
+	}{user.Email, domains, s.csrfToken(w, r)})
+}
+
+func (s *EmailServer) rotateDKIMHandler(w http.ResponseWriter, r *http.Request) {
+	domain, ok := s.dkimAdminDomain(w, r)
+	if !ok {
+		return
+	}
+	err := s.dkim.Rotate(domain)
+	if err == errDKIMRotationPending {
+		http.Error(w, "New keys are already waiting to be activated", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error rotating DKIM keys", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("HX-Redirect", "/admin/dkim")
+}
+
+func (s *EmailServer) activateDKIMHandler(w http.ResponseWriter, r *http.Request) {
+	domain, ok := s.dkimAdminDomain(w, r)
+	if !ok {
+		return
+	}
+	if err := s.dkim.Activate(domain); err != nil {
+		http.Error(w, "Error activating DKIM keys", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("HX-Redirect", "/admin/dkim")
+}
+
+// dkimAdminDomain returns the hosted domain named in the URL, or writes an
+// error if there is none or the user is not an admin.
+func (s *EmailServer) dkimAdminDomain(w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID := s.getUserID(r)
+	if userID == 0 || !s.isAdmin(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+
+	domain := mux.Vars(r)["domain"]
+	for _, d := range s.domains {
+		if d == domain {
+			return domain, true
+		}
+	}
+	http.Error(w, "Unknown domain", http.StatusNotFound)
+	return "", false
+}
+
+func (s *EmailServer) deleteDKIMKeyHandler(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserID(r)
+	if userID == 0 || !s.isAdmin(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid key", http.StatusBadRequest)
+		return
+	}
+	if err := s.dkim.DeleteRetired(id); err != nil {
+		http.Error(w, "Error deleting DKIM key", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("HX-Redirect", "/admin/dkim")
+}
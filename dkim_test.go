@@ -0,0 +1,95 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+var dkimSelectorParam = regexp.MustCompile(`s=([^;\s]+)`)
+
+// signingSelectors returns the selectors a message from domain is signed
+// with.
+func signingSelectors(t *testing.T, d *DKIMSigner, domain string) map[string]bool {
+	signed, err := d.Sign([]byte("From: bob@" + domain + "\r\nSubject: hi\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _, err := parseMessage(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selectors := make(map[string]bool)
+	fields := header.FieldsByKey("DKIM-Signature")
+	for fields.Next() {
+		if m := dkimSelectorParam.FindStringSubmatch(fields.Value()); m != nil {
+			selectors[m[1]] = true
+		}
+	}
+	return selectors
+}
+
+func TestDKIMRotationWaitsForActivation(t *testing.T) {
+	d := NewDKIMSigner(newTestDB(t))
+	const domain = "localhost.com"
+	if err := d.EnsureKeys([]string{domain}); err != nil {
+		t.Fatal(err)
+	}
+	first := signingSelectors(t, d, domain)
+	if len(first) != 2 {
+		t.Fatalf("signed with %v, want an RSA and an Ed25519 key", first)
+	}
+
+	if err := d.Rotate(domain); err != nil {
+		t.Fatal(err)
+	}
+	if got := signingSelectors(t, d, domain); len(got) != 2 || !subset(got, first) {
+		t.Errorf("after Rotate signed with %v, want the old keys %v", got, first)
+	}
+	if err := d.Rotate(domain); err != errDKIMRotationPending {
+		t.Errorf("second Rotate returned %v, want errDKIMRotationPending", err)
+	}
+
+	if err := d.Activate(domain); err != nil {
+		t.Fatal(err)
+	}
+	second := signingSelectors(t, d, domain)
+	if len(second) != 2 || subset(second, first) {
+		t.Errorf("after Activate signed with %v, want new keys", second)
+	}
+	if err := d.Activate(domain); err == nil {
+		t.Error("Activate without pending keys succeeded")
+	}
+
+	// Rotations within the same second still get selectors of their own
+	if err := d.Rotate(domain); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Activate(domain); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := d.Keys(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, retired := 0, 0
+	for _, key := range keys {
+		switch {
+		case key.Active:
+			active++
+		case !key.Pending:
+			retired++
+		}
+	}
+	if active != 2 || retired != 4 {
+		t.Errorf("got %d active and %d retired keys, want 2 and 4", active, retired)
+	}
+}
+
+func subset(a, b map[string]bool) bool {
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
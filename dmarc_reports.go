@@ -0,0 +1,902 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-msgauth/dmarc"
+)
+
+// DMARC aggregate reports (RFC 7489, section 7.2) go both ways. The DMARC
+// result of every message received on the MX port is counted per source
+// and day, and once a day is over each sender domain whose record has a
+// rua tag gets an XML report of it. Reports other receivers send about our
+// domains are read from the configured report mailbox and summarized on
+// the /admin/dmarc page.
+
+func (s *EmailServer) createDMARCReportTables() error {
+	// dmarc_results counts our own DMARC verdicts for outgoing reports,
+	// one row per policy domain, UTC day and distinct outcome.
+	resultsTable := `
+	CREATE TABLE IF NOT EXISTS dmarc_results (
+		domain TEXT NOT NULL,
+		day TEXT NOT NULL,
+		source_ip TEXT NOT NULL,
+		header_from TEXT NOT NULL,
+		envelope_from TEXT NOT NULL,
+		spf TEXT NOT NULL,
+		spf_aligned BOOLEAN NOT NULL,
+		dkim TEXT NOT NULL,
+		dkim_domains TEXT NOT NULL,
+		dkim_aligned BOOLEAN NOT NULL,
+		disposition TEXT NOT NULL,
+		count INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (domain, day, source_ip, header_from, envelope_from, spf, spf_aligned,
+			dkim, dkim_domains, dkim_aligned, disposition)
+	);
+	CREATE TABLE IF NOT EXISTS dmarc_reports_sent (
+		domain TEXT NOT NULL,
+		day TEXT NOT NULL,
+		report_id TEXT NOT NULL,
+		recipients TEXT NOT NULL,
+		sent DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (domain, day)
+	);`
+
+	// dmarc_reports and dmarc_report_rows hold the reports we received.
+	// dmarc_ingested remembers which messages in the report mailbox have
+	// been looked at, and why those that are not reports were skipped.
+	reportsTable := `
+	CREATE TABLE IF NOT EXISTS dmarc_reports (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id INTEGER NOT NULL,
+		org_name TEXT NOT NULL,
+		report_id TEXT NOT NULL,
+		domain TEXT NOT NULL,
+		policy TEXT NOT NULL,
+		date_begin DATETIME NOT NULL,
+		date_end DATETIME NOT NULL,
+		received DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (org_name, report_id)
+	);
+	CREATE TABLE IF NOT EXISTS dmarc_report_rows (
+		report_id INTEGER NOT NULL REFERENCES dmarc_reports(id) ON DELETE CASCADE,
+		source_ip TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		disposition TEXT NOT NULL,
+		dkim TEXT NOT NULL,
+		spf TEXT NOT NULL,
+		header_from TEXT NOT NULL,
+		envelope_from TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_dmarc_report_rows_report ON dmarc_report_rows(report_id);
+	CREATE TABLE IF NOT EXISTS dmarc_ingested (
+		message_id INTEGER PRIMARY KEY,
+		error TEXT NOT NULL DEFAULT ''
+	);`
+
+	if _, err := s.db.Exec(resultsTable); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(reportsTable); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// dmarcFeedback is the aggregate report format of RFC 7489, appendix C.
+type dmarcFeedback struct {
+	XMLName         xml.Name              `xml:"feedback"`
+	Version         string                `xml:"version,omitempty"`
+	Metadata        dmarcReportMetadata   `xml:"report_metadata"`
+	PolicyPublished dmarcPolicyPublished  `xml:"policy_published"`
+	Records         []dmarcFeedbackRecord `xml:"record"`
+}
+
+type dmarcReportMetadata struct {
+	OrgName   string         `xml:"org_name"`
+	Email     string         `xml:"email"`
+	ReportID  string         `xml:"report_id"`
+	DateRange dmarcDateRange `xml:"date_range"`
+}
+
+type dmarcDateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+type dmarcPolicyPublished struct {
+	Domain string `xml:"domain"`
+	ADKIM  string `xml:"adkim,omitempty"`
+	ASPF   string `xml:"aspf,omitempty"`
+	P      string `xml:"p"`
+	SP     string `xml:"sp,omitempty"`
+	Pct    int    `xml:"pct"`
+}
+
+type dmarcFeedbackRecord struct {
+	Row         dmarcRow         `xml:"row"`
+	Identifiers dmarcIdentifiers `xml:"identifiers"`
+	AuthResults dmarcAuthResults `xml:"auth_results"`
+}
+
+type dmarcRow struct {
+	SourceIP        string `xml:"source_ip"`
+	Count           int    `xml:"count"`
+	PolicyEvaluated struct {
+		Disposition string `xml:"disposition"`
+		DKIM        string `xml:"dkim"`
+		SPF         string `xml:"spf"`
+	} `xml:"policy_evaluated"`
+}
+
+type dmarcIdentifiers struct {
+	EnvelopeFrom string `xml:"envelope_from,omitempty"`
+	HeaderFrom   string `xml:"header_from"`
+}
+
+type dmarcAuthResults struct {
+	DKIM []dmarcDomainResult `xml:"dkim"`
+	SPF  []dmarcDomainResult `xml:"spf"`
+}
+
+type dmarcDomainResult struct {
+	Domain string `xml:"domain"`
+	Scope  string `xml:"scope,omitempty"`
+	Result string `xml:"result"`
+}
+
+// maxReportSize bounds a decompressed report, so a zip bomb in the report
+// mailbox cannot exhaust memory.
+const maxReportSize = 32 << 20
+
+// DMARCReports sends our aggregate reports and ingests the ones sent to us.
+type DMARCReports struct {
+	db       *sql.DB
+	hostname string
+	domains  []string
+	config   DMARCConfig
+	resolver AuthResolver
+
+	// send hands a finished report to delivery.
+	send func(from string, to []string, raw []byte) error
+	now  func() time.Time
+	wake chan struct{}
+}
+
+func NewDMARCReports(db *sql.DB, hostname string, domains []string, config DMARCConfig, resolver AuthResolver) *DMARCReports {
+	r := &DMARCReports{
+		db:       db,
+		hostname: hostname,
+		domains:  domains,
+		config:   config,
+		resolver: resolver,
+		now:      time.Now,
+		wake:     make(chan struct{}, 1),
+	}
+	// Reports from a domain we have no DKIM keys for would fail the
+	// recipient's DMARC check, if the domain is a real one at all
+	if r.config.SendReports && !r.hosts(addressDomain(r.reportFrom())) {
+		log.Printf("DMARC reports: not sending any, %s is not in a hosted domain; set report_from or hostname",
+			r.reportFrom())
+		r.config.SendReports = false
+	}
+	return r
+}
+
+// hosts reports whether domain is one of ours.
+func (r *DMARCReports) hosts(domain string) bool {
+	for _, d := range r.domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record counts one message towards the report for its policy domain.
+func (r *DMARCReports) Record(auth *MessageAuth) error {
+	_, err := r.db.Exec(`INSERT INTO dmarc_results (domain, day, source_ip, header_from, envelope_from, spf, spf_aligned,
+		dkim, dkim_domains, dkim_aligned, disposition, count) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 1)
+		ON CONFLICT (domain, day, source_ip, header_from, envelope_from, spf, spf_aligned,
+			dkim, dkim_domains, dkim_aligned, disposition) DO UPDATE SET count = count + 1`,
+		auth.DMARCDomain, r.now().UTC().Format("2006-01-02"), auth.RemoteIP, auth.HeaderFrom, auth.SPFDomain,
+		auth.SPF, auth.SPFAligned, auth.DKIM, auth.DKIMDomains, auth.DKIMAligned, auth.Disposition)
+	return err
+}
+
+// Watch wakes the report loop whenever mail reaches the report mailbox.
+func (r *DMARCReports) Watch(events *EventBus) {
+	if r.config.ReportMailbox == "" {
+		return
+	}
+	events.Subscribe(func(ev *MailboxEvent) {
+		if ev.Type == MessagesAdded && strings.EqualFold(ev.Username, r.config.ReportMailbox) {
+			r.Wake()
+		}
+	})
+}
+
+// Wake makes the report loop run right away.
+func (r *DMARCReports) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends the reports for days that have ended and ingests new mail in
+// the report mailbox, checking hourly until ctx is done.
+func (r *DMARCReports) Run(ctx context.Context) {
+	for {
+		if r.config.SendReports {
+			if err := r.SendDue(ctx); err != nil {
+				log.Printf("DMARC reports: %v", err)
+			}
+		}
+		if r.config.ReportMailbox != "" {
+			if err := r.IngestNew(); err != nil {
+				log.Printf("DMARC report ingestion: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+// SendDue sends a report for every domain and finished day of the last
+// week that has results but no report yet. A domain that could not be
+// reached is tried again on the next run.
+func (r *DMARCReports) SendDue(ctx context.Context) error {
+	today := r.now().UTC().Format("2006-01-02")
+	since := r.now().UTC().AddDate(0, 0, -7).Format("2006-01-02")
+	rows, err := r.db.Query(`SELECT DISTINCT domain, day FROM dmarc_results res
+		WHERE day >= ? AND day < ?
+		AND NOT EXISTS (SELECT 1 FROM dmarc_reports_sent s WHERE s.domain = res.domain AND s.day = res.day)
+		ORDER BY day, domain`, since, today)
+	if err != nil {
+		return err
+	}
+	var due [][2]string
+	for rows.Next() {
+		var domain, day string
+		if err := rows.Scan(&domain, &day); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, [2]string{domain, day})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range due {
+		if err := r.sendReport(ctx, d[0], d[1]); err != nil {
+			log.Printf("DMARC report for %s on %s not sent: %v", d[0], d[1], err)
+		}
+	}
+
+	// Results are only needed until their report is out.
+	_, err = r.db.Exec("DELETE FROM dmarc_results WHERE day < ?", since)
+	return err
+}
+
+func (r *DMARCReports) sendReport(ctx context.Context, domain, day string) error {
+	record, err := dmarc.LookupWithOptions(domain, &dmarc.LookupOptions{
+		LookupTXT: func(name string) ([]string, error) { return r.resolver.LookupTXT(ctx, name) },
+	})
+	if dmarc.IsTempFail(err) {
+		return err
+	}
+
+	reportID := fmt.Sprintf("%s.%s@%s", strings.ReplaceAll(day, "-", ""), domain, r.hostname)
+	var recipients []string
+	if err == nil && len(record.ReportURIAggregate) > 0 {
+		report, err := r.buildReport(domain, day, reportID, record)
+		if err != nil {
+			return err
+		}
+		// Base64 makes the attachment a third larger.
+		recipients = r.reportRecipients(ctx, domain, record.ReportURIAggregate, len(report)*4/3)
+		if len(recipients) > 0 {
+			raw := r.composeReport(domain, day, reportID, recipients, report)
+			if err := r.send(r.reportFrom(), recipients, raw); err != nil {
+				return err
+			}
+			log.Printf("Sent DMARC report for %s on %s to %s", domain, day, strings.Join(recipients, ", "))
+		}
+	}
+	_, err = r.db.Exec("INSERT INTO dmarc_reports_sent (domain, day, report_id, recipients) VALUES (?, ?, ?, ?)",
+		domain, day, reportID, strings.Join(recipients, ", "))
+	return err
+}
+
+func (r *DMARCReports) reportFrom() string {
+	if r.config.ReportFrom != "" {
+		return r.config.ReportFrom
+	}
+	return "dmarc-reports@" + r.hostname
+}
+
+// reportRecipients picks the mailto: addresses from a rua tag whose size
+// limit, if any, allows a report of size bytes. Addresses outside the
+// policy domain must have agreed to receive its reports (RFC 7489, 7.1).
+func (r *DMARCReports) reportRecipients(ctx context.Context, domain string, uris []string, size int) []string {
+	var recipients []string
+	for _, uri := range uris {
+		if !strings.HasPrefix(strings.ToLower(uri), "mailto:") {
+			continue
+		}
+		addr := uri[len("mailto:"):]
+		if bang := strings.LastIndex(addr, "!"); bang >= 0 {
+			limit, ok := parseReportSizeLimit(addr[bang+1:])
+			addr = addr[:bang]
+			if ok && int64(size) > limit {
+				log.Printf("DMARC report for %s too large for %s", domain, addr)
+				continue
+			}
+		}
+		addrDomain := addressDomain(addr)
+		if addrDomain == "" {
+			continue
+		}
+		if organizationalDomain(addrDomain) != organizationalDomain(domain) && !r.acceptsReports(ctx, domain, addrDomain) {
+			log.Printf("DMARC reports for %s not sent to %s: %s has not authorized them", domain, addr, addrDomain)
+			continue
+		}
+		recipients = append(recipients, addr)
+	}
+	return recipients
+}
+
+// acceptsReports reports whether dest publishes a record agreeing to get
+// domain's reports.
+func (r *DMARCReports) acceptsReports(ctx context.Context, domain, dest string) bool {
+	txts, err := r.resolver.LookupTXT(ctx, domain+"._report._dmarc."+dest)
+	if err != nil {
+		return false
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReportSizeLimit parses the size after "!" in a rua URI, such as
+// "50m".
+func parseReportSizeLimit(s string) (int64, bool) {
+	unit := int64(1)
+	if s != "" {
+		switch strings.ToLower(s[len(s)-1:]) {
+		case "k":
+			unit = 1 << 10
+		case "m":
+			unit = 1 << 20
+		case "g":
+			unit = 1 << 30
+		case "t":
+			unit = 1 << 40
+		}
+		if unit > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n * unit, true
+}
+
+// buildReport writes the gzipped XML report for domain and day.
+func (r *DMARCReports) buildReport(domain, day, reportID string, record *dmarc.Record) ([]byte, error) {
+	begin, err := time.Parse("2006-01-02", day)
+	if err != nil {
+		return nil, err
+	}
+	end := begin.AddDate(0, 0, 1)
+
+	feedback := dmarcFeedback{
+		Version: "1.0",
+		Metadata: dmarcReportMetadata{
+			OrgName:   r.hostname,
+			Email:     r.reportFrom(),
+			ReportID:  reportID,
+			DateRange: dmarcDateRange{Begin: begin.Unix(), End: end.Unix() - 1},
+		},
+		PolicyPublished: dmarcPolicyPublished{
+			Domain: domain,
+			ADKIM:  string(record.DKIMAlignment),
+			ASPF:   string(record.SPFAlignment),
+			P:      string(record.Policy),
+			SP:     string(record.SubdomainPolicy),
+			Pct:    100,
+		},
+	}
+	if record.Percent != nil {
+		feedback.PolicyPublished.Pct = *record.Percent
+	}
+
+	rows, err := r.db.Query(`SELECT source_ip, header_from, envelope_from, spf, spf_aligned, dkim, dkim_domains,
+		dkim_aligned, disposition, count FROM dmarc_results WHERE domain = ? AND day = ? ORDER BY source_ip`, domain, day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var rec dmarcFeedbackRecord
+		var spf, dkim, dkimDomains string
+		var spfAligned, dkimAligned bool
+		if err := rows.Scan(&rec.Row.SourceIP, &rec.Identifiers.HeaderFrom, &rec.Identifiers.EnvelopeFrom, &spf,
+			&spfAligned, &dkim, &dkimDomains, &dkimAligned, &rec.Row.PolicyEvaluated.Disposition, &rec.Row.Count); err != nil {
+			return nil, err
+		}
+		rec.Row.PolicyEvaluated.SPF = passOrFail(spfAligned)
+		rec.Row.PolicyEvaluated.DKIM = passOrFail(dkimAligned)
+		for _, d := range strings.Fields(dkimDomains) {
+			rec.AuthResults.DKIM = append(rec.AuthResults.DKIM, dmarcDomainResult{Domain: d, Result: "pass"})
+		}
+		rec.AuthResults.SPF = []dmarcDomainResult{{Domain: rec.Identifiers.EnvelopeFrom, Scope: "mfrom", Result: spf}}
+		feedback.Records = append(feedback.Records, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	io.WriteString(zw, xml.Header)
+	enc := xml.NewEncoder(zw)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feedback); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// composeReport wraps a report in a message as RFC 7489, section 7.2.1.1
+// describes.
+func (r *DMARCReports) composeReport(domain, day, reportID string, recipients []string, report []byte) []byte {
+	begin, _ := time.Parse("2006-01-02", day)
+	filename := fmt.Sprintf("%s!%s!%d!%d.xml.gz", r.hostname, domain, begin.Unix(), begin.AddDate(0, 0, 1).Unix()-1)
+	from := r.reportFrom()
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&buf, "Subject: Report Domain: %s Submitter: %s Report-ID: <%s>\r\n", domain, r.hostname, reportID)
+	fmt.Fprintf(&buf, "Date: %s\r\n", r.now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-Id: %s\r\n", newMessageID(from))
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(&buf, "Mime-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mw.Boundary())
+
+	part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	fmt.Fprintf(part, "This is a DMARC aggregate report from %s for %s, covering %s (UTC).\r\n", r.hostname, domain, day)
+
+	part, _ = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {fmt.Sprintf("application/gzip; name=%q", filename)},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", filename)},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	encoded := base64.StdEncoding.EncodeToString(report)
+	for len(encoded) > 76 {
+		io.WriteString(part, encoded[:76]+"\r\n")
+		encoded = encoded[76:]
+	}
+	io.WriteString(part, encoded+"\r\n")
+
+	mw.Close()
+	return buf.Bytes()
+}
+
+func passOrFail(ok bool) string {
+	if ok {
+		return "pass"
+	}
+	return "fail"
+}
+
+// IngestNew reads every message in the report mailbox that has not been
+// looked at yet.
+func (r *DMARCReports) IngestNew() error {
+	ids, err := queryIDs(r.db, `SELECT DISTINCT e.message_id FROM emails e
+		JOIN mailboxes m ON m.id = e.mailbox_id JOIN users u ON u.id = m.user_id
+		WHERE u.email = lower(?) AND e.message_id NOT IN (SELECT message_id FROM dmarc_ingested)
+		ORDER BY e.message_id`, r.config.ReportMailbox)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		msg, err := loadMessage(r.db, id)
+		if err != nil {
+			return err
+		}
+		reason := ""
+		if err := r.ingest(msg); err != nil {
+			log.Printf("DMARC report in message %d skipped: %v", id, err)
+			reason = err.Error()
+		}
+		if _, err := r.db.Exec("INSERT INTO dmarc_ingested (message_id, error) VALUES (?, ?)", id, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ingest stores the aggregate reports attached to msg, as XML or zipped or
+// gzipped XML.
+func (r *DMARCReports) ingest(msg *StoredMessage) error {
+	content, err := msg.MIME()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, a := range content.Attachments {
+		documents, err := reportDocuments(a)
+		if err != nil {
+			return fmt.Errorf("%s: %v", a.Filename, err)
+		}
+		for _, doc := range documents {
+			var feedback dmarcFeedback
+			if err := xml.Unmarshal(doc, &feedback); err != nil {
+				return fmt.Errorf("%s: %v", a.Filename, err)
+			}
+			if err := r.storeReport(msg.ID, &feedback); err != nil {
+				return err
+			}
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("no aggregate report attached")
+	}
+	return nil
+}
+
+// reportDocuments unpacks the XML documents in an attachment.
+func reportDocuments(a Attachment) ([][]byte, error) {
+	name := strings.ToLower(a.Filename)
+	switch {
+	case a.ContentType == "application/zip" || a.ContentType == "application/x-zip-compressed" ||
+		strings.HasSuffix(name, ".zip"):
+		zr, err := zip.NewReader(bytes.NewReader(a.data), int64(len(a.data)))
+		if err != nil {
+			return nil, err
+		}
+		var documents [][]byte
+		for _, f := range zr.File {
+			if !strings.EqualFold(path.Ext(f.Name), ".xml") {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			doc, err := readReport(rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			documents = append(documents, doc)
+		}
+		return documents, nil
+
+	case a.ContentType == "application/gzip" || a.ContentType == "application/x-gzip" ||
+		strings.HasSuffix(name, ".gz"):
+		zr, err := gzip.NewReader(bytes.NewReader(a.data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		doc, err := readReport(zr)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{doc}, nil
+
+	case a.ContentType == "text/xml" || a.ContentType == "application/xml" || strings.HasSuffix(name, ".xml"):
+		return [][]byte{a.data}, nil
+	}
+	return nil, nil
+}
+
+func readReport(r io.Reader) ([]byte, error) {
+	doc, err := io.ReadAll(io.LimitReader(r, maxReportSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(doc) > maxReportSize {
+		return nil, errors.New("report too large")
+	}
+	return doc, nil
+}
+
+// storeReport saves a received report about one of our domains. A report
+// already stored, as identified by its sender and ID, is left alone.
+func (r *DMARCReports) storeReport(messageID int64, f *dmarcFeedback) error {
+	domain := strings.ToLower(f.PolicyPublished.Domain)
+	if !r.hosts(domain) {
+		return fmt.Errorf("report for %q, which we do not host", f.PolicyPublished.Domain)
+	}
+	if f.Metadata.ReportID == "" || f.Metadata.OrgName == "" {
+		return errors.New("report without org_name or report_id")
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT OR IGNORE INTO dmarc_reports (message_id, org_name, report_id, domain, policy, date_begin, date_end)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		messageID, f.Metadata.OrgName, f.Metadata.ReportID, domain, f.PolicyPublished.P,
+		time.Unix(f.Metadata.DateRange.Begin, 0).UTC().Format(sqliteTimeLayout),
+		time.Unix(f.Metadata.DateRange.End, 0).UTC().Format(sqliteTimeLayout))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	reportID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range f.Records {
+		_, err := tx.Exec(`INSERT INTO dmarc_report_rows (report_id, source_ip, count, disposition, dkim, spf, header_from, envelope_from)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			reportID, rec.Row.SourceIP, rec.Row.Count, rec.Row.PolicyEvaluated.Disposition,
+			rec.Row.PolicyEvaluated.DKIM, rec.Row.PolicyEvaluated.SPF,
+			strings.ToLower(rec.Identifiers.HeaderFrom), rec.Identifiers.EnvelopeFrom)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// dmarcSource is one sending IP on the DMARC page.
+type dmarcSource struct {
+	Domain      string
+	SourceIP    string
+	Messages    int
+	Passed      int
+	Quarantined int
+	Rejected    int
+	Reporters   string
+	LastSeen    string
+}
+
+// PassRate is the share of the source's messages that passed DMARC.
+func (s dmarcSource) PassRate() int {
+	if s.Messages == 0 {
+		return 0
+	}
+	return s.Passed * 100 / s.Messages
+}
+
+type dmarcReportView struct {
+	OrgName  string
+	ReportID string
+	Domain   string
+	Begin    string
+	End      string
+	Messages int
+	Failed   int
+}
+
+// dmarcAdminHandler summarizes the last 30 days of received reports: who
+// sends mail as our domains, and whether it passes.
+func (s *EmailServer) dmarcAdminHandler(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserID(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !s.isAdmin(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var user User
+	s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&user.Email)
+
+	since := time.Now().UTC().AddDate(0, 0, -30).Format(sqliteTimeLayout)
+	rows, err := s.db.Query(`SELECT d.domain, rr.source_ip, SUM(rr.count),
+		SUM(CASE WHEN rr.dkim = 'pass' OR rr.spf = 'pass' THEN rr.count ELSE 0 END),
+		SUM(CASE WHEN rr.disposition = 'quarantine' THEN rr.count ELSE 0 END),
+		SUM(CASE WHEN rr.disposition = 'reject' THEN rr.count ELSE 0 END),
+		GROUP_CONCAT(DISTINCT d.org_name), MAX(d.date_end)
+		FROM dmarc_report_rows rr JOIN dmarc_reports d ON d.id = rr.report_id
+		WHERE d.date_end >= ?
+		GROUP BY d.domain, rr.source_ip
+		ORDER BY d.domain, SUM(rr.count) DESC`, since)
+	if err != nil {
+		http.Error(w, "Error loading DMARC reports", http.StatusInternalServerError)
+		return
+	}
+	var sources []dmarcSource
+	for rows.Next() {
+		var src dmarcSource
+		var lastSeen string
+		if err := rows.Scan(&src.Domain, &src.SourceIP, &src.Messages, &src.Passed, &src.Quarantined,
+			&src.Rejected, &src.Reporters, &lastSeen); err != nil {
+			rows.Close()
+			http.Error(w, "Error loading DMARC reports", http.StatusInternalServerError)
+			return
+		}
+		src.Reporters = strings.ReplaceAll(src.Reporters, ",", ", ")
+		src.LastSeen = parseTimestamp(lastSeen).Format("Jan 2, 2006")
+		sources = append(sources, src)
+	}
+	rows.Close()
+
+	rows, err = s.db.Query(`SELECT d.org_name, d.report_id, d.domain, d.date_begin, d.date_end,
+		COALESCE(SUM(rr.count), 0), COALESCE(SUM(CASE WHEN rr.dkim != 'pass' AND rr.spf != 'pass' THEN rr.count ELSE 0 END), 0)
+		FROM dmarc_reports d LEFT JOIN dmarc_report_rows rr ON rr.report_id = d.id
+		GROUP BY d.id ORDER BY d.date_end DESC, d.id DESC LIMIT 50`)
+	if err != nil {
+		http.Error(w, "Error loading DMARC reports", http.StatusInternalServerError)
+		return
+	}
+	var reports []dmarcReportView
+	for rows.Next() {
+		var rep dmarcReportView
+		var begin, end string
+		if err := rows.Scan(&rep.OrgName, &rep.ReportID, &rep.Domain, &begin, &end, &rep.Messages, &rep.Failed); err != nil {
+			rows.Close()
+			http.Error(w, "Error loading DMARC reports", http.StatusInternalServerError)
+			return
+		}
+		rep.Begin = parseTimestamp(begin).Format("Jan 2 15:04")
+		rep.End = parseTimestamp(end).Format("Jan 2 15:04")
+		reports = append(reports, rep)
+	}
+	rows.Close()
+
+	tmpl := template.Must(template.New("dmarc").Parse(`
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="csrf-token" content="{{.CSRFToken}}">
+    <title>DMARC Reports - Email Server</title>
+    <script src="https://unpkg.com/htmx.org@1.9.6"></script>
+    <script src="/static/csrf.js"></script>
+    <link rel="stylesheet" href="/static/style.css">
+    <link href="https://fonts.googleapis.com/css2?family=Google+Sans:wght@400;500;600&display=swap" rel="stylesheet">
+    <link href="https://fonts.googleapis.com/icon?family=Material+Icons" rel="stylesheet">
+</head>
+<body>
+    <!-- Header -->
+    <div class="header">
+        <div class="header-content">
+            <a href="/dashboard" class="logo">
+                <span class="material-icons">email</span>
+                Email
+            </a>
+            <div class="user-info">
+                <span>{{.Email}}</span>
+                <a href="/dashboard" class="btn btn-secondary">
+                    <span class="material-icons">arrow_back</span>
+                    <span class="hidden-mobile">Back to Inbox</span>
+                </a>
+            </div>
+        </div>
+    </div>
+
+    <!-- Main Content -->
+    <div class="container" style="margin-top: 20px;">
+        <div class="card" style="margin-bottom: 20px;">
+            <div class="card-body">
+                <h1 style="font-size: 22px; font-weight: 500; margin: 0 0 8px; display: flex; align-items: center; gap: 8px;">
+                    <span class="material-icons">policy</span>
+                    Who sends as our domains
+                </h1>
+                <p style="color: var(--text-secondary); font-size: 13px; margin-bottom: 16px;">
+                    Sources seen in the aggregate reports of the last 30 days.
+                    {{if .ReportMailbox}}Reports are read from {{.ReportMailbox}}; list it as <code>rua=mailto:{{.ReportMailbox}}</code> in each domain's DMARC record.
+                    {{else}}Set <code>dmarc.report_mailbox</code> to collect reports.{{end}}
+                </p>
+                {{if .Sources}}
+                <table style="width: 100%; font-size: 13px; border-collapse: collapse;">
+                    <tr style="text-align: left; color: var(--text-secondary);">
+                        <th style="padding: 6px;">Domain</th><th style="padding: 6px;">Source IP</th>
+                        <th style="padding: 6px;">Messages</th><th style="padding: 6px;">DMARC pass</th>
+                        <th style="padding: 6px;">Quarantined / rejected</th><th style="padding: 6px;">Reported by</th>
+                        <th style="padding: 6px;">Last seen</th>
+                    </tr>
+                    {{range .Sources}}
+                    <tr style="border-top: 1px solid var(--border-color);">
+                        <td style="padding: 6px;">{{.Domain}}</td>
+                        <td style="padding: 6px;"><code>{{.SourceIP}}</code></td>
+                        <td style="padding: 6px;">{{.Messages}}</td>
+                        <td style="padding: 6px;">
+                            {{if eq .Passed .Messages}}<span class="bg-green-100 text-green-800 px-2 py-1 rounded">{{.PassRate}}%</span>
+                            {{else}}<span class="bg-red-100 text-red-800 px-2 py-1 rounded">{{.PassRate}}%</span>{{end}}
+                        </td>
+                        <td style="padding: 6px;">{{.Quarantined}} / {{.Rejected}}</td>
+                        <td style="padding: 6px;">{{.Reporters}}</td>
+                        <td style="padding: 6px;">{{.LastSeen}}</td>
+                    </tr>
+                    {{end}}
+                </table>
+                {{else}}
+                <p style="color: var(--text-secondary);">No reports received yet.</p>
+                {{end}}
+            </div>
+        </div>
+
+        {{if .Reports}}
+        <div class="card">
+            <div class="card-body">
+                <h2 style="font-size: 18px; font-weight: 500; margin: 0 0 12px;">Recent reports</h2>
+                <table style="width: 100%; font-size: 13px; border-collapse: collapse;">
+                    <tr style="text-align: left; color: var(--text-secondary);">
+                        <th style="padding: 6px;">Reporter</th><th style="padding: 6px;">Domain</th>
+                        <th style="padding: 6px;">Period (UTC)</th><th style="padding: 6px;">Messages</th>
+                        <th style="padding: 6px;">Failed</th><th style="padding: 6px;">Report ID</th>
+                    </tr>
+                    {{range .Reports}}
+                    <tr style="border-top: 1px solid var(--border-color);">
+                        <td style="padding: 6px;">{{.OrgName}}</td>
+                        <td style="padding: 6px;">{{.Domain}}</td>
+                        <td style="padding: 6px;">{{.Begin}} – {{.End}}</td>
+                        <td style="padding: 6px;">{{.Messages}}</td>
+                        <td style="padding: 6px;">{{.Failed}}</td>
+                        <td style="padding: 6px; word-break: break-all;">{{.ReportID}}</td>
+                    </tr>
+                    {{end}}
+                </table>
+            </div>
+        </div>
+        {{end}}
+    </div>
+</body>
+</html>`))
+
+	tmpl.Execute(w, struct {
+		Email         string
+		ReportMailbox string
+		Sources       []dmarcSource
+		Reports       []dmarcReportView
+		CSRFToken     string
+	}{user.Email, s.config.DMARC.ReportMailbox, sources, reports, s.csrfToken(w, r)})
+}
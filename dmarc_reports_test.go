@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestDMARCReportsOnlySentFromHostedDomain(t *testing.T) {
+	domains := []string{"localhost.com"}
+	tests := []struct {
+		name     string
+		hostname string
+		from     string
+		send     bool
+	}{
+		{"default hostname", "localhost", "", false},
+		{"hosted hostname", "localhost.com", "", true},
+		{"hosted report_from", "localhost", "dmarc-reports@localhost.com", true},
+		{"foreign report_from", "localhost.com", "dmarc@example.org", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DMARCConfig{SendReports: true, ReportFrom: tt.from}
+			r := NewDMARCReports(nil, tt.hostname, domains, config, authZone{})
+			if r.config.SendReports != tt.send {
+				t.Errorf("sending reports is %v, want %v", r.config.SendReports, tt.send)
+			}
+		})
+	}
+	if defaultConfig().DMARC.SendReports {
+		t.Error("reports are sent by default")
+	}
+}
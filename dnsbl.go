@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Before the MX listener takes mail, the client's IP is matched against
+// the static allow and deny lists and looked up in the configured DNS
+// blocklists (DNSBLs), and the MAIL FROM domain in the domain blocklists
+// (RHSBLs). Lookup results are cached. A listed client or sender gets a
+// 554, and a lookup that fails for a reason other than the name not
+// existing gets a 451 so the client tries again later.
+
+// BlocklistResolver is the DNS the blocklists are queried through.
+// *net.Resolver satisfies it; tests can answer from a fake zone.
+type BlocklistResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Blocklists decides whether the MX listener talks to a client.
+type Blocklists struct {
+	zones       []string
+	domainZones []string
+	allow, deny []*net.IPNet
+	resolver    BlocklistResolver
+	timeout     time.Duration
+	ttl         time.Duration
+	now         func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]blocklistEntry
+}
+
+// blocklistEntry is a cached lookup of one name in one zone.
+type blocklistEntry struct {
+	listed  bool
+	reason  string // the zone's TXT record, if it has one
+	expires time.Time
+}
+
+// maxBlocklistCache is the number of cached lookups after which expired
+// ones are dropped.
+const maxBlocklistCache = 10000
+
+func NewBlocklists(config BlocklistConfig, resolver BlocklistResolver) (*Blocklists, error) {
+	allow, err := parseCIDRs(config.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("blocklists allow: %v", err)
+	}
+	deny, err := parseCIDRs(config.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("blocklists deny: %v", err)
+	}
+	return &Blocklists{
+		zones:       config.Zones,
+		domainZones: config.DomainZones,
+		allow:       allow,
+		deny:        deny,
+		resolver:    resolver,
+		timeout:     10 * time.Second,
+		ttl:         time.Duration(config.CacheTTL),
+		now:         time.Now,
+		cache:       make(map[string]blocklistEntry),
+	}, nil
+}
+
+// parseCIDRs parses CIDR ranges; a plain address stands for itself.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether ip is on the allow list, which exempts it from
+// every other check.
+func (b *Blocklists) Allowed(ip net.IP) bool {
+	return b != nil && ip != nil && containsIP(b.allow, ip)
+}
+
+// CheckClient returns the SMTP error to refuse a client with, or nil if
+// neither the deny list nor a DNSBL has its IP.
+func (b *Blocklists) CheckClient(ip net.IP) error {
+	if b == nil || ip == nil || b.Allowed(ip) {
+		return nil
+	}
+	if containsIP(b.deny, ip) {
+		log.Printf("Blocklists: refused %s: on the deny list", ip)
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Client host [%s] blocked by local policy", ip),
+		}
+	}
+
+	name := reverseIP(ip)
+	for _, zone := range b.zones {
+		entry, err := b.lookup(name + "." + zone)
+		if err != nil {
+			log.Printf("Blocklists: looking up %s in %s: %v", ip, zone, err)
+			return &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+				Message:      fmt.Sprintf("Temporary failure looking up [%s] in %s; try again later", ip, zone),
+			}
+		}
+		if entry.listed {
+			log.Printf("Blocklists: refused %s: listed in %s", ip, zone)
+			return &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      blockedMessage(fmt.Sprintf("Client host [%s] blocked using %s", ip, zone), entry.reason),
+			}
+		}
+	}
+	return nil
+}
+
+// CheckSender returns the SMTP error to refuse a MAIL FROM address with,
+// or nil if its domain is on no RHSBL. Bounces, which have no sender, and
+// allowed clients are not checked.
+func (b *Blocklists) CheckSender(ip net.IP, from string) error {
+	domain := addressDomain(from)
+	if b == nil || domain == "" || b.Allowed(ip) {
+		return nil
+	}
+
+	for _, zone := range b.domainZones {
+		entry, err := b.lookup(strings.TrimSuffix(domain, ".") + "." + zone)
+		if err != nil {
+			log.Printf("Blocklists: looking up %s in %s: %v", domain, zone, err)
+			return &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 4, 3},
+				Message:      fmt.Sprintf("Temporary failure looking up %s in %s; try again later", domain, zone),
+			}
+		}
+		if entry.listed {
+			log.Printf("Blocklists: refused sender %s from %s: listed in %s", from, ip, zone)
+			return &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      blockedMessage(fmt.Sprintf("Sender domain %s blocked using %s", domain, zone), entry.reason),
+			}
+		}
+	}
+	return nil
+}
+
+func blockedMessage(message, reason string) string {
+	if reason != "" {
+		message += "; " + reason
+	}
+	return message
+}
+
+// lookup queries one blocklist name, answering from the cache when it
+// can. Only answers in 127.0.0.0/8 mean the name is listed; lists answer
+// 127.255.255.x to refuse a query, for instance from a public resolver,
+// which is logged and counts as not listed. Failed lookups are not cached.
+func (b *Blocklists) lookup(name string) (blocklistEntry, error) {
+	now := b.now()
+	b.mu.Lock()
+	entry, ok := b.cache[name]
+	b.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), b.timeout)
+	defer cancel()
+
+	entry = blocklistEntry{expires: now.Add(b.ttl)}
+	addrs, err := b.resolver.LookupIPAddr(ctx, name)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		err = nil
+	}
+	if err != nil {
+		return entry, err
+	}
+	for _, addr := range addrs {
+		ip := addr.IP.To4()
+		if ip == nil || ip[0] != 127 {
+			continue
+		}
+		if ip[1] == 255 && ip[2] == 255 {
+			log.Printf("Blocklists: query for %s refused with %s", name, ip)
+			continue
+		}
+		entry.listed = true
+	}
+	if entry.listed {
+		if txt, err := b.resolver.LookupTXT(ctx, name); err == nil && len(txt) > 0 {
+			entry.reason = txt[0]
+		}
+	}
+
+	b.mu.Lock()
+	if len(b.cache) >= maxBlocklistCache {
+		for cached, e := range b.cache {
+			if !now.Before(e.expires) {
+				delete(b.cache, cached)
+			}
+		}
+	}
+	b.cache[name] = entry
+	b.mu.Unlock()
+	return entry, nil
+}
+
+// reverseIP returns the name ip is looked up under in a DNSBL zone: the
+// octets of an IPv4 address, or the nibbles of an IPv6 one, in reverse.
+func reverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	ip16 := ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", ip16[i]&0xf), fmt.Sprintf("%x", ip16[i]>>4))
+	}
+	return strings.Join(nibbles, ".")
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// blocklistZone answers blocklist queries from memory and counts them.
+// Names in fail give a temporary DNS error.
+type blocklistZone struct {
+	a     map[string]string
+	txt   map[string]string
+	fail  map[string]bool
+	calls map[string]int
+}
+
+func (z *blocklistZone) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	z.calls[host]++
+	if z.fail[host] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	if ip, ok := z.a[host]; ok {
+		return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (z *blocklistZone) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := z.txt[name]; ok {
+		return []string{txt}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func newTestBlocklists(t *testing.T) (*Blocklists, *blocklistZone) {
+	zone := &blocklistZone{
+		a: map[string]string{
+			"2.0.0.127.bl.test":      "127.0.0.2",
+			"7.100.51.198.bl.test":   "127.0.0.4",
+			"9.100.51.198.bl.test":   "127.255.255.254",
+			"spam.example.dbl.test":  "127.0.1.2",
+			"other.example.dbl.test": "192.0.2.1",
+		},
+		txt:   map[string]string{"7.100.51.198.bl.test": "listed for testing"},
+		fail:  map[string]bool{"8.100.51.198.bl.test": true, "broken.example.dbl.test": true},
+		calls: make(map[string]int),
+	}
+	b, err := NewBlocklists(BlocklistConfig{
+		Allow:       []string{"10.1.2.3"},
+		Deny:        []string{"10.0.0.0/8", "2001:db8:bad::/48"},
+		Zones:       []string{"bl.test"},
+		DomainZones: []string{"dbl.test"},
+		CacheTTL:    Duration(time.Minute),
+	}, zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, zone
+}
+
+// smtpCode returns the code of an SMTP error, 0 for nil and -1 for any
+// other error.
+func smtpCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); ok {
+		return smtpErr.Code
+	}
+	return -1
+}
+
+func TestBlocklistsCheckClient(t *testing.T) {
+	b, _ := newTestBlocklists(t)
+	tests := []struct {
+		name   string
+		ip     string
+		code   int
+		reason string
+	}{
+		{"denied", "10.9.9.9", 554, "local policy"},
+		{"denied v6", "2001:db8:bad::1", 554, "local policy"},
+		{"allowed over denied", "10.1.2.3", 0, ""},
+		{"listed", "127.0.0.2", 554, "blocked using bl.test"},
+		{"listed with reason", "198.51.100.7", 554, "listed for testing"},
+		{"query refused", "198.51.100.9", 0, ""},
+		{"lookup failure", "198.51.100.8", 451, "try again later"},
+		{"not listed", "192.0.2.1", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := b.CheckClient(net.ParseIP(tt.ip))
+			if smtpCode(err) != tt.code || (tt.reason != "" && !strings.Contains(err.Error(), tt.reason)) {
+				t.Errorf("got %v, want code %d mentioning %q", err, tt.code, tt.reason)
+			}
+		})
+	}
+}
+
+func TestBlocklistsCheckSender(t *testing.T) {
+	b, _ := newTestBlocklists(t)
+	tests := []struct {
+		name string
+		ip   string
+		from string
+		code int
+	}{
+		{"listed", "192.0.2.1", "a@spam.example", 554},
+		{"listed domain case", "192.0.2.1", "a@SPAM.example", 554},
+		{"answer outside 127/8", "192.0.2.1", "a@other.example", 0},
+		{"not listed", "192.0.2.1", "a@ok.example", 0},
+		{"lookup failure", "192.0.2.1", "a@broken.example", 451},
+		{"bounce", "192.0.2.1", "", 0},
+		{"allowed client", "10.1.2.3", "a@spam.example", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := b.CheckSender(net.ParseIP(tt.ip), tt.from); smtpCode(err) != tt.code {
+				t.Errorf("got %v, want code %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestBlocklistsCache(t *testing.T) {
+	b, zone := newTestBlocklists(t)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	ip := net.ParseIP("127.0.0.2")
+	b.CheckClient(ip)
+	b.CheckClient(ip)
+	if n := zone.calls["2.0.0.127.bl.test"]; n != 1 {
+		t.Errorf("looked up %d times within the TTL, want once", n)
+	}
+	now = now.Add(2 * time.Minute)
+	b.CheckClient(ip)
+	if n := zone.calls["2.0.0.127.bl.test"]; n != 2 {
+		t.Errorf("looked up %d times after the TTL, want twice", n)
+	}
+
+	// Failures are not cached
+	failing := net.ParseIP("198.51.100.8")
+	b.CheckClient(failing)
+	b.CheckClient(failing)
+	if n := zone.calls["8.100.51.198.bl.test"]; n != 2 {
+		t.Errorf("failed lookup made %d times, want 2", n)
+	}
+}
+
+func TestReverseIP(t *testing.T) {
+	tests := []struct{ ip, want string }{
+		{"192.0.2.1", "1.2.0.192"},
+		{"::ffff:192.0.2.1", "1.2.0.192"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"},
+	}
+	for _, tt := range tests {
+		if got := reverseIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("reverseIP(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestNewBlocklistsRejectsBadRanges(t *testing.T) {
+	for _, value := range []string{"bogus", "10.0.0.0/33"} {
+		if _, err := NewBlocklists(BlocklistConfig{Deny: []string{value}}, &blocklistZone{}); err == nil {
+			t.Errorf("deny %q accepted", value)
+		}
+	}
+}
+
+// TestMXRefusesListedClients talks to the MX listener from 127.0.0.1,
+// which is listed, and then with only the sender domains checked.
+func TestMXRefusesListedClients(t *testing.T) {
+	db := newTestDB(t)
+	newTestUser(t, db, "bob@localhost.com")
+	queue := NewOutboundQueue(db, "localhost.com", defaultConfig().Outbound, nil)
+	delivery := NewDelivery(db, []string{"localhost.com"}, queue, NewEventBus(db))
+	auth := NewAuthenticator("mx.localhost.com", authZone{})
+
+	serve := func(b *Blocklists) *smtp.Client {
+		srv := smtp.NewServer(NewSMTPBackend(db, delivery, defaultConfig().SMTP, auth, nil, b))
+		srv.Domain = "mx.localhost.com"
+		srv.AuthDisabled = true
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(l)
+		t.Cleanup(func() { srv.Close() })
+		c, err := smtp.Dial(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	zone := &blocklistZone{
+		a:     map[string]string{"1.0.0.127.bl.test": "127.0.0.2", "spam.example.dbl.test": "127.0.1.2"},
+		txt:   map[string]string{"1.0.0.127.bl.test": "listed for testing"},
+		calls: make(map[string]int),
+	}
+	clients, err := NewBlocklists(BlocklistConfig{Zones: []string{"bl.test"}}, zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = serve(clients).Hello("client.example")
+	if smtpCode(err) != 554 || !strings.Contains(err.Error(), "listed for testing") {
+		t.Errorf("EHLO from a listed client got %v, want 554 with the list's reason", err)
+	}
+
+	senders, err := NewBlocklists(BlocklistConfig{DomainZones: []string{"dbl.test"}}, zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := serve(senders)
+	if err := c.Hello("client.example"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("a@spam.example", nil); smtpCode(err) != 554 {
+		t.Errorf("MAIL FROM a listed domain got %v, want 554", err)
+	}
+	if err := c.Mail("a@ok.example", nil); err != nil {
+		t.Errorf("MAIL FROM an unlisted domain got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+
+	"github.com/emersion/go-imap"
+)
+
+// MailboxEventType says what changed in a mailbox.
+type MailboxEventType int
+
+const (
+	// MessagesAdded: messages were delivered, appended, copied or moved in.
+	MessagesAdded MailboxEventType = iota
+	// MessagesExpunged: messages were removed or moved out.
+	MessagesExpunged
+	// FlagsChanged: flags of messages in the mailbox were changed.
+	FlagsChanged
+)
+
+// MailboxEvent is published whenever the contents of a mailbox change, by
+// whichever part of the server made the change.
+type MailboxEvent struct {
+	Type      MailboxEventType
+	UserID    int
+	Username  string // the owner's address, which is also the IMAP login
+	MailboxID int64
+	Mailbox   string
+
+	Count    uint32          // MessagesAdded: messages now in the mailbox
+	SeqNums  []uint32        // MessagesExpunged: removed positions, highest first
+	Messages []*imap.Message // FlagsChanged: sequence number, UID and flags
+
+	// Wait asks subscribers to return only once the event has been passed
+	// on. IMAP commands set it so that the issuing session sees its own
+	// updates before the tagged OK.
+	Wait bool
+}
+
+// EventBus fans mailbox events out to the IMAP server and the web UI.
+// Delivery, flag changes and expunges publish to it, wherever they come
+// from.
+type EventBus struct {
+	db *sql.DB
+
+	mu          sync.RWMutex
+	nextID      int
+	subscribers map[int]func(*MailboxEvent)
+}
+
+func NewEventBus(db *sql.DB) *EventBus {
+	return &EventBus{db: db, subscribers: make(map[int]func(*MailboxEvent))}
+}
+
+// Subscribe registers fn to be called for every event and returns a
+// function that cancels the subscription. fn is called synchronously by
+// the publisher and should hand the event off quickly.
+func (b *EventBus) Subscribe(fn func(*MailboxEvent)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.subscribers[id] = fn
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// Publish passes ev to every subscriber.
+func (b *EventBus) Publish(ev *MailboxEvent) {
+	b.mu.RLock()
+	subscribers := make([]func(*MailboxEvent), 0, len(b.subscribers))
+	for _, fn := range b.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	b.mu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(ev)
+	}
+}
+
+// MessagesAdded publishes the new size of a mailbox.
+func (b *EventBus) MessagesAdded(mailboxID int64, wait bool) {
+	ev, err := b.newEvent(MessagesAdded, mailboxID, wait)
+	if err != nil {
+		log.Printf("Failed to publish mailbox event: %v", err)
+		return
+	}
+	if err := b.db.QueryRow("SELECT COUNT(*) FROM emails WHERE mailbox_id = ?", mailboxID).Scan(&ev.Count); err != nil {
+		log.Printf("Failed to publish mailbox event: %v", err)
+		return
+	}
+	b.Publish(ev)
+}
+
+// MessagesExpunged publishes the removal of messages at seqNums, which must
+// be highest first.
+func (b *EventBus) MessagesExpunged(mailboxID int64, seqNums []uint32, wait bool) {
+	if len(seqNums) == 0 {
+		return
+	}
+	ev, err := b.newEvent(MessagesExpunged, mailboxID, wait)
+	if err != nil {
+		log.Printf("Failed to publish mailbox event: %v", err)
+		return
+	}
+	ev.SeqNums = seqNums
+	b.Publish(ev)
+}
+
+// FlagsChanged publishes the new flags of messages in a mailbox.
+func (b *EventBus) FlagsChanged(mailboxID int64, messages []*imap.Message, wait bool) {
+	if len(messages) == 0 {
+		return
+	}
+	ev, err := b.newEvent(FlagsChanged, mailboxID, wait)
+	if err != nil {
+		log.Printf("Failed to publish mailbox event: %v", err)
+		return
+	}
+	ev.Messages = messages
+	b.Publish(ev)
+}
+
+// EmailFlagsChanged publishes the current flags of one email, for changes
+// made outside IMAP such as reading or starring it in the web UI.
+func (b *EventBus) EmailFlagsChanged(emailID int64) {
+	var mailboxID sql.NullInt64
+	var uid sql.NullInt64
+	err := b.db.QueryRow("SELECT mailbox_id, uid FROM emails WHERE id = ?", emailID).Scan(&mailboxID, &uid)
+	if err != nil || !mailboxID.Valid {
+		return
+	}
+
+	var seqNum uint32
+	err = b.db.QueryRow("SELECT COUNT(*) FROM emails WHERE mailbox_id = ? AND uid <= ?", mailboxID.Int64, uid.Int64).Scan(&seqNum)
+	if err != nil {
+		log.Printf("Failed to publish mailbox event: %v", err)
+		return
+	}
+	msg := imap.NewMessage(seqNum, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+	msg.Uid = uint32(uid.Int64)
+	if msg.Flags, err = listFlags(b.db, emailID); err != nil {
+		log.Printf("Failed to publish mailbox event: %v", err)
+		return
+	}
+	b.FlagsChanged(mailboxID.Int64, []*imap.Message{msg}, false)
+}
+
+func (b *EventBus) newEvent(typ MailboxEventType, mailboxID int64, wait bool) (*MailboxEvent, error) {
+	ev := &MailboxEvent{Type: typ, MailboxID: mailboxID, Wait: wait}
+	err := b.db.QueryRow(`SELECT u.id, u.email, m.name FROM mailboxes m JOIN users u ON u.id = m.user_id
+		WHERE m.id = ?`, mailboxID).Scan(&ev.UserID, &ev.Username, &ev.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
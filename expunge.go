@@ -0,0 +1,222 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// removeEmails deletes emails from one mailbox and garbage-collects the
+// stored messages no longer in use. It returns the sequence numbers the
+// emails had, highest first, which is the order EXPUNGE responses are sent
+// in so that no number has to be adjusted for earlier removals.
+func removeEmails(db *sql.DB, mailboxID int64, emailIDs []int64) ([]uint32, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	seqNums, messageIDs, err := expungeEmails(tx, mailboxID, emailIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := collectMessages(tx, messageIDs); err != nil {
+		return nil, err
+	}
+
+	return seqNums, tx.Commit()
+}
+
+// expungeEmails deletes emails from a mailbox without collecting their
+// messages, returning the removed sequence numbers (highest first) and the
+// messages that were referenced.
+func expungeEmails(db execer, mailboxID int64, emailIDs []int64) ([]uint32, []int64, error) {
+	seqNums, messageIDs, err := mailboxPositions(db, mailboxID, emailIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, id := range emailIDs {
+		if _, err := db.Exec("DELETE FROM email_flags WHERE email_id = ?", id); err != nil {
+			return nil, nil, err
+		}
+		if _, err := db.Exec("DELETE FROM emails WHERE id = ? AND mailbox_id = ?", id, mailboxID); err != nil {
+			return nil, nil, err
+		}
+	}
+	return seqNums, messageIDs, nil
+}
+
+// mailboxPositions looks up the sequence numbers, highest first, and the
+// stored messages of those emailIDs that are in the mailbox.
+func mailboxPositions(db execer, mailboxID int64, emailIDs []int64) ([]uint32, []int64, error) {
+	wanted := make(map[int64]bool, len(emailIDs))
+	for _, id := range emailIDs {
+		wanted[id] = true
+	}
+
+	rows, err := db.Query("SELECT id, message_id FROM emails WHERE mailbox_id = ? ORDER BY uid", mailboxID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var seqNums []uint32
+	var messageIDs []int64
+	seqNum := uint32(0)
+	for rows.Next() {
+		var id, messageID int64
+		if err := rows.Scan(&id, &messageID); err != nil {
+			return nil, nil, err
+		}
+		seqNum++
+		if wanted[id] {
+			seqNums = append(seqNums, seqNum)
+			messageIDs = append(messageIDs, messageID)
+		}
+	}
+
+	sort.Slice(seqNums, func(i, j int) bool { return seqNums[i] > seqNums[j] })
+	return seqNums, messageIDs, rows.Err()
+}
+
+// collectMessages deletes those of the given stored messages that no email
+// and no pending outbound delivery refers to any more, along with their
+// headers, attachments, finished deliveries and any blobs left
+// unreferenced.
+func collectMessages(db execer, messageIDs []int64) error {
+	for _, id := range messageIDs {
+		var refs int
+		err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM emails WHERE message_id = ?) +
+			(SELECT COUNT(*) FROM outbound_queue WHERE message_id = ? AND status = 'pending')`, id, id).Scan(&refs)
+		if err != nil {
+			return err
+		}
+		if refs > 0 {
+			continue
+		}
+
+		hashes, err := queryStrings(db, "SELECT DISTINCT blob_hash FROM attachments WHERE message_id = ?", id)
+		if err != nil {
+			return err
+		}
+
+		if err := unindexMessage(db, id); err != nil {
+			return err
+		}
+		for _, query := range []string{
+			"DELETE FROM attachments WHERE message_id = ?",
+			"DELETE FROM message_auth WHERE message_id = ?",
+			"DELETE FROM message_headers WHERE message_id = ?",
+			"DELETE FROM spam_trained WHERE message_id = ?",
+			"DELETE FROM outbound_queue WHERE message_id = ?",
+			"DELETE FROM messages WHERE id = ?",
+		} {
+			if _, err := db.Exec(query, id); err != nil {
+				return err
+			}
+		}
+
+		if len(hashes) == 0 {
+			continue
+		}
+		args := make([]interface{}, len(hashes))
+		for i, hash := range hashes {
+			args[i] = hash
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(hashes)), ", ")
+		_, err = db.Exec(`DELETE FROM blobs WHERE hash IN (`+placeholders+`)
+			AND hash NOT IN (SELECT blob_hash FROM attachments)`, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func queryStrings(db execer, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// trashEmails handles the web UI's delete action: emails are moved to the
+// user's Trash, and emails already in Trash are removed for good.
+func (s *EmailServer) trashEmails(userID int, emailIDs []int64) error {
+	trash, err := getSpecialMailbox(s.db, userID, imap.TrashAttr)
+	if err != nil {
+		return err
+	}
+
+	byMailbox, err := s.emailsByMailbox(userID, emailIDs)
+	if err != nil {
+		return err
+	}
+
+	for mailboxID, ids := range byMailbox {
+		var seqNums []uint32
+		var err error
+		if mailboxID == trash.ID {
+			seqNums, err = removeEmails(s.db, mailboxID, ids)
+		} else {
+			seqNums, err = s.refileEmails(ids, mailboxID, trash.ID)
+		}
+		if err != nil {
+			return err
+		}
+		s.events.MessagesExpunged(mailboxID, seqNums, false)
+		if mailboxID != trash.ID {
+			s.events.MessagesAdded(trash.ID, false)
+		}
+	}
+	return nil
+}
+
+// emailsByMailbox groups those of emailIDs that belong to the user by the
+// mailbox they are in.
+func (s *EmailServer) emailsByMailbox(userID int, emailIDs []int64) (map[int64][]int64, error) {
+	byMailbox := make(map[int64][]int64)
+	for _, id := range emailIDs {
+		var mailboxID int64
+		err := s.db.QueryRow(`SELECT e.mailbox_id FROM emails e JOIN mailboxes m ON m.id = e.mailbox_id
+			WHERE e.id = ? AND m.user_id = ?`, id, userID).Scan(&mailboxID)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		byMailbox[mailboxID] = append(byMailbox[mailboxID], id)
+	}
+	return byMailbox, nil
+}
+
+// refileEmails moves emails between two of a user's mailboxes in one
+// transaction and returns the sequence numbers they had in the source.
+func (s *EmailServer) refileEmails(emailIDs []int64, fromMailboxID, toMailboxID int64) ([]uint32, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	seqNums, _, err := moveEmails(tx, emailIDs, fromMailboxID, toMailboxID)
+	if err != nil {
+		return nil, err
+	}
+	return seqNums, tx.Commit()
+}
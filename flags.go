@@ -0,0 +1,144 @@
+package main
+
+import "github.com/emersion/go-imap"
+
+// systemFlags are the RFC 3501 flags clients may set. \Recent is managed by
+// the server and never stored.
+var systemFlags = []string{
+	imap.SeenFlag,
+	imap.AnsweredFlag,
+	imap.FlaggedFlag,
+	imap.DeletedFlag,
+	imap.DraftFlag,
+}
+
+func (s *EmailServer) createFlagTables() error {
+	existed, err := tableExists(s.db, "email_flags")
+	if err != nil {
+		return err
+	}
+
+	flagTable := `
+	CREATE TABLE IF NOT EXISTS email_flags (
+		email_id INTEGER NOT NULL REFERENCES emails(id) ON DELETE CASCADE,
+		flag TEXT NOT NULL,
+		PRIMARY KEY (email_id, flag)
+	);
+	CREATE INDEX IF NOT EXISTS idx_email_flags_flag ON email_flags(flag);`
+
+	if _, err := s.db.Exec(flagTable); err != nil {
+		return err
+	}
+	if existed {
+		return nil
+	}
+
+	// The web UI used to track only emails.read; carry it over as \Seen.
+	_, err = s.db.Exec("INSERT OR IGNORE INTO email_flags (email_id, flag) SELECT id, ? FROM emails WHERE read = TRUE",
+		imap.SeenFlag)
+	return err
+}
+
+func tableExists(db execer, table string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	return count > 0, err
+}
+
+// normalizeFlags canonicalizes the case of system flags, drops \Recent and
+// duplicates, and keeps keywords as given.
+func normalizeFlags(flags []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, flag := range flags {
+		flag = imap.CanonicalFlag(flag)
+		if flag == "" || flag == imap.RecentFlag || seen[flag] {
+			continue
+		}
+		seen[flag] = true
+		out = append(out, flag)
+	}
+	return out
+}
+
+// listFlags returns the flags set on one email, in a stable order.
+func listFlags(db execer, emailID int64) ([]string, error) {
+	rows, err := db.Query("SELECT flag FROM email_flags WHERE email_id = ? ORDER BY flag", emailID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := []string{}
+	for rows.Next() {
+		var flag string
+		if err := rows.Scan(&flag); err != nil {
+			return nil, err
+		}
+		flags = append(flags, flag)
+	}
+	return flags, rows.Err()
+}
+
+// hasFlag reports whether an email carries the given flag.
+func hasFlag(db execer, emailID int64, flag string) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM email_flags WHERE email_id = ? AND flag = ?", emailID, flag).Scan(&count)
+	return count > 0
+}
+
+// updateFlags applies a STORE operation to one email.
+func updateFlags(db execer, emailID int64, op imap.FlagsOp, flags []string) error {
+	flags = normalizeFlags(flags)
+
+	if op == imap.SetFlags {
+		if _, err := db.Exec("DELETE FROM email_flags WHERE email_id = ?", emailID); err != nil {
+			return err
+		}
+		op = imap.AddFlags
+	}
+
+	for _, flag := range flags {
+		var err error
+		if op == imap.AddFlags {
+			_, err = db.Exec("INSERT OR IGNORE INTO email_flags (email_id, flag) VALUES (?, ?)", emailID, flag)
+		} else {
+			_, err = db.Exec("DELETE FROM email_flags WHERE email_id = ? AND flag = ?", emailID, flag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFlag turns a single flag on or off, as the web UI does for \Seen and
+// \Flagged.
+func setFlag(db execer, emailID int64, flag string, on bool) error {
+	var op imap.FlagsOp = imap.RemoveFlags
+	if on {
+		op = imap.AddFlags
+	}
+	return updateFlags(db, emailID, op, []string{flag})
+}
+
+// mailboxKeywords returns the user keywords in use in a mailbox, which are
+// announced alongside the system flags on SELECT.
+func mailboxKeywords(db execer, mailboxID int64) ([]string, error) {
+	rows, err := db.Query(`SELECT DISTINCT f.flag FROM email_flags f JOIN emails e ON e.id = f.email_id
+		WHERE e.mailbox_id = ? AND f.flag NOT LIKE '\%' ORDER BY f.flag`, mailboxID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keywords []string
+	for rows.Next() {
+		var keyword string
+		if err := rows.Scan(&keyword); err != nil {
+			return nil, err
+		}
+		keywords = append(keywords, keyword)
+	}
+	return keywords, rows.Err()
+}
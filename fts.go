@@ -0,0 +1,196 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+)
+
+// The full-text index holds one row per stored message, with the message id
+// as rowid. It uses the trigram tokenizer so that MATCH finds arbitrary
+// case-insensitive substrings, which is what both IMAP SEARCH and the web
+// search box need. Flags are not part of the index: is:unread and friends
+// read email_flags directly, so a flag change never needs a reindex.
+
+func (s *EmailServer) createSearchIndex() error {
+	existed, err := tableExists(s.db, "message_fts")
+	if err != nil {
+		return err
+	}
+
+	ftsTable := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS message_fts USING fts5(
+		subject, sender, recipients, body,
+		tokenize = 'trigram'
+	);`
+
+	if _, err := s.db.Exec(ftsTable); err != nil {
+		return err
+	}
+	if existed {
+		return nil
+	}
+
+	log.Println("Building full-text search index")
+	ids, err := queryIDs(s.db, "SELECT id FROM messages ORDER BY id")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		msg, err := loadMessage(s.db, id)
+		if err != nil {
+			return err
+		}
+		content, err := msg.MIME()
+		if err != nil {
+			content = &MIMEContent{Text: string(msg.Body)}
+		}
+		if err := indexMessage(s.db, msg, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexMessage adds a stored message to the full-text index.
+func indexMessage(db execer, msg *StoredMessage, content *MIMEContent) error {
+	recipients := strings.TrimSpace(msg.HeaderText("To") + " " + msg.HeaderText("Cc"))
+	_, err := db.Exec("INSERT INTO message_fts (rowid, subject, sender, recipients, body) VALUES (?, ?, ?, ?, ?)",
+		msg.ID, msg.HeaderText("Subject"), msg.HeaderText("From"), recipients, content.Text)
+	return err
+}
+
+// unindexMessage removes a deleted message from the full-text index.
+func unindexMessage(db execer, messageID int64) error {
+	_, err := db.Exec("DELETE FROM message_fts WHERE rowid = ?", messageID)
+	return err
+}
+
+// textCondition returns an SQL condition on e.message_id that holds when
+// term occurs in one of the given index columns, or in any column when none
+// are given. Trigrams need at least three characters; shorter terms fall
+// back to a LIKE scan of the index, which only folds ASCII case.
+func textCondition(term string, columns ...string) (string, []interface{}) {
+	if utf8.RuneCountInString(term) >= 3 {
+		query := `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+		if len(columns) > 0 {
+			query = "{" + strings.Join(columns, " ") + "} : " + query
+		}
+		return "e.message_id IN (SELECT rowid FROM message_fts WHERE message_fts MATCH ?)", []interface{}{query}
+	}
+
+	if len(columns) == 0 {
+		columns = []string{"subject", "sender", "recipients", "body"}
+	}
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term) + "%"
+	var conds []string
+	var args []interface{}
+	for _, column := range columns {
+		conds = append(conds, column+` LIKE ? ESCAPE '\'`)
+		args = append(args, pattern)
+	}
+	return "e.message_id IN (SELECT rowid FROM message_fts WHERE " + strings.Join(conds, " OR ") + ")", args
+}
+
+// webSearch translates a search box query into an SQL condition over
+// emails e. It understands Gmail-style operators:
+//
+//	from:alice  to:bob  subject:"weekly report"
+//	has:attachment  is:unread  is:read  is:starred
+//	after:2024/01/31  before:2024-02-15
+//
+// Everything else is matched as free text against subject, sender,
+// recipients and body. Quoted strings are kept together.
+func webSearch(query string) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, condArgs ...interface{}) {
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+	addText := func(cond string, condArgs []interface{}) {
+		add(cond, condArgs...)
+	}
+
+	for _, token := range splitSearchQuery(query) {
+		key, value := "", token
+		if i := strings.Index(token, ":"); i > 0 {
+			key, value = strings.ToLower(token[:i]), strings.Trim(token[i+1:], `"`)
+		}
+
+		switch key {
+		case "from":
+			addText(textCondition(value, "sender"))
+		case "to":
+			addText(textCondition(value, "recipients"))
+		case "subject":
+			addText(textCondition(value, "subject"))
+		case "has":
+			if strings.EqualFold(value, "attachment") {
+				add("EXISTS (SELECT 1 FROM attachments a WHERE a.message_id = e.message_id)")
+			}
+		case "is":
+			switch strings.ToLower(value) {
+			case "unread":
+				add("NOT EXISTS (SELECT 1 FROM email_flags f WHERE f.email_id = e.id AND f.flag = ?)", imap.SeenFlag)
+			case "read":
+				add("EXISTS (SELECT 1 FROM email_flags f WHERE f.email_id = e.id AND f.flag = ?)", imap.SeenFlag)
+			case "starred":
+				add("EXISTS (SELECT 1 FROM email_flags f WHERE f.email_id = e.id AND f.flag = ?)", imap.FlaggedFlag)
+			}
+		case "after", "before":
+			date, err := parseSearchDate(value)
+			if err != nil {
+				addText(textCondition(strings.Trim(token, `"`)))
+				continue
+			}
+			if key == "after" {
+				add("date(e.date) >= ?", date.Format("2006-01-02"))
+			} else {
+				add("date(e.date) < ?", date.Format("2006-01-02"))
+			}
+		default:
+			addText(textCondition(strings.Trim(token, `"`)))
+		}
+	}
+
+	if len(conds) == 0 {
+		return "1", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func parseSearchDate(value string) (time.Time, error) {
+	if t, err := time.Parse("2006/1/2", value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-1-2", value)
+}
+
+// splitSearchQuery splits on spaces outside double quotes.
+func splitSearchQuery(query string) []string {
+	var tokens []string
+	var current strings.Builder
+	quoted := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case r == ' ' && !quoted:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
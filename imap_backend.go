@@ -1,22 +1,98 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"errors"
-	"strings"
+	"io"
+	"log"
+	"net/mail"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type IMAPBackend struct {
-	db *sql.DB
+	db      *sql.DB
+	events  *EventBus
+	updates chan backend.Update
+	// serving is set once an IMAP server reads updates; until then
+	// there are no sessions to tell about changes.
+	serving atomic.Bool
 }
 
-func NewIMAPBackend(db *sql.DB) *IMAPBackend {
-	return &IMAPBackend{db: db}
+func NewIMAPBackend(db *sql.DB, events *EventBus) *IMAPBackend {
+	b := &IMAPBackend{db: db, events: events, updates: make(chan backend.Update, 100)}
+	events.Subscribe(b.mailboxEvent)
+	return b
+}
+
+// Updates implements backend.BackendUpdater. The IMAP server forwards each
+// update to the sessions of the user that have the mailbox selected.
+func (b *IMAPBackend) Updates() <-chan backend.Update {
+	b.serving.Store(true)
+	return b.updates
+}
+
+// mailboxEvent turns a mailbox event into unsolicited responses: EXISTS for
+// new messages, EXPUNGE for removed ones and FETCH FLAGS for flag changes.
+// The server leaves the FETCH responses out for a session whose STORE was
+// .SILENT.
+func (b *IMAPBackend) mailboxEvent(ev *MailboxEvent) {
+	switch ev.Type {
+	case MessagesAdded:
+		status := imap.NewMailboxStatus(ev.Mailbox, []imap.StatusItem{imap.StatusMessages})
+		status.Messages = ev.Count
+		b.notify(&backend.MailboxUpdate{
+			Update:        backend.NewUpdate(ev.Username, ev.Mailbox),
+			MailboxStatus: status,
+		}, ev.Wait)
+	case MessagesExpunged:
+		for _, seqNum := range ev.SeqNums {
+			b.notify(&backend.ExpungeUpdate{
+				Update: backend.NewUpdate(ev.Username, ev.Mailbox),
+				SeqNum: seqNum,
+			}, ev.Wait)
+		}
+	case FlagsChanged:
+		for _, msg := range ev.Messages {
+			b.notify(&backend.MessageUpdate{
+				Update:  backend.NewUpdate(ev.Username, ev.Mailbox),
+				Message: msg,
+			}, ev.Wait)
+		}
+	}
+}
+
+// notify queues an update for the server. With wait set it returns only
+// once the responses have been written. Nothing is queued before a server
+// reads the updates. EXISTS and EXPUNGE have to reach every session in
+// order, or their sequence numbers go out of step with ours, so they wait
+// for room in the queue, which the server keeps draining. Flag changes
+// are dropped when it is full; clients see the flags on their next FETCH.
+func (b *IMAPBackend) notify(update backend.Update, wait bool) {
+	if !b.serving.Load() {
+		return
+	}
+
+	done := update.Done()
+	if _, ok := update.(*backend.MessageUpdate); ok {
+		select {
+		case b.updates <- update:
+		default:
+			log.Printf("IMAP: update queue full, dropped flag update for %s", update.Username())
+			return
+		}
+	} else {
+		b.updates <- update
+	}
+	if wait {
+		<-done
+	}
 }
 
 func (b *IMAPBackend) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
@@ -32,7 +108,12 @@ func (b *IMAPBackend) Login(connInfo *imap.ConnInfo, username, password string)
 		return nil, errors.New("authentication failed")
 	}
 
+	if err := ensureDefaultMailboxes(b.db, userID); err != nil {
+		return nil, err
+	}
+
 	return &IMAPUser{
+		backend:  b,
 		username: username,
 		userID:   userID,
 		db:       b.db,
@@ -40,6 +121,7 @@ func (b *IMAPBackend) Login(connInfo *imap.ConnInfo, username, password string)
 }
 
 type IMAPUser struct {
+	backend  *IMAPBackend
 	username string
 	userID   int
 	db       *sql.DB
@@ -50,46 +132,60 @@ func (u *IMAPUser) Username() string {
 }
 
 func (u *IMAPUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
-	return []backend.Mailbox{
-		&IMAPMailbox{
-			name:     "INBOX",
-			username: u.username,
-			db:       u.db,
-		},
-	}, nil
+	mailboxes, err := listMailboxes(u.db, u.userID, subscribed)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]backend.Mailbox, len(mailboxes))
+	for i, m := range mailboxes {
+		list[i] = u.newMailbox(m)
+	}
+	return list, nil
 }
 
 func (u *IMAPUser) GetMailbox(name string) (backend.Mailbox, error) {
-	if name != "INBOX" {
-		return nil, errors.New("mailbox not found")
+	m, err := getMailbox(u.db, u.userID, name)
+	if err != nil {
+		return nil, err
 	}
-	return &IMAPMailbox{
-		name:     name,
-		username: u.username,
-		db:       u.db,
-	}, nil
+	return u.newMailbox(m), nil
 }
 
 func (u *IMAPUser) CreateMailbox(name string) error {
-	return errors.New("operation not supported")
+	return createMailbox(u.db, u.userID, name)
 }
 
 func (u *IMAPUser) DeleteMailbox(name string) error {
-	return errors.New("operation not supported")
+	return deleteMailbox(u.db, u.userID, name)
 }
 
 func (u *IMAPUser) RenameMailbox(existingName, newName string) error {
-	return errors.New("operation not supported")
+	return renameMailbox(u.db, u.userID, existingName, newName)
 }
 
 func (u *IMAPUser) Logout() error {
 	return nil
 }
 
+func (u *IMAPUser) newMailbox(m *Mailbox) *IMAPMailbox {
+	return &IMAPMailbox{
+		backend:  u.backend,
+		mailbox:  m,
+		name:     m.Name,
+		username: u.username,
+		db:       u.db,
+	}
+}
+
 type IMAPMailbox struct {
+	backend  *IMAPBackend
+	mailbox  *Mailbox
 	name     string
 	username string
 	db       *sql.DB
+	// readOnly is set when the mailbox was opened with EXAMINE
+	readOnly bool
 }
 
 func (m *IMAPMailbox) Name() string {
@@ -97,43 +193,78 @@ func (m *IMAPMailbox) Name() string {
 }
 
 func (m *IMAPMailbox) Info() (*imap.MailboxInfo, error) {
+	attributes := []string{}
+	if m.mailbox.SpecialUse != "" {
+		attributes = append(attributes, m.mailbox.SpecialUse)
+	}
+	if m.mailbox.hasChildren(m.db) {
+		attributes = append(attributes, imap.HasChildrenAttr)
+	} else {
+		attributes = append(attributes, imap.HasNoChildrenAttr)
+	}
+
 	return &imap.MailboxInfo{
-		Attributes: []string{},
-		Delimiter:  "/",
+		Attributes: attributes,
+		Delimiter:  mailboxDelimiter,
 		Name:       m.name,
 	}, nil
 }
 
 func (m *IMAPMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
-	status := &imap.MailboxStatus{
-		Name:     m.name,
-		ReadOnly: false,
-		Items:    make(map[imap.StatusItem]interface{}),
+	// UIDNEXT moves with every delivery, so re-read the mailbox row.
+	mailbox, err := getMailboxByID(m.db, m.mailbox.UserID, m.mailbox.ID)
+	if err != nil {
+		return nil, err
 	}
+	m.mailbox = mailbox
+
+	keywords, err := mailboxKeywords(m.db, m.mailbox.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := imap.NewMailboxStatus(m.name, items)
+	status.Flags = append(append([]string{}, systemFlags...), keywords...)
+	status.PermanentFlags = append(append([]string{}, status.Flags...), imap.TryCreateFlag)
 
 	for _, item := range items {
 		switch item {
 		case imap.StatusMessages:
 			var count int
-			m.db.QueryRow("SELECT COUNT(*) FROM emails WHERE to_email = ?", m.username).Scan(&count)
-			status.Items[imap.StatusMessages] = uint32(count)
+			m.db.QueryRow("SELECT COUNT(*) FROM emails WHERE mailbox_id = ?", m.mailbox.ID).Scan(&count)
+			status.Messages = uint32(count)
 		case imap.StatusUidNext:
-			status.Items[imap.StatusUidNext] = uint32(1000)
+			status.UidNext = mailbox.UIDNext
 		case imap.StatusUidValidity:
-			status.Items[imap.StatusUidValidity] = uint32(1)
+			status.UidValidity = mailbox.UIDValidity
 		case imap.StatusRecent:
-			status.Items[imap.StatusRecent] = uint32(0)
+			status.Recent = 0
 		case imap.StatusUnseen:
 			var count int
-			m.db.QueryRow("SELECT COUNT(*) FROM emails WHERE to_email = ? AND read = FALSE", m.username).Scan(&count)
-			status.Items[imap.StatusUnseen] = uint32(count)
+			m.db.QueryRow(`SELECT COUNT(*) FROM emails e WHERE e.mailbox_id = ?
+				AND NOT EXISTS (SELECT 1 FROM email_flags f WHERE f.email_id = e.id AND f.flag = ?)`,
+				m.mailbox.ID, imap.SeenFlag).Scan(&count)
+			status.Unseen = uint32(count)
 		}
 	}
 
+	// SELECT reports the sequence number of the first unseen message.
+	err = m.db.QueryRow(`SELECT COUNT(*) FROM emails WHERE mailbox_id = ? AND uid <= (
+			SELECT MIN(e.uid) FROM emails e WHERE e.mailbox_id = ?
+			AND NOT EXISTS (SELECT 1 FROM email_flags f WHERE f.email_id = e.id AND f.flag = ?))`,
+		m.mailbox.ID, m.mailbox.ID, imap.SeenFlag).Scan(&status.UnseenSeqNum)
+	if err != nil {
+		return nil, err
+	}
+
 	return status, nil
 }
 
 func (m *IMAPMailbox) SetSubscribed(subscribed bool) error {
+	if err := setSubscribed(m.db, m.mailbox.ID, subscribed); err != nil {
+		return err
+	}
+	m.mailbox.Subscribed = subscribed
 	return nil
 }
 
@@ -141,73 +272,447 @@ func (m *IMAPMailbox) Check() error {
 	return nil
 }
 
-func (m *IMAPMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
-	defer close(ch)
+// mailboxMessage is one entry of a mailbox together with its position.
+type mailboxMessage struct {
+	seqNum    uint32
+	uid       uint32
+	emailID   int64
+	messageID int64
+	date      time.Time
+}
 
-	rows, err := m.db.Query("SELECT id, from_email, subject, body, date FROM emails WHERE to_email = ? ORDER BY date DESC", m.username)
+// messages returns the mailbox contents in UID order, which also defines
+// the sequence numbers.
+func (m *IMAPMailbox) messages() ([]mailboxMessage, error) {
+	rows, err := m.db.Query(`SELECT id, uid, message_id, date FROM emails
+		WHERE mailbox_id = ? ORDER BY uid`, m.mailbox.ID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rows.Close()
 
-	seqNum := uint32(1)
+	var messages []mailboxMessage
 	for rows.Next() {
-		var id int
-		var from, subject, body, date string
-		rows.Scan(&id, &from, &subject, &body, &date)
+		var msg mailboxMessage
+		var date string
+		if err := rows.Scan(&msg.emailID, &msg.uid, &msg.messageID, &date); err != nil {
+			return nil, err
+		}
+		msg.seqNum = uint32(len(messages) + 1)
+		msg.date = parseTimestamp(date)
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// selectMessages returns the messages matched by seqSet, read as UIDs when
+// uid is set and as sequence numbers otherwise.
+func (m *IMAPMailbox) selectMessages(uid bool, seqSet *imap.SeqSet) ([]mailboxMessage, error) {
+	messages, err := m.messages()
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+
+	last := messages[len(messages)-1]
+	max := last.seqNum
+	if uid {
+		max = last.uid
+	}
+	set := resolveSeqSet(seqSet, max)
 
-		if seqSet != nil && !seqSet.Contains(seqNum) {
-			seqNum++
-			continue
+	var selected []mailboxMessage
+	for _, msg := range messages {
+		id := msg.seqNum
+		if uid {
+			id = msg.uid
 		}
+		if set == nil || set.Contains(id) {
+			selected = append(selected, msg)
+		}
+	}
+	return selected, nil
+}
 
-		msg := &imap.Message{
-			SeqNum: seqNum,
-			Uid:    uint32(id),
+// resolveSeqSet replaces "*" in a sequence set with max, the largest number
+// in use, so that "*" and "n:*" match the last message even when n > max.
+func resolveSeqSet(seqSet *imap.SeqSet, max uint32) *imap.SeqSet {
+	if seqSet == nil {
+		return nil
+	}
+	resolved := new(imap.SeqSet)
+	for _, seq := range seqSet.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 {
+			start = max
+		}
+		if stop == 0 {
+			stop = max
+		}
+		if start > stop {
+			start, stop = stop, start
 		}
+		resolved.AddRange(start, stop)
+	}
+	return resolved
+}
+
+func (m *IMAPMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	selected, err := m.selectMessages(uid, seqSet)
+	if err != nil {
+		return err
+	}
 
+	// Fetching body text without .PEEK marks the message read, and the
+	// response then carries its new flags (RFC 3501 §6.4.5)
+	markSeen := !m.readOnly && fetchesBodyText(items)
+	if markSeen && !containsItem(items, imap.FetchFlags) {
+		items = append(items[:len(items):len(items)], imap.FetchFlags)
+	}
+
+	for _, entry := range selected {
+		stored, err := loadMessage(m.db, entry.messageID)
+		if err != nil {
+			return err
+		}
+		if markSeen && !hasFlag(m.db, entry.emailID, imap.SeenFlag) {
+			if err := setFlag(m.db, entry.emailID, imap.SeenFlag, true); err != nil {
+				return err
+			}
+			m.backend.events.EmailFlagsChanged(entry.emailID)
+		}
+
+		msg := imap.NewMessage(entry.seqNum, items)
 		for _, item := range items {
 			switch item {
 			case imap.FetchEnvelope:
-				msg.Envelope = &imap.Envelope{
-					Date:    time.Now(),
-					Subject: subject,
-					From:    []*imap.Address{{PersonalName: "", MailboxName: strings.Split(from, "@")[0], HostName: strings.Split(from, "@")[1]}},
-					To:      []*imap.Address{{PersonalName: "", MailboxName: strings.Split(m.username, "@")[0], HostName: strings.Split(m.username, "@")[1]}},
+				msg.Envelope, _ = backendutil.FetchEnvelope(stored.Header)
+			case imap.FetchBodyStructure, imap.FetchBody:
+				msg.BodyStructure, _ = backendutil.FetchBodyStructure(stored.Header, bytes.NewReader(stored.Body), item == imap.FetchBodyStructure)
+			case imap.FetchFlags:
+				msg.Flags, err = listFlags(m.db, entry.emailID)
+				if err != nil {
+					return err
 				}
-			case imap.FetchBodyStructure:
-				msg.BodyStructure = &imap.BodyStructure{
-					MIMEType:    "text",
-					MIMESubType: "plain",
+			case imap.FetchInternalDate:
+				msg.InternalDate = entry.date
+			case imap.FetchRFC822Size:
+				msg.Size = uint32(len(stored.Raw))
+			case imap.FetchUid:
+				msg.Uid = entry.uid
+			default:
+				section, err := imap.ParseBodySectionName(item)
+				if err != nil {
+					break
 				}
-			case imap.FetchFlags:
-				msg.Flags = []string{}
+				l, _ := backendutil.FetchBodySection(stored.Header, bytes.NewReader(stored.Body), section)
+				msg.Body[section] = l
 			}
 		}
+		msg.Uid = entry.uid
 
 		ch <- msg
-		seqNum++
 	}
 
 	return nil
 }
 
+// fetchesBodyText reports whether a FETCH asks for a body section without
+// .PEEK. RFC822 and RFC822.TEXT count; RFC822.HEADER is a peek.
+func fetchesBodyText(items []imap.FetchItem) bool {
+	for _, item := range items {
+		if section, err := imap.ParseBodySectionName(item); err == nil && !section.Peek {
+			return true
+		}
+	}
+	return false
+}
+
+func containsItem(items []imap.FetchItem, want imap.FetchItem) bool {
+	for _, item := range items {
+		if item == want {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *IMAPMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
-	return []uint32{}, nil
+	var maxSeqNum, maxUID uint32
+	err := m.db.QueryRow("SELECT COUNT(*), COALESCE(MAX(uid), 0) FROM emails WHERE mailbox_id = ?", m.mailbox.ID).
+		Scan(&maxSeqNum, &maxUID)
+	if err != nil {
+		return nil, err
+	}
+
+	matches, err := searchMailbox(m.db, m.mailbox.ID, resolveCriteria(criteria, maxSeqNum, maxUID))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint32, len(matches))
+	for i, msg := range matches {
+		if uid {
+			ids[i] = msg.uid
+		} else {
+			ids[i] = msg.seqNum
+		}
+	}
+	return ids, nil
+}
+
+// resolveCriteria returns a copy of c with "*" resolved in every sequence
+// set, including those of nested NOT and OR keys.
+func resolveCriteria(c *imap.SearchCriteria, maxSeqNum, maxUID uint32) *imap.SearchCriteria {
+	resolved := *c
+	resolved.SeqNum = resolveSeqSet(c.SeqNum, maxSeqNum)
+	resolved.Uid = resolveSeqSet(c.Uid, maxUID)
+
+	resolved.Not = make([]*imap.SearchCriteria, len(c.Not))
+	for i, not := range c.Not {
+		resolved.Not[i] = resolveCriteria(not, maxSeqNum, maxUID)
+	}
+	resolved.Or = make([][2]*imap.SearchCriteria, len(c.Or))
+	for i, or := range c.Or {
+		resolved.Or[i] = [2]*imap.SearchCriteria{
+			resolveCriteria(or[0], maxSeqNum, maxUID),
+			resolveCriteria(or[1], maxSeqNum, maxUID),
+		}
+	}
+	return &resolved
 }
 
 func (m *IMAPMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
-	return errors.New("operation not supported")
+	_, _, err := m.CreateMessageUID(flags, date, body)
+	return err
+}
+
+// CreateMessageUID stores an APPENDed message and files it in the mailbox
+// with the given flags and internal date. It returns the mailbox's
+// UIDVALIDITY and the new message's UID for the APPENDUID response code.
+func (m *IMAPMailbox) CreateMessageUID(flags []string, date time.Time, body imap.Literal) (uint32, uint32, error) {
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return 0, 0, err
+	}
+	msg, err := newStoredMessage(0, raw)
+	if err != nil {
+		return 0, 0, err
+	}
+	from := m.username
+	if addr, err := mail.ParseAddress(msg.HeaderText("From")); err == nil {
+		from = addr.Address
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	messageID, err := storeMessage(tx, raw)
+	if err != nil {
+		return 0, 0, err
+	}
+	emailID, uid, err := addToMailbox(tx, messageID, from, m.username, m.mailbox.ID, date)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := updateFlags(tx, emailID, imap.SetFlags, flags); err != nil {
+		return 0, 0, err
+	}
+	var validity uint32
+	if err := tx.QueryRow("SELECT uid_validity FROM mailboxes WHERE id = ?", m.mailbox.ID).Scan(&validity); err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+
+	m.backend.events.MessagesAdded(m.mailbox.ID, true)
+	return validity, uid, nil
 }
 
 func (m *IMAPMailbox) UpdateMessagesFlags(uid bool, seqset *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	selected, err := m.selectMessages(uid, seqset)
+	if err != nil {
+		return err
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var updated []*imap.Message
+	for _, entry := range selected {
+		if err := updateFlags(tx, entry.emailID, operation, flags); err != nil {
+			return err
+		}
+
+		items := []imap.FetchItem{imap.FetchFlags}
+		if uid {
+			items = append(items, imap.FetchUid)
+		}
+		msg := imap.NewMessage(entry.seqNum, items)
+		msg.Uid = entry.uid
+		if msg.Flags, err = listFlags(tx, entry.emailID); err != nil {
+			return err
+		}
+		updated = append(updated, msg)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	m.backend.events.FlagsChanged(m.mailbox.ID, updated, true)
 	return nil
 }
 
 func (m *IMAPMailbox) CopyMessages(uid bool, seqset *imap.SeqSet, destName string) error {
-	return errors.New("operation not supported")
+	_, err := m.CopyMessagesUID(uid, seqset, destName)
+	return err
+}
+
+// copyUID is the content of a COPYUID response code: the destination's
+// UIDVALIDITY and the source and destination UIDs, which pair up in order.
+type copyUID struct {
+	uidValidity uint32
+	source      *imap.SeqSet
+	dest        *imap.SeqSet
+}
+
+func (c *copyUID) args() []interface{} {
+	return []interface{}{c.uidValidity, c.source, c.dest}
+}
+
+// CopyMessagesUID copies messages into another mailbox in one transaction.
+// It returns nil as the copyUID when no message matched.
+func (m *IMAPMailbox) CopyMessagesUID(uid bool, seqset *imap.SeqSet, destName string) (*copyUID, error) {
+	result, _, dest, err := m.transfer(uid, seqset, destName, false)
+	if err != nil || dest == nil {
+		return result, err
+	}
+	m.backend.events.MessagesAdded(dest.ID, true)
+	return result, nil
+}
+
+// MoveMessages implements RFC 6851 MOVE. The server's MOVE handler passes
+// the error it returns on as the tagged response, so the COPYUID response
+// code goes in the tagged OK of the issuing connection alone, as with COPY.
+func (m *IMAPMailbox) MoveMessages(uid bool, seqset *imap.SeqSet, destName string) error {
+	result, seqNums, dest, err := m.transfer(uid, seqset, destName, true)
+	if err != nil || dest == nil {
+		return tryCreate(err)
+	}
+	m.backend.events.MessagesAdded(dest.ID, true)
+	m.backend.events.MessagesExpunged(m.mailbox.ID, seqNums, true)
+
+	name := "MOVE"
+	if uid {
+		name = "UID MOVE"
+	}
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "COPYUID",
+		Arguments: result.args(),
+		Info:      name + " completed",
+	}}
+}
+
+// transfer copies or moves the selected messages to the named mailbox. For
+// a move it also returns the sequence numbers the messages had, highest
+// first. dest is nil when nothing was selected.
+func (m *IMAPMailbox) transfer(uid bool, seqset *imap.SeqSet, destName string, move bool) (*copyUID, []uint32, *Mailbox, error) {
+	dest, err := getMailbox(m.db, m.mailbox.UserID, destName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if move && dest.ID == m.mailbox.ID {
+		return nil, nil, nil, errors.New("messages are already in this mailbox")
+	}
+	selected, err := m.selectMessages(uid, seqset)
+	if err != nil || len(selected) == 0 {
+		return nil, nil, nil, err
+	}
+
+	emailIDs := make([]int64, len(selected))
+	result := &copyUID{uidValidity: dest.UIDValidity, source: new(imap.SeqSet), dest: new(imap.SeqSet)}
+	for i, msg := range selected {
+		emailIDs[i] = msg.emailID
+		result.source.AddNum(msg.uid)
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var seqNums, uids []uint32
+	if move {
+		seqNums, uids, err = moveEmails(tx, emailIDs, m.mailbox.ID, dest.ID)
+	} else {
+		uids, err = copyEmails(tx, emailIDs, dest.ID)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Moving mail into Junk and back out is how IMAP clients report spam
+	// and mistakes
+	if spam, ok := spamTraining(m.mailbox, dest); ok {
+		if err := trainSpam(m.db, m.mailbox.UserID, emailIDs, spam); err != nil {
+			log.Printf("Spam training for %s: %v", m.username, err)
+		}
+	}
+
+	result.dest.AddNum(uids...)
+	return result, seqNums, dest, nil
 }
 
 func (m *IMAPMailbox) Expunge() error {
+	emailIDs, err := queryIDs(m.db, `SELECT e.id FROM emails e JOIN email_flags f ON f.email_id = e.id
+		WHERE e.mailbox_id = ? AND f.flag = ?`, m.mailbox.ID, imap.DeletedFlag)
+	if err != nil {
+		return err
+	}
+	return m.expunge(emailIDs)
+}
+
+// ExpungeUIDs implements UID EXPUNGE: only messages that are both flagged
+// \Deleted and in the UID set are removed.
+func (m *IMAPMailbox) ExpungeUIDs(seqSet *imap.SeqSet) error {
+	selected, err := m.selectMessages(true, seqSet)
+	if err != nil {
+		return err
+	}
+	var emailIDs []int64
+	for _, msg := range selected {
+		if hasFlag(m.db, msg.emailID, imap.DeletedFlag) {
+			emailIDs = append(emailIDs, msg.emailID)
+		}
+	}
+	return m.expunge(emailIDs)
+}
+
+func (m *IMAPMailbox) expunge(emailIDs []int64) error {
+	if len(emailIDs) == 0 {
+		return nil
+	}
+
+	seqNums, err := removeEmails(m.db, m.mailbox.ID, emailIDs)
+	if err != nil {
+		return err
+	}
+	m.backend.events.MessagesExpunged(m.mailbox.ID, seqNums, true)
 	return nil
 }
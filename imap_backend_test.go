@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// newTestInbox returns bob's INBOX holding n messages, on a backend whose
+// updates nobody reads yet.
+func newTestInbox(t *testing.T, n int) *IMAPMailbox {
+	db := newTestDB(t)
+	b := NewIMAPBackend(db, NewEventBus(db))
+	user := &IMAPUser{backend: b, username: "bob@localhost.com", userID: newTestUser(t, db, "bob@localhost.com"), db: db}
+	mbox, err := user.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox := mbox.(*IMAPMailbox)
+	for i := 0; i < n; i++ {
+		msg := []byte("Subject: test\r\n\r\nbody\r\n")
+		if err := inbox.CreateMessage(nil, time.Now(), bytes.NewReader(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return inbox
+}
+
+func TestNotifyWithoutServerDoesNotBlock(t *testing.T) {
+	db := newTestDB(t)
+	b := NewIMAPBackend(db, NewEventBus(db))
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 2*cap(b.updates); i++ {
+			b.notify(&backend.ExpungeUpdate{Update: backend.NewUpdate("bob@localhost.com", "INBOX"), SeqNum: 1}, false)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("notify blocked with nobody reading updates")
+	}
+	if n := len(b.updates); n != 0 {
+		t.Errorf("%d updates queued before a server reads them", n)
+	}
+}
+
+func TestNotifyFullQueue(t *testing.T) {
+	db := newTestDB(t)
+	b := NewIMAPBackend(db, NewEventBus(db))
+	updates := b.Updates()
+
+	// Flag changes beyond the queue's capacity are dropped
+	for i := 0; i < 2*cap(b.updates); i++ {
+		b.notify(&backend.MessageUpdate{
+			Update:  backend.NewUpdate("bob@localhost.com", "INBOX"),
+			Message: imap.NewMessage(1, []imap.FetchItem{imap.FetchFlags}),
+		}, false)
+	}
+	if n := len(updates); n != cap(b.updates) {
+		t.Fatalf("%d updates queued, want a full queue of %d", n, cap(b.updates))
+	}
+
+	// An expunge waits for room instead
+	sent := make(chan struct{})
+	go func() {
+		b.notify(&backend.ExpungeUpdate{Update: backend.NewUpdate("bob@localhost.com", "INBOX"), SeqNum: 3}, false)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("expunge did not wait for room in a full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var expunged []uint32
+	for i := 0; i <= cap(b.updates); i++ {
+		if update, ok := (<-updates).(*backend.ExpungeUpdate); ok {
+			expunged = append(expunged, update.SeqNum)
+		}
+	}
+	<-sent
+	if len(expunged) != 1 || expunged[0] != 3 {
+		t.Errorf("expunges received: %v, want [3]", expunged)
+	}
+}
+
+// TestMoveSendsCopyUIDToIssuer checks that MOVE answers with COPYUID in its
+// own tagged response and sends other sessions only EXISTS and EXPUNGE.
+func TestMoveSendsCopyUIDToIssuer(t *testing.T) {
+	inbox := newTestInbox(t, 3)
+	b, db := inbox.backend, inbox.db
+
+	var got []backend.Update
+	updates := b.Updates()
+	stop := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for {
+			select {
+			case update := <-updates:
+				got = append(got, update)
+				close(update.Done())
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	seqset, _ := imap.ParseSeqSet("2:3")
+	err := inbox.MoveMessages(false, seqset, "Archive")
+	close(stop)
+	<-drained
+
+	var status *imap.ErrStatusResp
+	if !errors.As(err, &status) || status.Resp.Type != imap.StatusRespOk || status.Resp.Code != "COPYUID" {
+		t.Fatalf("MoveMessages returned %v, want a tagged OK with COPYUID", err)
+	}
+	archive, err := getMailbox(db, inbox.mailbox.UserID, "Archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{archive.UIDValidity, "2:3", "1:2"}
+	if args := status.Resp.Arguments; len(args) != 3 || args[0] != want[0] ||
+		args[1].(*imap.SeqSet).String() != want[1] || args[2].(*imap.SeqSet).String() != want[2] {
+		t.Errorf("COPYUID arguments %v, want %v", status.Resp.Arguments, want)
+	}
+
+	var expunged []uint32
+	for _, update := range got {
+		switch update := update.(type) {
+		case *backend.StatusUpdate:
+			t.Errorf("status update sent to every session: %v", update.StatusResp)
+		case *backend.ExpungeUpdate:
+			expunged = append(expunged, update.SeqNum)
+		}
+	}
+	if !reflect.DeepEqual(expunged, []uint32{3, 2}) {
+		t.Errorf("expunged %v, want [3 2]", expunged)
+	}
+}
+
+func TestFetchBodySetsSeen(t *testing.T) {
+	tests := []struct {
+		name     string
+		item     imap.FetchItem
+		readOnly bool
+		seen     bool
+	}{
+		{"body", "BODY[]", false, true},
+		{"text", "BODY[TEXT]", false, true},
+		{"rfc822", "RFC822", false, true},
+		{"rfc822 text", "RFC822.TEXT", false, true},
+		{"peek", "BODY.PEEK[]", false, false},
+		{"rfc822 header", "RFC822.HEADER", false, false},
+		{"envelope", imap.FetchEnvelope, false, false},
+		{"examine", "BODY[]", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inbox := newTestInbox(t, 1)
+			b, db := inbox.backend, inbox.db
+			inbox.readOnly = tt.readOnly
+			updates := b.Updates()
+
+			ch := make(chan *imap.Message, 1)
+			seqset, _ := imap.ParseSeqSet("1")
+			if err := inbox.ListMessages(false, seqset, []imap.FetchItem{tt.item}, ch); err != nil {
+				t.Fatal(err)
+			}
+			fetched := <-ch
+
+			emailIDs, err := queryIDs(db, "SELECT id FROM emails WHERE mailbox_id = ?", inbox.mailbox.ID)
+			if err != nil || len(emailIDs) != 1 {
+				t.Fatalf("got emails %v, %v", emailIDs, err)
+			}
+			if got := hasFlag(db, emailIDs[0], imap.SeenFlag); got != tt.seen {
+				t.Errorf("\\Seen set: %v, want %v", got, tt.seen)
+			}
+			if _, ok := fetched.Items[imap.FetchFlags]; ok != tt.seen {
+				t.Errorf("FLAGS in the response: %v, want %v", ok, tt.seen)
+			} else if ok && !reflect.DeepEqual(fetched.Flags, []string{imap.SeenFlag}) {
+				t.Errorf("FLAGS %v, want [\\Seen]", fetched.Flags)
+			}
+
+			var published bool
+			for len(updates) > 0 {
+				if _, ok := (<-updates).(*backend.MessageUpdate); ok {
+					published = true
+				}
+			}
+			if published != tt.seen {
+				t.Errorf("flag change published: %v, want %v", published, tt.seen)
+			}
+		})
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name    string
+		uid     bool
+		seqset  string
+		dest    string
+		move    bool
+		source  string
+		copied  string
+		seqNums []uint32
+		err     error
+	}{
+		{"copy by sequence number", false, "2:3", "Archive", false, "3:4", "1:2", nil, nil},
+		{"copy by UID", true, "1,5", "Archive", false, "1,5", "1:2", nil, nil},
+		{"move by sequence number", false, "2,4", "Archive", true, "3,5", "1:2", []uint32{4, 2}, nil},
+		{"move by UID to the last", true, "4:*", "Archive", true, "4:5", "1:2", []uint32{4, 3}, nil},
+		{"expunged UID", true, "2", "Archive", true, "", "", nil, nil},
+		{"missing mailbox", false, "1", "Nope", false, "", "", nil, backend.ErrNoSuchMailbox},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// UIDs 1, 3, 4 and 5 at sequence numbers 1 to 4
+			inbox := newTestInbox(t, 5)
+			emailIDs, err := queryIDs(inbox.db, "SELECT id FROM emails WHERE mailbox_id = ? AND uid = 2", inbox.mailbox.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := removeEmails(inbox.db, inbox.mailbox.ID, emailIDs); err != nil {
+				t.Fatal(err)
+			}
+
+			seqset, _ := imap.ParseSeqSet(tt.seqset)
+			result, seqNums, dest, err := inbox.transfer(tt.uid, seqset, tt.dest, tt.move)
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if tt.source == "" {
+				if result != nil || dest != nil {
+					t.Errorf("got COPYUID %v into %v for no messages", result, dest)
+				}
+				return
+			}
+			if result.uidValidity != dest.UIDValidity || result.source.String() != tt.source || result.dest.String() != tt.copied {
+				t.Errorf("COPYUID %d %s %s, want %d %s %s", result.uidValidity, result.source, result.dest,
+					dest.UIDValidity, tt.source, tt.copied)
+			}
+			if !reflect.DeepEqual(seqNums, tt.seqNums) {
+				t.Errorf("sequence numbers %v, want %v", seqNums, tt.seqNums)
+			}
+
+			var left int
+			inbox.db.QueryRow("SELECT COUNT(*) FROM emails WHERE mailbox_id = ?", inbox.mailbox.ID).Scan(&left)
+			if want := 4 - len(tt.seqNums); left != want {
+				t.Errorf("%d messages left in INBOX, want %d", left, want)
+			}
+		})
+	}
+
+	inbox := newTestInbox(t, 1)
+	seqset, _ := imap.ParseSeqSet("1")
+	if _, _, _, err := inbox.transfer(false, seqset, "INBOX", true); err == nil {
+		t.Error("moved messages into the mailbox they are in")
+	}
+}
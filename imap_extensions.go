@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/server"
+)
+
+// capabilityExtension advertises extensions that need no commands of their
+// own because the backend implements them through existing ones.
+type capabilityExtension []string
+
+func (e capabilityExtension) Capabilities(c server.Conn) []string {
+	return e
+}
+
+func (e capabilityExtension) Command(name string) server.HandlerFactory {
+	return nil
+}
+
+// examineExtension tells the backend which mailboxes were opened with
+// EXAMINE, where FETCH must not set \Seen.
+type examineExtension struct{}
+
+func (examineExtension) Capabilities(c server.Conn) []string {
+	return nil
+}
+
+func (examineExtension) Command(name string) server.HandlerFactory {
+	if name != "EXAMINE" {
+		return nil
+	}
+	return func() server.Handler {
+		h := &examineHandler{}
+		h.ReadOnly = true
+		return h
+	}
+}
+
+type examineHandler struct {
+	server.Select
+}
+
+// Handle runs SELECT in read-only mode, whose tagged OK [READ-ONLY] comes
+// back as an error, and marks the mailbox it selected.
+func (h *examineHandler) Handle(conn server.Conn) error {
+	err := h.Select.Handle(conn)
+	if mbox, ok := conn.Context().Mailbox.(*IMAPMailbox); ok {
+		mbox.readOnly = true
+	}
+	return err
+}
+
+// uidPlusMailbox is implemented by mailboxes that can report the UIDs
+// RFC 4315 asks for.
+type uidPlusMailbox interface {
+	CreateMessageUID(flags []string, date time.Time, body imap.Literal) (uidValidity, uid uint32, err error)
+	CopyMessagesUID(uid bool, seqSet *imap.SeqSet, dest string) (*copyUID, error)
+	ExpungeUIDs(seqSet *imap.SeqSet) error
+}
+
+// uidPlusExtension implements UIDPLUS: APPEND answers with APPENDUID, COPY
+// with COPYUID, and UID EXPUNGE removes only the given messages. The server
+// ignores extensions that provide MOVE, so the backend's MoveMessages
+// returns the tagged OK with COPYUID for MOVE itself.
+type uidPlusExtension struct{}
+
+func (uidPlusExtension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"UIDPLUS"}
+	}
+	return nil
+}
+
+func (uidPlusExtension) Command(name string) server.HandlerFactory {
+	switch name {
+	case "APPEND":
+		return func() server.Handler { return &appendUIDHandler{} }
+	case "COPY":
+		return func() server.Handler { return &copyUIDHandler{} }
+	case "EXPUNGE":
+		return func() server.Handler { return &expungeHandler{} }
+	}
+	return nil
+}
+
+type appendUIDHandler struct {
+	commands.Append
+}
+
+func (cmd *appendUIDHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+
+	mbox, err := ctx.User.GetMailbox(cmd.Mailbox)
+	if err != nil {
+		return tryCreate(err)
+	}
+
+	uidMbox, ok := mbox.(uidPlusMailbox)
+	if !ok {
+		return mbox.CreateMessage(cmd.Flags, cmd.Date, cmd.Message)
+	}
+	validity, uid, err := uidMbox.CreateMessageUID(cmd.Flags, cmd.Date, cmd.Message)
+	if err != nil {
+		return err
+	}
+
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "APPENDUID",
+		Arguments: []interface{}{validity, uid},
+		Info:      "APPEND completed",
+	}}
+}
+
+// tryCreate adds the TRYCREATE response code to a missing target mailbox
+// error.
+func tryCreate(err error) error {
+	if err != backend.ErrNoSuchMailbox {
+		return err
+	}
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: imap.CodeTryCreate,
+		Info: err.Error(),
+	}}
+}
+
+type copyUIDHandler struct {
+	commands.Copy
+}
+
+func (cmd *copyUIDHandler) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+
+	mbox, ok := ctx.Mailbox.(uidPlusMailbox)
+	if !ok {
+		return tryCreate(ctx.Mailbox.CopyMessages(uid, cmd.SeqSet, cmd.Mailbox))
+	}
+	copied, err := mbox.CopyMessagesUID(uid, cmd.SeqSet, cmd.Mailbox)
+	if err != nil || copied == nil {
+		return tryCreate(err)
+	}
+
+	name := "COPY"
+	if uid {
+		name = "UID COPY"
+	}
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "COPYUID",
+		Arguments: copied.args(),
+		Info:      name + " completed",
+	}}
+}
+
+func (cmd *copyUIDHandler) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *copyUIDHandler) UidHandle(conn server.Conn) error {
+	return cmd.handle(true, conn)
+}
+
+// expungeHandler accepts the sequence set of UID EXPUNGE; plain EXPUNGE is
+// handled as before.
+type expungeHandler struct {
+	SeqSet *imap.SeqSet
+}
+
+func (cmd *expungeHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	seqSet, ok := fields[0].(string)
+	if !ok {
+		return errors.New("Invalid sequence set")
+	}
+	set, err := imap.ParseSeqSet(seqSet)
+	if err != nil {
+		return err
+	}
+	cmd.SeqSet = set
+	return nil
+}
+
+func (cmd *expungeHandler) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	return ctx.Mailbox.Expunge()
+}
+
+func (cmd *expungeHandler) UidHandle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+	if cmd.SeqSet == nil {
+		return errors.New("UID EXPUNGE requires a sequence set")
+	}
+	mbox, ok := ctx.Mailbox.(uidPlusMailbox)
+	if !ok {
+		return errors.New("UID EXPUNGE not supported")
+	}
+	return mbox.ExpungeUIDs(cmd.SeqSet)
+}
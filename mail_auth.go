@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log"
+	"math/rand"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Mail arriving on the MX listener is checked before it is filed: SPF for
+// the connecting IP and MAIL FROM domain, every DKIM signature, and the
+// DMARC policy of the From domain, which passes if SPF or DKIM passed for
+// a domain aligned with From. The outcome is added to the message as an
+// Authentication-Results header and kept in the message_auth table.
+// Failing mail is rejected or sent to Junk when the domain's policy says
+// so.
+
+func (s *EmailServer) createAuthTables() error {
+	authTable := `
+	CREATE TABLE IF NOT EXISTS message_auth (
+		message_id INTEGER PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+		remote_ip TEXT NOT NULL,
+		helo TEXT NOT NULL,
+		spf TEXT NOT NULL,
+		spf_domain TEXT NOT NULL,
+		spf_aligned BOOLEAN NOT NULL DEFAULT FALSE,
+		dkim TEXT NOT NULL,
+		dkim_domains TEXT NOT NULL,
+		dkim_aligned BOOLEAN NOT NULL DEFAULT FALSE,
+		dmarc TEXT NOT NULL,
+		dmarc_policy TEXT NOT NULL,
+		disposition TEXT NOT NULL,
+		header_from TEXT NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err := s.db.Exec(authTable)
+	return err
+}
+
+// AuthResolver is the DNS used by the SPF, DKIM and DMARC checks.
+// *net.Resolver satisfies it; tests can answer from memory instead.
+type AuthResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// MessageAuth is the outcome of checking one inbound message. Results use
+// the RFC 8601 values: pass, fail, softfail, neutral, none, temperror and
+// permerror.
+type MessageAuth struct {
+	RemoteIP string `json:"remote_ip"`
+	Helo     string `json:"helo"`
+
+	SPF         string `json:"spf"`
+	SPFDomain   string `json:"spf_domain"` // MAIL FROM domain, or HELO for bounces
+	SPFAligned  bool   `json:"spf_aligned"`
+	DKIM        string `json:"dkim"`         // pass if any signature verified
+	DKIMDomains string `json:"dkim_domains"` // space-separated domains of the valid signatures
+	DKIMAligned bool   `json:"dkim_aligned"`
+
+	DMARC       string `json:"dmarc"`
+	DMARCPolicy string `json:"dmarc_policy"` // the policy published for HeaderFrom, if any
+	// Disposition is what was done with the message: none, quarantine or
+	// reject.
+	Disposition string `json:"disposition"`
+	HeaderFrom  string `json:"header_from"`
+	// DMARCDomain is where the record was found: HeaderFrom or its
+	// organizational domain. Aggregate reports go to its rua addresses.
+	DMARCDomain string `json:"-"`
+
+	// dkimResults has one entry per signature for the header.
+	dkimResults []authres.Result
+}
+
+// Passed reports whether the message is authenticated for its From domain.
+func (a *MessageAuth) Passed() bool {
+	return a.DMARC == string(authres.ResultPass)
+}
+
+// Failed reports whether the From domain's DMARC check failed.
+func (a *MessageAuth) Failed() bool {
+	return a.DMARC == string(authres.ResultFail)
+}
+
+// Authenticator runs the inbound checks.
+type Authenticator struct {
+	hostname string
+	resolver AuthResolver
+	timeout  time.Duration
+	// sample decides whether a failing message falls within a policy's
+	// pct; it is replaced in tests.
+	sample func(percent int) bool
+	// collect, if set, counts the results for DMARC aggregate reports.
+	collect func(auth *MessageAuth) error
+}
+
+func NewAuthenticator(hostname string, resolver AuthResolver) *Authenticator {
+	return &Authenticator{
+		hostname: hostname,
+		resolver: resolver,
+		timeout:  30 * time.Second,
+		sample:   func(percent int) bool { return rand.Intn(100) < percent },
+	}
+}
+
+// Check authenticates a message received from ip, which greeted with helo
+// and gave mailFrom as the envelope sender.
+func (a *Authenticator) Check(ip net.IP, helo, mailFrom string, raw []byte) *MessageAuth {
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	auth := &MessageAuth{Helo: helo, Disposition: string(dmarc.PolicyNone)}
+	if ip != nil {
+		auth.RemoteIP = ip.String()
+	}
+	a.checkSPF(ctx, auth, ip, helo, mailFrom)
+	a.checkDKIM(ctx, auth, raw)
+	a.checkDMARC(ctx, auth, raw)
+	return auth
+}
+
+// Collect counts the outcome of a finished transaction, accepted or
+// rejected, towards the sender domain's next aggregate report.
+func (a *Authenticator) Collect(auth *MessageAuth) {
+	if a.collect == nil || auth.DMARCDomain == "" {
+		return
+	}
+	if err := a.collect(auth); err != nil {
+		log.Printf("Failed to record DMARC result for %s: %v", auth.HeaderFrom, err)
+	}
+}
+
+func (a *Authenticator) checkSPF(ctx context.Context, auth *MessageAuth, ip net.IP, helo, mailFrom string) {
+	auth.SPFDomain = addressDomain(mailFrom)
+	if auth.SPFDomain == "" {
+		auth.SPFDomain = strings.ToLower(helo)
+	}
+	if ip == nil || auth.SPFDomain == "" {
+		auth.SPF = string(authres.ResultNone)
+		return
+	}
+	result, _ := spf.CheckHostWithSender(ip, helo, mailFrom, spf.WithContext(ctx), spf.WithResolver(a.resolver))
+	auth.SPF = string(result)
+}
+
+func (a *Authenticator) checkDKIM(ctx context.Context, auth *MessageAuth, raw []byte) {
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+		LookupTXT:        a.lookupTXT(ctx),
+		MaxVerifications: 10,
+	})
+	if err != nil && err != dkim.ErrTooManySignatures {
+		auth.DKIM = string(authres.ResultPermError)
+		return
+	}
+
+	auth.DKIM = string(authres.ResultNone)
+	var domains []string
+	for _, v := range verifications {
+		value := dkimResult(v.Err)
+		auth.dkimResults = append(auth.dkimResults, &authres.DKIMResult{Value: value, Domain: v.Domain, Identifier: v.Identifier})
+		if value == authres.ResultPass {
+			domains = append(domains, strings.ToLower(v.Domain))
+		}
+		// Any valid signature makes the message pass; otherwise report
+		// the first signature's result.
+		if value == authres.ResultPass || auth.DKIM == string(authres.ResultNone) {
+			auth.DKIM = string(value)
+		}
+	}
+	auth.DKIMDomains = strings.Join(domains, " ")
+}
+
+func dkimResult(err error) authres.ResultValue {
+	switch {
+	case err == nil:
+		return authres.ResultPass
+	case dkim.IsTempFail(err):
+		return authres.ResultTempError
+	case dkim.IsPermFail(err):
+		return authres.ResultPermError
+	default:
+		return authres.ResultFail
+	}
+}
+
+func (a *Authenticator) checkDMARC(ctx context.Context, auth *MessageAuth, raw []byte) {
+	header, _, err := parseMessage(raw)
+	if err != nil {
+		auth.DMARC = string(authres.ResultPermError)
+		return
+	}
+	// DMARC needs exactly one author domain.
+	from, err := mail.ParseAddressList(header.Get("From"))
+	if err != nil || len(from) != 1 || addressDomain(from[0].Address) == "" {
+		auth.DMARC = string(authres.ResultPermError)
+		return
+	}
+	auth.HeaderFrom = addressDomain(from[0].Address)
+
+	record, recordDomain, policy, err := a.lookupDMARC(ctx, auth.HeaderFrom)
+	switch {
+	case err == dmarc.ErrNoPolicy:
+		auth.DMARC = string(authres.ResultNone)
+		return
+	case dmarc.IsTempFail(err):
+		auth.DMARC = string(authres.ResultTempError)
+		return
+	case err != nil:
+		auth.DMARC = string(authres.ResultPermError)
+		return
+	}
+	auth.DMARCPolicy = string(policy)
+	auth.DMARCDomain = recordDomain
+
+	auth.SPFAligned = auth.SPF == string(authres.ResultPass) &&
+		aligned(auth.SPFDomain, auth.HeaderFrom, record.SPFAlignment)
+	for _, domain := range strings.Fields(auth.DKIMDomains) {
+		if aligned(domain, auth.HeaderFrom, record.DKIMAlignment) {
+			auth.DKIMAligned = true
+		}
+	}
+	if auth.SPFAligned || auth.DKIMAligned {
+		auth.DMARC = string(authres.ResultPass)
+		return
+	}
+	auth.DMARC = string(authres.ResultFail)
+
+	// Messages outside pct get the next milder policy (RFC 7489, 6.6.4).
+	if record.Percent != nil && *record.Percent < 100 && !a.sample(*record.Percent) {
+		switch policy {
+		case dmarc.PolicyReject:
+			policy = dmarc.PolicyQuarantine
+		case dmarc.PolicyQuarantine:
+			policy = dmarc.PolicyNone
+		}
+	}
+	auth.Disposition = string(policy)
+}
+
+// lookupDMARC finds the record for domain, falling back to its
+// organizational domain, and returns it with the domain it was found at and
+// the policy that applies to domain.
+func (a *Authenticator) lookupDMARC(ctx context.Context, domain string) (*dmarc.Record, string, dmarc.Policy, error) {
+	options := &dmarc.LookupOptions{LookupTXT: a.lookupTXT(ctx)}
+	record, err := dmarc.LookupWithOptions(domain, options)
+	if err == nil {
+		return record, domain, record.Policy, nil
+	}
+
+	org := organizationalDomain(domain)
+	if err != dmarc.ErrNoPolicy || org == domain {
+		return nil, "", "", err
+	}
+	if record, err = dmarc.LookupWithOptions(org, options); err != nil {
+		return nil, "", "", err
+	}
+	if record.SubdomainPolicy != "" {
+		return record, org, record.SubdomainPolicy, nil
+	}
+	return record, org, record.Policy, nil
+}
+
+func (a *Authenticator) lookupTXT(ctx context.Context) func(string) ([]string, error) {
+	return func(name string) ([]string, error) {
+		return a.resolver.LookupTXT(ctx, name)
+	}
+}
+
+// aligned reports whether an authenticated domain matches the From domain
+// in the given DMARC alignment mode.
+func aligned(domain, from string, mode dmarc.AlignmentMode) bool {
+	if strings.EqualFold(domain, from) {
+		return true
+	}
+	return mode != dmarc.AlignmentStrict && organizationalDomain(domain) == organizationalDomain(from)
+}
+
+// organizationalDomain returns the registered domain that name belongs to,
+// such as example.co.uk for mail.example.co.uk.
+func organizationalDomain(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	org, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return name
+	}
+	return org
+}
+
+// Header returns the Authentication-Results field for the message, ending
+// in CRLF.
+func (a *Authenticator) Header(auth *MessageAuth) string {
+	results := []authres.Result{&authres.SPFResult{
+		Value: authres.ResultValue(auth.SPF),
+		From:  auth.SPFDomain,
+		Helo:  auth.Helo,
+	}}
+	results = append(results, auth.dkimResults...)
+	if len(auth.dkimResults) == 0 {
+		results = append(results, &authres.DKIMResult{Value: authres.ResultValue(auth.DKIM)})
+	}
+	results = append(results, &authres.DMARCResult{
+		Value: authres.ResultValue(auth.DMARC),
+		From:  auth.HeaderFrom,
+	})
+	return "Authentication-Results: " + authres.Format(a.hostname, results) + "\r\n"
+}
+
+// Stamp removes Authentication-Results fields that claim to come from this
+// server, which only a forger could have added, and prepends the real one.
+func (a *Authenticator) Stamp(raw []byte, auth *MessageAuth) []byte {
+	header, body, err := parseMessage(raw)
+	if err == nil {
+		removed := false
+		fields := header.FieldsByKey("Authentication-Results")
+		for fields.Next() {
+			id, _, err := authres.Parse(fields.Value())
+			if err == nil && strings.EqualFold(id, a.hostname) {
+				fields.Del()
+				removed = true
+			}
+		}
+		if removed {
+			var buf bytes.Buffer
+			if err := textproto.WriteHeader(&buf, header); err == nil {
+				buf.Write(body)
+				raw = buf.Bytes()
+			}
+		}
+	}
+	return append([]byte(a.Header(auth)), raw...)
+}
+
+func storeMessageAuth(db execer, messageID int64, auth *MessageAuth) error {
+	_, err := db.Exec(`INSERT INTO message_auth (message_id, remote_ip, helo, spf, spf_domain, spf_aligned,
+		dkim, dkim_domains, dkim_aligned, dmarc, dmarc_policy, disposition, header_from)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		messageID, auth.RemoteIP, auth.Helo, auth.SPF, auth.SPFDomain, auth.SPFAligned,
+		auth.DKIM, auth.DKIMDomains, auth.DKIMAligned, auth.DMARC, auth.DMARCPolicy, auth.Disposition, auth.HeaderFrom)
+	return err
+}
+
+// loadMessageAuth returns the checks recorded for a message, or nil for
+// mail that did not arrive on the MX listener.
+func loadMessageAuth(db execer, messageID int64) (*MessageAuth, error) {
+	auth := &MessageAuth{}
+	err := db.QueryRow(`SELECT remote_ip, helo, spf, spf_domain, spf_aligned, dkim, dkim_domains, dkim_aligned,
+		dmarc, dmarc_policy, disposition, header_from FROM message_auth WHERE message_id = ?`, messageID).Scan(
+		&auth.RemoteIP, &auth.Helo, &auth.SPF, &auth.SPFDomain, &auth.SPFAligned, &auth.DKIM, &auth.DKIMDomains,
+		&auth.DKIMAligned, &auth.DMARC, &auth.DMARCPolicy, &auth.Disposition, &auth.HeaderFrom)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
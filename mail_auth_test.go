@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+// authZone answers the SPF, DKIM and DMARC lookups from TXT records in
+// memory. Names in fail give a temporary DNS error.
+type authZone struct {
+	txt  map[string][]string
+	fail map[string]bool
+}
+
+func (z authZone) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	name = strings.TrimSuffix(name, ".")
+	if z.fail[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if records, ok := z.txt[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (z authZone) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (z authZone) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (z authZone) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestAuthenticatorCheck(t *testing.T) {
+	signer := NewDKIMSigner(newTestDB(t))
+	if err := signer.EnsureKeys([]string{"sender.example"}); err != nil {
+		t.Fatal(err)
+	}
+
+	zone := authZone{
+		txt: map[string][]string{
+			"sender.example":              {"v=spf1 ip4:192.0.2.1 -all"},
+			"_dmarc.sender.example":       {"v=DMARC1; p=reject"},
+			"spoof.example":               {"v=spf1 -all"},
+			"_dmarc.spoof.example":        {"v=DMARC1; p=reject"},
+			"_dmarc.quar.example":         {"v=DMARC1; p=none; sp=quarantine"},
+			"bounce.relaxed.example":      {"v=spf1 ip4:192.0.2.1 -all"},
+			"_dmarc.relaxed.example":      {"v=DMARC1; p=reject"},
+			"bounce.strict.example":       {"v=spf1 ip4:192.0.2.1 -all"},
+			"_dmarc.strict.example":       {"v=DMARC1; p=reject; aspf=s"},
+			"_dmarc.sampled.example":      {"v=DMARC1; p=reject; pct=10"},
+			"_dmarc.sampled-none.example": {"v=DMARC1; p=quarantine; pct=10"},
+		},
+		fail: map[string]bool{"_dmarc.broken.example": true},
+	}
+	keys, err := signer.Keys("sender.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		record, err := key.TXTRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		zone.txt[key.DNSName()] = record
+	}
+
+	auth := NewAuthenticator("mx.localhost.com", zone)
+	auth.sample = func(percent int) bool { return false }
+
+	const (
+		listed   = "192.0.2.1"
+		unlisted = "198.51.100.7"
+	)
+	tests := []struct {
+		name        string
+		ip          string
+		mailFrom    string
+		from        string
+		sign        bool
+		tamper      bool
+		spf         string
+		dkim        string
+		dmarc       string
+		disposition string
+	}{
+		{"aligned spf", listed, "a@sender.example", "a@sender.example", false, false, "pass", "none", "pass", "none"},
+		{"aligned dkim", unlisted, "a@sender.example", "a@sender.example", true, false, "fail", "pass", "pass", "none"},
+		{"tampered dkim", unlisted, "a@sender.example", "a@sender.example", true, true, "fail", "permerror", "fail", "reject"},
+		{"spoofed", listed, "ceo@spoof.example", "ceo@spoof.example", false, false, "fail", "none", "fail", "reject"},
+		{"subdomain policy", listed, "x@mail.quar.example", "x@mail.quar.example", false, false, "none", "none", "fail", "quarantine"},
+		{"relaxed alignment", listed, "b@bounce.relaxed.example", "n@relaxed.example", false, false, "pass", "none", "pass", "none"},
+		{"strict alignment", listed, "b@bounce.strict.example", "n@strict.example", false, false, "pass", "none", "fail", "reject"},
+		{"outside pct", listed, "p@sampled.example", "p@sampled.example", false, false, "none", "none", "fail", "quarantine"},
+		{"outside pct quarantine", listed, "p@sampled-none.example", "p@sampled-none.example", false, false, "none", "none", "fail", "none"},
+		{"no policy", listed, "n@nodmarc.example", "n@nodmarc.example", false, false, "none", "none", "none", "none"},
+		{"dns failure", listed, "n@broken.example", "n@broken.example", false, false, "none", "none", "temperror", "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := []byte("From: " + tt.from + "\r\nTo: bob@localhost.com\r\nSubject: hi\r\n\r\nhello\r\n")
+			if tt.sign {
+				if raw, err = signer.Sign(raw); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.tamper {
+				raw = bytes.Replace(raw, []byte("hello"), []byte("hullo"), 1)
+			}
+
+			got := auth.Check(net.ParseIP(tt.ip), "client.example", tt.mailFrom, raw)
+			if got.SPF != tt.spf || got.DKIM != tt.dkim || got.DMARC != tt.dmarc || got.Disposition != tt.disposition {
+				t.Errorf("got spf=%s dkim=%s dmarc=%s disposition=%s, want spf=%s dkim=%s dmarc=%s disposition=%s",
+					got.SPF, got.DKIM, got.DMARC, got.Disposition, tt.spf, tt.dkim, tt.dmarc, tt.disposition)
+			}
+		})
+	}
+}
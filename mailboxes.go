@@ -0,0 +1,548 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+)
+
+// mailboxDelimiter separates levels of the mailbox hierarchy.
+const mailboxDelimiter = "/"
+
+// Mailbox is a folder owned by one user.
+type Mailbox struct {
+	ID         int64  `json:"id"`
+	UserID     int    `json:"user_id"`
+	Name       string `json:"name"`
+	SpecialUse string `json:"special_use,omitempty"` // RFC 6154 attribute, e.g. \Sent
+	Subscribed bool   `json:"subscribed"`
+	// UIDValidity changes whenever a mailbox of this name is recreated, so
+	// clients know to drop cached UIDs.
+	UIDValidity uint32 `json:"uid_validity"`
+	UIDNext     uint32 `json:"uid_next"`
+}
+
+// defaultMailboxes are created for every user.
+var defaultMailboxes = []struct {
+	name       string
+	specialUse string
+}{
+	{"INBOX", ""},
+	{"Sent", imap.SentAttr},
+	{"Drafts", imap.DraftsAttr},
+	{"Trash", imap.TrashAttr},
+	{"Junk", imap.JunkAttr},
+	{"Archive", imap.ArchiveAttr},
+}
+
+var errMailboxHasChildren = errors.New("mailbox has children, delete them first")
+
+func (s *EmailServer) createMailboxTables() error {
+	mailboxTable := `
+	CREATE TABLE IF NOT EXISTS mailboxes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		special_use TEXT NOT NULL DEFAULT '',
+		subscribed BOOLEAN NOT NULL DEFAULT TRUE,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (user_id, name)
+	);`
+
+	if _, err := s.db.Exec(mailboxTable); err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(s.db, "emails", "mailbox_id", "INTEGER REFERENCES mailboxes(id)"); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec("CREATE INDEX IF NOT EXISTS idx_emails_mailbox ON emails(mailbox_id)"); err != nil {
+		return err
+	}
+
+	// Per-mailbox UIDs (RFC 3501 section 2.3.1.1)
+	if err := addColumnIfMissing(s.db, "mailboxes", "uid_validity", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(s.db, "mailboxes", "uid_next", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(s.db, "emails", "uid", "INTEGER"); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_emails_mailbox_uid ON emails(mailbox_id, uid)"); err != nil {
+		return err
+	}
+
+	// The last UIDVALIDITY handed out is kept apart from the mailboxes so it
+	// survives deleting the mailbox that used it.
+	validityTable := `
+	CREATE TABLE IF NOT EXISTS uid_validity (
+		last INTEGER NOT NULL
+	);
+	INSERT INTO uid_validity (last)
+		SELECT COALESCE(MAX(uid_validity), 0) FROM mailboxes
+		WHERE NOT EXISTS (SELECT 1 FROM uid_validity);`
+
+	if _, err := s.db.Exec(validityTable); err != nil {
+		return err
+	}
+
+	// Give existing users their default folders and file mail that predates
+	// mailboxes into the owner's INBOX.
+	rows, err := s.db.Query("SELECT id FROM users")
+	if err != nil {
+		return err
+	}
+	var userIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, id)
+	}
+	rows.Close()
+
+	for _, id := range userIDs {
+		if err := ensureDefaultMailboxes(s.db, id); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.db.Exec(`UPDATE emails SET mailbox_id = (
+			SELECT m.id FROM mailboxes m JOIN users u ON u.id = m.user_id
+			WHERE u.email = emails.to_email AND m.name = 'INBOX')
+		WHERE mailbox_id IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	return s.backfillUIDs()
+}
+
+// backfillUIDs assigns UIDVALIDITY to mailboxes and UIDs to messages that
+// were created before UIDs were tracked.
+func (s *EmailServer) backfillUIDs() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	mailboxIDs, err := queryIDs(tx, "SELECT id FROM mailboxes WHERE uid_validity = 0 ORDER BY id")
+	if err != nil {
+		return err
+	}
+	for _, id := range mailboxIDs {
+		validity, err := newUIDValidity(tx)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE mailboxes SET uid_validity = ? WHERE id = ?", validity, id); err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query("SELECT id, mailbox_id FROM emails WHERE uid IS NULL AND mailbox_id IS NOT NULL ORDER BY mailbox_id, id")
+	if err != nil {
+		return err
+	}
+	type pending struct{ id, mailboxID int64 }
+	var emails []pending
+	for rows.Next() {
+		var e pending
+		if err := rows.Scan(&e.id, &e.mailboxID); err != nil {
+			rows.Close()
+			return err
+		}
+		emails = append(emails, e)
+	}
+	rows.Close()
+
+	for _, e := range emails {
+		uid, err := allocateUID(tx, e.mailboxID)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE emails SET uid = ? WHERE id = ?", uid, e.id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func queryIDs(db execer, query string, args ...interface{}) ([]int64, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// newUIDValidity returns a UIDVALIDITY value larger than any handed out
+// before, so a recreated mailbox never reuses an old one.
+func newUIDValidity(db execer) (uint32, error) {
+	var validity uint32
+	err := db.QueryRow("UPDATE uid_validity SET last = MAX(last + 1, ?) RETURNING last", time.Now().Unix()).Scan(&validity)
+	return validity, err
+}
+
+// allocateUID reserves the next UID of a mailbox.
+func allocateUID(db execer, mailboxID int64) (uint32, error) {
+	var uid uint32
+	err := db.QueryRow("UPDATE mailboxes SET uid_next = uid_next + 1 WHERE id = ? RETURNING uid_next - 1", mailboxID).Scan(&uid)
+	return uid, err
+}
+
+// insertMailbox creates a mailbox with a fresh UIDVALIDITY unless one of
+// that name already exists.
+func insertMailbox(db execer, userID int, name, specialUse string) error {
+	validity, err := newUIDValidity(db)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR IGNORE INTO mailboxes (user_id, name, special_use, uid_validity) VALUES (?, ?, ?, ?)",
+		userID, name, specialUse, validity)
+	return err
+}
+
+// moveAllEmails refiles every message of one mailbox into another, giving
+// each a new UID in the destination.
+func moveAllEmails(db execer, fromMailboxID, toMailboxID int64) error {
+	ids, err := queryIDs(db, "SELECT id FROM emails WHERE mailbox_id = ? ORDER BY uid", fromMailboxID)
+	if err != nil {
+		return err
+	}
+	_, _, err = moveEmails(db, ids, fromMailboxID, toMailboxID)
+	return err
+}
+
+// moveEmails refiles emails into another mailbox under new UIDs. It returns
+// the sequence numbers they had in the source, highest first, and their
+// UIDs in the destination.
+func moveEmails(db execer, emailIDs []int64, fromMailboxID, toMailboxID int64) ([]uint32, []uint32, error) {
+	seqNums, _, err := mailboxPositions(db, fromMailboxID, emailIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var uids []uint32
+	for _, id := range emailIDs {
+		var count int
+		db.QueryRow("SELECT COUNT(*) FROM emails WHERE id = ? AND mailbox_id = ?", id, fromMailboxID).Scan(&count)
+		if count == 0 {
+			continue
+		}
+		uid, err := allocateUID(db, toMailboxID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := db.Exec("UPDATE emails SET mailbox_id = ?, uid = ? WHERE id = ?", toMailboxID, uid, id); err != nil {
+			return nil, nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return seqNums, uids, nil
+}
+
+// copyEmails files copies of emails into another mailbox under new UIDs,
+// along with their flags. The copies share the stored message of the
+// original. It returns the new UIDs in the order of emailIDs.
+func copyEmails(db execer, emailIDs []int64, toMailboxID int64) ([]uint32, error) {
+	var uids []uint32
+	for _, id := range emailIDs {
+		uid, err := allocateUID(db, toMailboxID)
+		if err != nil {
+			return nil, err
+		}
+		res, err := db.Exec(`INSERT INTO emails (message_id, from_email, to_email, date, mailbox_id, uid)
+			SELECT message_id, from_email, to_email, date, ?, ? FROM emails WHERE id = ?`, toMailboxID, uid, id)
+		if err != nil {
+			return nil, err
+		}
+		copyID, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		_, err = db.Exec("INSERT INTO email_flags (email_id, flag) SELECT ?, flag FROM email_flags WHERE email_id = ?", copyID, id)
+		if err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+// ensureDefaultMailboxes creates any of the default folders the user is
+// missing.
+func ensureDefaultMailboxes(db execer, userID int) error {
+	for _, mbox := range defaultMailboxes {
+		if err := insertMailbox(db, userID, mbox.name, mbox.specialUse); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeMailboxName canonicalizes INBOX, which is case-insensitive, and
+// drops a trailing hierarchy delimiter.
+func normalizeMailboxName(name string) string {
+	name = strings.TrimSuffix(name, mailboxDelimiter)
+	if strings.EqualFold(name, "INBOX") {
+		return "INBOX"
+	}
+	if len(name) > len("INBOX/") && strings.EqualFold(name[:len("INBOX/")], "INBOX/") {
+		return "INBOX/" + name[len("INBOX/"):]
+	}
+	return name
+}
+
+const mailboxColumns = "id, user_id, name, special_use, subscribed, uid_validity, uid_next"
+
+func scanMailbox(row interface{ Scan(...interface{}) error }) (*Mailbox, error) {
+	var m Mailbox
+	if err := row.Scan(&m.ID, &m.UserID, &m.Name, &m.SpecialUse, &m.Subscribed, &m.UIDValidity, &m.UIDNext); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// getMailbox looks up one of the user's mailboxes by name.
+func getMailbox(db execer, userID int, name string) (*Mailbox, error) {
+	row := db.QueryRow("SELECT "+mailboxColumns+" FROM mailboxes WHERE user_id = ? AND name = ?",
+		userID, normalizeMailboxName(name))
+	m, err := scanMailbox(row)
+	if err == sql.ErrNoRows {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return m, err
+}
+
+// getMailboxByID looks up a mailbox and checks that it belongs to the user.
+func getMailboxByID(db execer, userID int, id int64) (*Mailbox, error) {
+	row := db.QueryRow("SELECT "+mailboxColumns+" FROM mailboxes WHERE user_id = ? AND id = ?", userID, id)
+	m, err := scanMailbox(row)
+	if err == sql.ErrNoRows {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return m, err
+}
+
+// getSpecialMailbox returns the user's mailbox with the given RFC 6154
+// attribute, or INBOX when specialUse is empty.
+func getSpecialMailbox(db execer, userID int, specialUse string) (*Mailbox, error) {
+	if specialUse == "" {
+		return getMailbox(db, userID, "INBOX")
+	}
+	row := db.QueryRow("SELECT "+mailboxColumns+" FROM mailboxes WHERE user_id = ? AND special_use = ? ORDER BY id LIMIT 1",
+		userID, specialUse)
+	m, err := scanMailbox(row)
+	if err == sql.ErrNoRows {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return m, err
+}
+
+// listMailboxes returns the user's mailboxes in name order, INBOX first.
+func listMailboxes(db execer, userID int, subscribedOnly bool) ([]*Mailbox, error) {
+	query := "SELECT " + mailboxColumns + " FROM mailboxes WHERE user_id = ?"
+	if subscribedOnly {
+		query += " AND subscribed = TRUE"
+	}
+	query += " ORDER BY name != 'INBOX', name"
+
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mailboxes []*Mailbox
+	for rows.Next() {
+		m, err := scanMailbox(rows)
+		if err != nil {
+			return nil, err
+		}
+		mailboxes = append(mailboxes, m)
+	}
+	return mailboxes, rows.Err()
+}
+
+// hasChildren reports whether any mailbox sits below m in the hierarchy.
+// SQLite's substr counts characters, not bytes, hence the rune counts here
+// and in renameMailbox.
+func (m *Mailbox) hasChildren(db execer) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM mailboxes WHERE user_id = ? AND substr(name, 1, ?) = ?",
+		m.UserID, utf8.RuneCountInString(m.Name)+1, m.Name+mailboxDelimiter).Scan(&count)
+	return count > 0
+}
+
+// DisplayName is the last component of the mailbox's hierarchical name.
+func (m *Mailbox) DisplayName() string {
+	if i := strings.LastIndex(m.Name, mailboxDelimiter); i >= 0 {
+		return m.Name[i+1:]
+	}
+	return m.Name
+}
+
+// createMailbox creates name along with any missing parent mailboxes.
+func createMailbox(db *sql.DB, userID int, name string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertMailboxPath(tx, userID, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertMailboxPath creates a new mailbox along with any missing parents.
+func insertMailboxPath(db execer, userID int, name string) error {
+	name = normalizeMailboxName(name)
+	if name == "" || strings.Contains(name, mailboxDelimiter+mailboxDelimiter) {
+		return errors.New("invalid mailbox name")
+	}
+	if _, err := getMailbox(db, userID, name); err == nil {
+		return backend.ErrMailboxAlreadyExists
+	}
+
+	parts := strings.Split(name, mailboxDelimiter)
+	for i := range parts {
+		path := strings.Join(parts[:i+1], mailboxDelimiter)
+		if err := insertMailbox(db, userID, path, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteMailbox removes a mailbox and the messages filed in it. INBOX and
+// the special-use mailboxes can't be deleted, and neither can a mailbox
+// that still has children.
+func deleteMailbox(db *sql.DB, userID int, name string) error {
+	m, err := getMailbox(db, userID, name)
+	if err != nil {
+		return err
+	}
+	if m.Name == "INBOX" {
+		return errors.New("cannot delete INBOX")
+	}
+	if m.SpecialUse != "" {
+		// Delivery, sending and the Junk filter file mail into these
+		return fmt.Errorf("cannot delete %s, it is the %s mailbox", m.Name, m.SpecialUse)
+	}
+	if m.hasChildren(db) {
+		return errMailboxHasChildren
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	emailIDs, err := queryIDs(tx, "SELECT id FROM emails WHERE mailbox_id = ?", m.ID)
+	if err != nil {
+		return err
+	}
+	_, messageIDs, err := expungeEmails(tx, m.ID, emailIDs)
+	if err != nil {
+		return err
+	}
+	if err := collectMessages(tx, messageIDs); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM mailboxes WHERE id = ?", m.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// renameMailbox renames a mailbox together with everything below it.
+// Renaming INBOX moves its messages into a new mailbox and leaves INBOX
+// empty, as RFC 3501 requires.
+func renameMailbox(db *sql.DB, userID int, existingName, newName string) error {
+	m, err := getMailbox(db, userID, existingName)
+	if err != nil {
+		return err
+	}
+	newName = normalizeMailboxName(newName)
+	if newName == "" || newName == "INBOX" {
+		return errors.New("invalid mailbox name")
+	}
+	if _, err := getMailbox(db, userID, newName); err == nil {
+		return backend.ErrMailboxAlreadyExists
+	}
+	if strings.HasPrefix(newName, m.Name+mailboxDelimiter) {
+		return errors.New("cannot move a mailbox into itself")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.Name == "INBOX" {
+		if err := insertMailboxPath(tx, userID, newName); err != nil {
+			return err
+		}
+		dest, err := getMailbox(tx, userID, newName)
+		if err != nil {
+			return err
+		}
+		if err := moveAllEmails(tx, m.ID, dest.ID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+
+	// Create missing parents of the new name first.
+	parts := strings.Split(newName, mailboxDelimiter)
+	for i := 0; i < len(parts)-1; i++ {
+		path := strings.Join(parts[:i+1], mailboxDelimiter)
+		if err := insertMailbox(tx, userID, path, ""); err != nil {
+			return err
+		}
+	}
+
+	length := utf8.RuneCountInString(m.Name)
+	_, err = tx.Exec(`UPDATE mailboxes SET name = ? || substr(name, ?)
+		WHERE user_id = ? AND (name = ? OR substr(name, 1, ?) = ?)`,
+		newName, length+1, userID, m.Name, length+1, m.Name+mailboxDelimiter)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// setSubscribed persists the subscription state of a mailbox.
+func setSubscribed(db execer, mailboxID int64, subscribed bool) error {
+	_, err := db.Exec("UPDATE mailboxes SET subscribed = ? WHERE id = ?", subscribed, mailboxID)
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenameInbox(t *testing.T) {
+	inbox, db := searchFixture(t)
+
+	// A failed move must not leave the new mailbox behind
+	trigger := `CREATE TRIGGER fail_move BEFORE UPDATE OF mailbox_id ON emails
+		BEGIN SELECT RAISE(ABORT, 'move failed'); END`
+	if _, err := db.Exec(trigger); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameMailbox(db, inbox.UserID, "INBOX", "Old/2023"); err == nil {
+		t.Fatal("rename succeeded with the move failing")
+	}
+	for _, name := range []string{"Old", "Old/2023"} {
+		if _, err := getMailbox(db, inbox.UserID, name); err == nil {
+			t.Errorf("%s created by a failed rename", name)
+		}
+	}
+
+	if _, err := db.Exec("DROP TRIGGER fail_move"); err != nil {
+		t.Fatal(err)
+	}
+	if err := renameMailbox(db, inbox.UserID, "INBOX", "Old/2023"); err != nil {
+		t.Fatal(err)
+	}
+	old, err := getMailbox(db, inbox.UserID, "Old/2023")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inInbox, inOld int
+	db.QueryRow("SELECT COUNT(*) FROM emails WHERE mailbox_id = ?", inbox.ID).Scan(&inInbox)
+	db.QueryRow("SELECT COUNT(*) FROM emails WHERE mailbox_id = ?", old.ID).Scan(&inOld)
+	if inInbox != 0 || inOld != 3 {
+		t.Errorf("%d messages left in INBOX and %d in Old/2023, want 0 and 3", inInbox, inOld)
+	}
+}
+
+func TestNewUIDValidity(t *testing.T) {
+	now := uint32(time.Now().Unix())
+	tests := []struct {
+		name string
+		last uint32
+		min  uint32
+	}{
+		{"fresh database", 0, now},
+		{"last handed out long ago", 1000, now},
+		{"clock set back", now + 3600, now + 3601},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if _, err := db.Exec("UPDATE uid_validity SET last = ?", tt.last); err != nil {
+				t.Fatal(err)
+			}
+			first, err := newUIDValidity(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first < tt.min || first > tt.min+5 {
+				t.Errorf("got %d, want %d or a few seconds later", first, tt.min)
+			}
+			second, err := newUIDValidity(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if second <= first {
+				t.Errorf("second value %d not above the first %d", second, first)
+			}
+		})
+	}
+}
+
+func TestAllocateUID(t *testing.T) {
+	db := newTestDB(t)
+	userID := newTestUser(t, db, "bob@localhost.com")
+	if err := createMailbox(db, userID, "Work"); err != nil {
+		t.Fatal(err)
+	}
+	work, err := getMailbox(db, userID, "Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbox, err := getMailbox(db, userID, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		mailbox *Mailbox
+		want    uint32
+	}{
+		{inbox, 1},
+		{inbox, 2},
+		{work, 1},
+		{inbox, 3},
+		{work, 2},
+	}
+	for i, step := range steps {
+		uid, err := allocateUID(db, step.mailbox.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid != step.want {
+			t.Errorf("step %d: %s got UID %d, want %d", i, step.mailbox.Name, uid, step.want)
+		}
+	}
+
+	// A deleted and recreated mailbox starts over under a new UIDVALIDITY
+	if err := deleteMailbox(db, userID, "Work"); err != nil {
+		t.Fatal(err)
+	}
+	if err := createMailbox(db, userID, "Work"); err != nil {
+		t.Fatal(err)
+	}
+	recreated, err := getMailbox(db, userID, "Work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recreated.UIDValidity <= work.UIDValidity {
+		t.Errorf("recreated UIDVALIDITY %d not above %d", recreated.UIDValidity, work.UIDValidity)
+	}
+	if uid, err := allocateUID(db, recreated.ID); err != nil || uid != 1 {
+		t.Errorf("recreated mailbox got UID %d, %v, want 1", uid, err)
+	}
+}
@@ -1,26 +1,44 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"html/template"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
 	"github.com/emersion/go-imap/server"
 	"github.com/emersion/go-smtp"
 	"github.com/gorilla/mux"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/crypto/bcrypt"
 	_ "modernc.org/sqlite"
 )
 
 type EmailServer struct {
 	db         *sql.DB
+	config     *Config
 	imapServer *server.Server
-	smtpServer *smtp.Server
-	domains    []string // Available domains for email creation
+	smtpServer *smtp.Server // MX: mail for our domains from other servers
+	submission *smtp.Server // mail from our users, authenticated
+	domains    []string     // Available domains for email creation
+	delivery   *Delivery
+	outbound   *OutboundQueue
+	events     *EventBus
+	certs      *certStore
+	dkim       *DKIMSigner
+	auth       *Authenticator
+	reports    *DMARCReports
 }
 
 type User struct {
@@ -32,15 +50,34 @@ type User struct {
 }
 
 type Email struct {
-	ID      int    `json:"id"`
-	From    string `json:"from"`
-	To      string `json:"to"`
-	Subject string `json:"subject"`
-	Body    string `json:"body"`
-	Date    string `json:"date"`
-	Read    bool   `json:"read"`
+	ID        int    `json:"id"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Cc        string `json:"cc,omitempty"`
+	ReplyTo   string `json:"reply_to,omitempty"`
+	MessageID string `json:"message_id,omitempty"`
+	Subject   string `json:"subject"`
+	Body      string `json:"body"`
+	Date      string `json:"date"`
+	Read      bool   `json:"read"`    // \Seen
+	Starred   bool   `json:"starred"` // \Flagged
+	MailboxID int64  `json:"mailbox_id"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Auth        *MessageAuth `json:"auth,omitempty"` // inbound SPF/DKIM/DMARC results
 }
 
+// emailTableSchema holds one row per delivered copy of a stored message.
+const emailTableSchema = `
+	CREATE TABLE IF NOT EXISTS emails (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id INTEGER NOT NULL REFERENCES messages(id),
+		from_email TEXT NOT NULL,
+		to_email TEXT NOT NULL,
+		date DATETIME DEFAULT CURRENT_TIMESTAMP,
+		read BOOLEAN DEFAULT FALSE
+	);`
+
 func main() {
 	server := &EmailServer{}
 	if err := server.Initialize(); err != nil {
@@ -49,20 +86,46 @@ func main() {
 
 	// Start SMTP server
 	go func() {
-		log.Println("Starting SMTP server on :2525")
-		if err := server.smtpServer.ListenAndServe(); err != nil {
+		l, err := server.listen("SMTP", server.smtpServer.Addr, "", nil)
+		if err == nil {
+			err = server.smtpServer.Serve(l)
+		}
+		if err != nil {
 			log.Printf("SMTP server error: %v", err)
 		}
 	}()
 
+	// Start submission server
+	go func() {
+		l, err := server.listen("submission", server.submission.Addr, server.config.TLS.SMTPSAddr, server.submission.TLSConfig)
+		if err == nil {
+			err = server.submission.Serve(l)
+		}
+		if err != nil {
+			log.Printf("Submission server error: %v", err)
+		}
+	}()
+
 	// Start IMAP server
 	go func() {
-		log.Println("Starting IMAP server on :1143")
-		if err := server.imapServer.ListenAndServe(); err != nil {
+		l, err := server.listen("IMAP", server.imapServer.Addr, server.config.TLS.IMAPSAddr, server.imapServer.TLSConfig)
+		if err == nil {
+			err = server.imapServer.Serve(l)
+		}
+		if err != nil {
 			log.Printf("IMAP server error: %v", err)
 		}
 	}()
 
+	// Reload the TLS certificate on SIGHUP
+	go server.certs.reloadOnSIGHUP()
+
+	// Start outbound delivery
+	go server.outbound.Run(context.Background())
+
+	// Send and collect DMARC aggregate reports
+	go server.reports.Run(context.Background())
+
 	// Start web server
 	server.StartWebServer()
 }
@@ -70,11 +133,17 @@ func main() {
 func (s *EmailServer) Initialize() error {
 	var err error
 
+	s.config, err = loadConfig()
+	if err != nil {
+		return err
+	}
+
 	// Initialize available domains
 	s.domains = []string{"localhost.com", "emailserver.local", "testmail.dev", "myemail.local"}
 
-	// Initialize database
-	s.db, err = sql.Open("sqlite3", "email_server.db")
+	// Initialize database. SQLite enforces foreign keys, and with them
+	// ON DELETE CASCADE, only when asked to on each connection.
+	s.db, err = sql.Open("sqlite3", "email_server.db?_pragma=foreign_keys(1)")
 	if err != nil {
 		return err
 	}
@@ -83,18 +152,77 @@ func (s *EmailServer) Initialize() error {
 		return err
 	}
 
+	// Initialize delivery: local mailboxes plus the outbound queue
+	transport, err := newTransport(s.config, net.DefaultResolver, &net.Dialer{Timeout: 30 * time.Second})
+	if err != nil {
+		return err
+	}
+	s.events = NewEventBus(s.db)
+	s.outbound = NewOutboundQueue(s.db, s.config.Hostname, s.config.Outbound, transport)
+	s.delivery = NewDelivery(s.db, s.domains, s.outbound, s.events)
+	s.outbound.bounce = s.delivery.Deliver
+
+	// Load the TLS certificate, generating a self-signed one on first run,
+	// and hand out ACME certificates if configured
+	s.certs, err = newCertStore(s.config.TLS, s.config.Hostname)
+	if err != nil {
+		return err
+	}
+	if s.config.TLS.ACME.Enabled {
+		var cache autocert.Cache = dbCertCache{s.db}
+		if s.config.TLS.ACME.CacheDir != "" {
+			cache = autocert.DirCache(s.config.TLS.ACME.CacheDir)
+		}
+		if err := s.certs.enableACME(s.config.TLS.ACME, s.config.Hostname, cache); err != nil {
+			return err
+		}
+	}
+
 	// Initialize IMAP server
-	imapBackend := NewIMAPBackend(s.db)
-	s.imapServer = server.New(imapBackend)
+	s.imapServer = server.New(NewIMAPBackend(s.db, s.events))
 	s.imapServer.Addr = ":1143"
-	s.imapServer.AllowInsecureAuth = true
+	s.imapServer.TLSConfig = s.certs.tlsConfig()
+	s.imapServer.Enable(capabilityExtension{"SPECIAL-USE"}, uidPlusExtension{}, examineExtension{})
 
-	// Initialize SMTP server
-	smtpBackend := NewSMTPBackend(s.db)
+	// Make sure every hosted domain has DKIM keys to sign with
+	s.dkim = NewDKIMSigner(s.db)
+	if err := s.dkim.EnsureKeys(s.domains); err != nil {
+		return err
+	}
+
+	// Initialize SMTP server; other servers deliver here without logging in
+	// if the blocklists let them, and their mail is checked with SPF, DKIM
+	// and DMARC and scored for spam
+	s.auth = NewAuthenticator(s.config.Hostname, net.DefaultResolver)
+
+	// DMARC results are counted for aggregate reports, which are sent
+	// signed like any other mail from us
+	s.reports = NewDMARCReports(s.db, s.config.Hostname, s.domains, s.config.DMARC, net.DefaultResolver)
+	s.reports.send = func(from string, to []string, raw []byte) error {
+		signed, err := s.dkim.Sign(raw)
+		if err != nil {
+			return err
+		}
+		return s.delivery.Deliver(from, to, signed)
+	}
+	s.reports.Watch(s.events)
+	s.auth.collect = s.reports.Record
+	blocklists, err := NewBlocklists(s.config.Blocklists, net.DefaultResolver)
+	if err != nil {
+		return err
+	}
+	smtpBackend := NewSMTPBackend(s.db, s.delivery, s.config.SMTP, s.auth, NewSpamFilter(s.db, s.config.Spam), blocklists)
 	s.smtpServer = smtp.NewServer(smtpBackend)
 	s.smtpServer.Addr = ":2525"
-	s.smtpServer.Domain = "localhost"
-	s.smtpServer.AllowInsecureAuth = true
+	s.smtpServer.Domain = s.config.Hostname
+	s.smtpServer.TLSConfig = s.certs.tlsConfig()
+	s.smtpServer.AuthDisabled = true
+
+	// Initialize submission server
+	s.submission = smtp.NewServer(NewSubmissionBackend(s.db, s.delivery, s.config.SMTP, s.dkim))
+	s.submission.Addr = s.config.Submission.Addr
+	s.submission.Domain = s.config.Hostname
+	s.submission.TLSConfig = s.certs.tlsConfig()
 
 	return nil
 }
@@ -109,22 +237,67 @@ func (s *EmailServer) createTables() error {
 		created DATETIME DEFAULT CURRENT_TIMESTAMP
 	);`
 
-	emailTable := `
-	CREATE TABLE IF NOT EXISTS emails (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		from_email TEXT NOT NULL,
-		to_email TEXT NOT NULL,
-		subject TEXT NOT NULL,
-		body TEXT NOT NULL,
-		date DATETIME DEFAULT CURRENT_TIMESTAMP,
-		read BOOLEAN DEFAULT FALSE
-	);`
-
 	if _, err := s.db.Exec(userTable); err != nil {
 		return err
 	}
 
-	if _, err := s.db.Exec(emailTable); err != nil {
+	if err := s.createMessageTables(); err != nil {
+		return err
+	}
+
+	if err := s.createMIMETables(); err != nil {
+		return err
+	}
+
+	if err := s.createSearchIndex(); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(emailTableSchema); err != nil {
+		return err
+	}
+
+	if err := s.migrateLegacyEmails(); err != nil {
+		return err
+	}
+
+	if err := s.createMailboxTables(); err != nil {
+		return err
+	}
+
+	if err := s.createFlagTables(); err != nil {
+		return err
+	}
+
+	if err := s.createOutboundTables(); err != nil {
+		return err
+	}
+
+	if err := s.createSessionTables(); err != nil {
+		return err
+	}
+
+	if err := s.createSubmissionTables(); err != nil {
+		return err
+	}
+
+	if err := s.createDKIMTables(); err != nil {
+		return err
+	}
+
+	if err := s.createAuthTables(); err != nil {
+		return err
+	}
+
+	if err := s.createDMARCReportTables(); err != nil {
+		return err
+	}
+
+	if err := s.createSpamTables(); err != nil {
+		return err
+	}
+
+	if err := s.createACMETables(); err != nil {
 		return err
 	}
 
@@ -145,14 +318,28 @@ func (s *EmailServer) StartWebServer() {
 	r.HandleFunc("/register", s.registerHandler).Methods("POST")
 	r.HandleFunc("/dashboard", s.dashboardHandler).Methods("GET")
 	r.HandleFunc("/emails", s.emailsHandler).Methods("GET")
+	r.HandleFunc("/search", s.emailsHandler).Methods("GET")
 	r.HandleFunc("/email/{id}", s.emailDetailHandler).Methods("GET")
+	r.HandleFunc("/email/{id}/attachments/{aid}", s.attachmentHandler).Methods("GET")
+	r.HandleFunc("/email/{id}/star", s.starHandler).Methods("POST")
+	r.HandleFunc("/emails/delete", s.deleteEmailsHandler).Methods("POST")
+	r.HandleFunc("/emails/spam", s.markSpamHandler).Methods("POST")
+	r.HandleFunc("/emails/not-spam", s.notSpamHandler).Methods("POST")
+	r.HandleFunc("/events", s.eventsHandler).Methods("GET")
 	r.HandleFunc("/compose", s.composePageHandler).Methods("GET")
 	r.HandleFunc("/compose", s.sendEmailHandler).Methods("POST")
 	r.HandleFunc("/logout", s.logoutHandler).Methods("POST")
+	r.HandleFunc("/sessions", s.sessionsHandler).Methods("GET")
+	r.HandleFunc("/sessions/revoke-all", s.revokeAllSessionsHandler).Methods("POST")
+	r.HandleFunc("/sessions/{id}/revoke", s.revokeSessionHandler).Methods("POST")
+	r.HandleFunc("/admin/dkim", s.dkimAdminHandler).Methods("GET")
+	r.HandleFunc("/admin/dkim/{domain}/rotate", s.rotateDKIMHandler).Methods("POST")
+	r.HandleFunc("/admin/dkim/{domain}/activate", s.activateDKIMHandler).Methods("POST")
+	r.HandleFunc("/admin/dkim/keys/{id}/delete", s.deleteDKIMKeyHandler).Methods("POST")
+	r.HandleFunc("/admin/dmarc", s.dmarcAdminHandler).Methods("GET")
 	r.HandleFunc("/api/domains", s.getDomainsHandler).Methods("GET")
 
-	log.Println("Starting web server on :8585")
-	log.Fatal(http.ListenAndServe(":8585", r))
+	log.Fatal(s.serveWeb(":8585", s.csrfProtect(r)))
 }
 
 func (s *EmailServer) homeHandler(w http.ResponseWriter, r *http.Request) {
@@ -270,7 +457,7 @@ func (s *EmailServer) homeHandler(w http.ResponseWriter, r *http.Request) {
                         Choose from our available domains when creating your email account:
                     </p>
                     <div style="display: flex; flex-wrap: wrap; gap: 8px;">
-                        {{range .}}
+                        {{range .Domains}}
                         <span style="background: var(--background-light); padding: 6px 12px; border-radius: 16px; font-size: 14px; color: var(--primary-color); border: 1px solid var(--border-color);">
                             @{{.}}
                         </span>
@@ -291,19 +478,22 @@ func (s *EmailServer) homeHandler(w http.ResponseWriter, r *http.Request) {
                 <div class="card-body">
                     <div style="display: grid; grid-template-columns: repeat(auto-fit, minmax(200px, 1fr)); gap: 16px;">
                         <div>
-                            <h4 style="font-weight: 500; margin-bottom: 8px; color: var(--text-primary);">SMTP Server</h4>
-                            <p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Host: localhost</p>
-                            <p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Port: 2525</p>
+                            <h4 style="font-weight: 500; margin-bottom: 8px; color: var(--text-primary);">Outgoing Mail (SMTP)</h4>
+                            <p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Host: {{.Setup.Host}}</p>
+                            {{if .Setup.Submission}}<p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Port: {{.Setup.Submission}} (STARTTLS)</p>{{end}}
+                            {{if .Setup.SMTPS}}<p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Port: {{.Setup.SMTPS}} (SSL/TLS)</p>{{end}}
+                            <p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Login required</p>
                         </div>
                         <div>
-                            <h4 style="font-weight: 500; margin-bottom: 8px; color: var(--text-primary);">IMAP Server</h4>
-                            <p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Host: localhost</p>
-                            <p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Port: 1143</p>
+                            <h4 style="font-weight: 500; margin-bottom: 8px; color: var(--text-primary);">Incoming Mail (IMAP)</h4>
+                            <p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Host: {{.Setup.Host}}</p>
+                            {{if .Setup.IMAP}}<p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Port: {{.Setup.IMAP}} (STARTTLS)</p>{{end}}
+                            {{if .Setup.IMAPS}}<p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Port: {{.Setup.IMAPS}} (SSL/TLS)</p>{{end}}
                         </div>
                         <div>
                             <h4 style="font-weight: 500; margin-bottom: 8px; color: var(--text-primary);">Web Interface</h4>
-                            <p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Port: 8080</p>
-                            <p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Protocol: HTTP</p>
+                            {{if .Setup.HTTPS}}<p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Port: {{.Setup.HTTPS}}</p>
+                            <p style="font-size: 14px; color: var(--text-secondary); margin: 4px 0;">Protocol: HTTPS</p>{{end}}
                         </div>
                     </div>
                 </div>
@@ -322,18 +512,50 @@ func (s *EmailServer) homeHandler(w http.ResponseWriter, r *http.Request) {
 </body>
 </html>`))
 
-	tmpl.Execute(w, domains)
+	tmpl.Execute(w, struct {
+		Domains []string
+		Setup   clientSetup
+	}{domains, s.clientSetup()})
+}
+
+// clientSetup is what the home page and dashboard tell users to set up
+// their mail clients with. Ports are empty for listeners that are off.
+type clientSetup struct {
+	Host              string
+	Submission, SMTPS string
+	IMAP, IMAPS       string
+	HTTPS             string
+}
+
+func (s *EmailServer) clientSetup() clientSetup {
+	port := func(addr string) string {
+		_, p, _ := net.SplitHostPort(addr)
+		return p
+	}
+	setup := clientSetup{
+		Host:       s.config.Hostname,
+		Submission: port(s.config.Submission.Addr),
+		SMTPS:      port(s.config.TLS.SMTPSAddr),
+		IMAPS:      port(s.config.TLS.IMAPSAddr),
+		HTTPS:      port(s.config.TLS.HTTPSAddr),
+	}
+	if s.imapServer != nil {
+		setup.IMAP = port(s.imapServer.Addr)
+	}
+	return setup
 }
 
 func (s *EmailServer) loginPageHandler(w http.ResponseWriter, r *http.Request) {
-	tmpl := `
+	tmpl := template.Must(template.New("login").Parse(`
 <!DOCTYPE html>
 <html lang="en">
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="csrf-token" content="{{.CSRFToken}}">
     <title>Sign In - Email Server</title>
     <script src="https://unpkg.com/htmx.org@1.9.6"></script>
+    <script src="/static/csrf.js"></script>
     <link rel="stylesheet" href="/static/style.css">
     <link href="https://fonts.googleapis.com/css2?family=Google+Sans:wght@400;500;600&display=swap" rel="stylesheet">
     <link href="https://fonts.googleapis.com/icon?family=Material+Icons" rel="stylesheet">
@@ -421,10 +643,10 @@ func (s *EmailServer) loginPageHandler(w http.ResponseWriter, r *http.Request) {
         </div>
     </div>
 </body>
-</html>`
+</html>`))
 
 	w.Header().Set("Content-Type", "text/html")
-	fmt.Fprint(w, tmpl)
+	tmpl.Execute(w, struct{ CSRFToken string }{s.csrfToken(w, r)})
 }
 
 func (s *EmailServer) loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -445,12 +667,14 @@ func (s *EmailServer) loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Set session cookie (simple implementation)
-	http.SetCookie(w, &http.Cookie{
-		Name:  "user_id",
-		Value: strconv.Itoa(user.ID),
-		Path:  "/",
-	})
+	if err := s.startSession(w, r, user.ID); err != nil {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<div class="alert alert-error">
+			<span class="material-icons" style="vertical-align: middle; margin-right: 8px;">error</span>
+			Could not sign you in. Please try again.
+		</div>`)
+		return
+	}
 
 	w.Header().Set("HX-Redirect", "/dashboard")
 }
@@ -464,8 +688,10 @@ func (s *EmailServer) registerPageHandler(w http.ResponseWriter, r *http.Request
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="csrf-token" content="{{.CSRFToken}}">
     <title>Register - Email Server</title>
     <script src="https://unpkg.com/htmx.org@1.9.6"></script>
+    <script src="/static/csrf.js"></script>
     <script src="https://cdn.tailwindcss.com"></script>
 </head>
 <body class="bg-gray-100 min-h-screen">
@@ -485,7 +711,7 @@ func (s *EmailServer) registerPageHandler(w http.ResponseWriter, r *http.Request
                     <select id="domain" name="domain" required
                             class="mt-1 block w-full px-3 py-2 border border-gray-300 rounded-md shadow-sm focus:outline-none focus:ring-indigo-500 focus:border-indigo-500"
                             onchange="updateEmailPreview()">
-                        {{range .}}
+                        {{range .Domains}}
                         <option value="{{.}}">{{.}}</option>
                         {{end}}
                     </select>
@@ -541,7 +767,34 @@ func (s *EmailServer) registerPageHandler(w http.ResponseWriter, r *http.Request
 </body>
 </html>`))
 
-	tmpl.Execute(w, domains)
+	tmpl.Execute(w, struct {
+		Domains   []string
+		CSRFToken string
+	}{domains, s.csrfToken(w, r)})
+}
+
+// createUser inserts a user together with their default mailboxes, so a
+// failure part way leaves no account without an INBOX behind.
+func createUser(db *sql.DB, username, email, hashedPassword string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO users (username, email, password) VALUES (?, ?, ?)",
+		username, email, hashedPassword)
+	if err != nil {
+		return err
+	}
+	userID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if err := ensureDefaultMailboxes(tx, int(userID)); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (s *EmailServer) registerHandler(w http.ResponseWriter, r *http.Request) {
@@ -581,10 +834,7 @@ func (s *EmailServer) registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Insert user
-	_, err = s.db.Exec("INSERT INTO users (username, email, password) VALUES (?, ?, ?)",
-		username, email, string(hashedPassword))
-	if err != nil {
+	if err := createUser(s.db, username, email, string(hashedPassword)); err != nil {
 		w.Header().Set("Content-Type", "text/html")
 		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
 			fmt.Fprint(w, `<div class="bg-red-100 border border-red-400 text-red-700 px-4 py-3 rounded">Email address already exists. Please choose a different username.</div>`)
@@ -617,14 +867,25 @@ func (s *EmailServer) dashboardHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// User-created folders are listed under the built-in ones
+	var folders []*Mailbox
+	mailboxes, _ := listMailboxes(s.db, userID, false)
+	for _, m := range mailboxes {
+		if m.Name != "INBOX" && m.SpecialUse == "" {
+			folders = append(folders, m)
+		}
+	}
+
 	tmpl := template.Must(template.New("dashboard").Parse(`
 <!DOCTYPE html>
 <html lang="en">
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="csrf-token" content="{{.CSRFToken}}">
     <title>{{.Username}} - Email Server</title>
     <script src="https://unpkg.com/htmx.org@1.9.6"></script>
+    <script src="/static/csrf.js"></script>
     <link rel="stylesheet" href="/static/style.css">
     <link href="https://fonts.googleapis.com/css2?family=Google+Sans:wght@400;500;600&display=swap" rel="stylesheet">
     <link href="https://fonts.googleapis.com/icon?family=Material+Icons" rel="stylesheet">
@@ -645,13 +906,27 @@ func (s *EmailServer) dashboardHandler(w http.ResponseWriter, r *http.Request) {
                 <!-- Search Bar -->
                 <div class="search-container hidden-mobile">
                     <span class="material-icons search-icon">search</span>
-                    <input type="text" class="search-input" placeholder="Search mail" 
+                    <input type="text" name="q" class="search-input" placeholder="Search mail"
                            hx-get="/search" hx-target="#content" hx-trigger="keyup changed delay:300ms">
                 </div>
             </div>
             
             <div class="user-info">
                 <span class="hidden-mobile">{{.Email}}</span>
+                <a href="/sessions" class="btn btn-secondary" title="Active sessions">
+                    <span class="material-icons">devices</span>
+                    <span class="hidden-mobile">Sessions</span>
+                </a>
+                {{if .IsAdmin}}
+                <a href="/admin/dkim" class="btn btn-secondary" title="DKIM keys">
+                    <span class="material-icons">key</span>
+                    <span class="hidden-mobile">DKIM</span>
+                </a>
+                <a href="/admin/dmarc" class="btn btn-secondary" title="DMARC reports">
+                    <span class="material-icons">policy</span>
+                    <span class="hidden-mobile">DMARC</span>
+                </a>
+                {{end}}
                 <form hx-post="/logout" class="inline">
                     <button type="submit" class="btn btn-danger">
                         <span class="material-icons">logout</span>
@@ -696,6 +971,16 @@ func (s *EmailServer) dashboardHandler(w http.ResponseWriter, r *http.Request) {
                     <span class="material-icons">delete</span>
                     Trash
                 </a>
+                <a href="#" class="sidebar-item" hx-get="/emails?type=archive" hx-target="#content">
+                    <span class="material-icons">archive</span>
+                    Archive
+                </a>
+                {{range .Folders}}
+                <a href="#" class="sidebar-item" hx-get="/emails?mailbox={{.ID}}" hx-target="#content" title="{{.Name}}">
+                    <span class="material-icons">folder</span>
+                    {{.DisplayName}}
+                </a>
+                {{end}}
             </nav>
             
             <!-- Account Info -->
@@ -705,8 +990,12 @@ func (s *EmailServer) dashboardHandler(w http.ResponseWriter, r *http.Request) {
                         <span class="material-icons" style="vertical-align: middle; margin-right: 4px;">settings</span>
                         Email Client Setup
                     </h4>
-                    <p style="font-size: 12px; margin-bottom: 4px;"><strong>SMTP:</strong> localhost:2525</p>
-                    <p style="font-size: 12px; margin-bottom: 4px;"><strong>IMAP:</strong> localhost:1143</p>
+                    {{with .Setup}}
+                    {{if .Submission}}<p style="font-size: 12px; margin-bottom: 4px;"><strong>SMTP:</strong> {{.Host}}:{{.Submission}} (STARTTLS)</p>{{end}}
+                    {{if .SMTPS}}<p style="font-size: 12px; margin-bottom: 4px;"><strong>SMTPS:</strong> {{.Host}}:{{.SMTPS}}</p>{{end}}
+                    {{if .IMAP}}<p style="font-size: 12px; margin-bottom: 4px;"><strong>IMAP:</strong> {{.Host}}:{{.IMAP}} (STARTTLS)</p>{{end}}
+                    {{if .IMAPS}}<p style="font-size: 12px; margin-bottom: 4px;"><strong>IMAPS:</strong> {{.Host}}:{{.IMAPS}}</p>{{end}}
+                    {{end}}
                     <p style="font-size: 12px;"><strong>User:</strong> {{.Email}}</p>
                 </div>
             </div>
@@ -758,17 +1047,38 @@ func (s *EmailServer) dashboardHandler(w http.ResponseWriter, r *http.Request) {
             }
         });
         
-        // Auto-refresh emails every 30 seconds
-        setInterval(function() {
-            if (document.querySelector('.sidebar-item.active')?.textContent.includes('Inbox')) {
-                htmx.trigger('#content', 'refresh');
+        // Live updates: keep the unread count in the title and reload the
+        // list on screen when its folder changes. Aggregate views such as
+        // Starred and search results have no data-mailbox and reload on any
+        // change. A list with messages checked is left alone.
+        const baseTitle = document.title;
+        function onMailboxEvent(event) {
+            const data = JSON.parse(event.data);
+            document.title = data.unread > 0 ? '(' + data.unread + ') ' + baseTitle : baseTitle;
+
+            const list = document.querySelector('#content .email-list');
+            if (event.type === 'unread' || !list || list.querySelector('.email-checkbox:checked')) {
+                return;
+            }
+            if (!list.dataset.mailbox || list.dataset.mailbox == data.mailbox) {
+                htmx.ajax('GET', list.dataset.refresh, '#content');
             }
-        }, 30000);
+        }
+        const events = new EventSource('/events');
+        ['unread', 'new', 'flags', 'deleted'].forEach(function(name) {
+            events.addEventListener(name, onMailboxEvent);
+        });
     </script>
 </body>
 </html>`))
 
-	tmpl.Execute(w, user)
+	tmpl.Execute(w, struct {
+		User
+		Folders   []*Mailbox
+		IsAdmin   bool
+		Setup     clientSetup
+		CSRFToken string
+	}{user, folders, s.isAdmin(userID), s.clientSetup(), s.csrfToken(w, r)})
 }
 
 func (s *EmailServer) emailsHandler(w http.ResponseWriter, r *http.Request) {
@@ -777,10 +1087,43 @@ func (s *EmailServer) emailsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user User
-	s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&user.Email)
+	const columns = `SELECT e.id, e.message_id, e.from_email, e.to_email, e.date,
+		EXISTS (SELECT 1 FROM email_flags f WHERE f.email_id = e.id AND f.flag = '\Seen'),
+		EXISTS (SELECT 1 FROM email_flags f WHERE f.email_id = e.id AND f.flag = '\Flagged'),
+		m.raw
+		FROM emails e JOIN messages m ON m.id = e.message_id`
 
-	rows, err := s.db.Query("SELECT id, from_email, to_email, subject, body, date, read FROM emails WHERE to_email = ? ORDER BY date DESC", user.Email)
+	var title, icon, query string
+	var mailboxID int64
+	var junk bool
+	var rows *sql.Rows
+	var err error
+	if q := strings.TrimSpace(r.URL.Query().Get("q")); q != "" {
+		// Search covers every folder except Trash and Junk.
+		cond, args := webSearch(q)
+		title, icon, query = "Search results", "search", "?q="+url.QueryEscape(q)
+		rows, err = s.db.Query(columns+`
+			JOIN mailboxes mb ON mb.id = e.mailbox_id
+			WHERE mb.user_id = ? AND mb.special_use NOT IN (?, ?) AND `+cond+`
+			ORDER BY e.date DESC`, append([]interface{}{userID, imap.TrashAttr, imap.JunkAttr}, args...)...)
+	} else if r.URL.Query().Get("type") == "starred" {
+		// Starred collects \Flagged messages from every folder.
+		title, icon, query = "Starred", "star", "?type=starred"
+		rows, err = s.db.Query(columns+`
+			JOIN mailboxes mb ON mb.id = e.mailbox_id
+			WHERE mb.user_id = ? AND EXISTS (SELECT 1 FROM email_flags f WHERE f.email_id = e.id AND f.flag = '\Flagged')
+			ORDER BY e.date DESC`, userID)
+	} else {
+		var folder *Mailbox
+		folder, title, err = s.folderForRequest(userID, r)
+		if err != nil {
+			fmt.Fprint(w, "Folder not found")
+			return
+		}
+		icon, query, mailboxID = folderIcon(folder), fmt.Sprintf("?mailbox=%d", folder.ID), folder.ID
+		junk = folder.SpecialUse == imap.JunkAttr
+		rows, err = s.db.Query(columns+" WHERE e.mailbox_id = ? ORDER BY e.date DESC", folder.ID)
+	}
 	if err != nil {
 		fmt.Fprint(w, "Error loading emails")
 		return
@@ -790,33 +1133,57 @@ func (s *EmailServer) emailsHandler(w http.ResponseWriter, r *http.Request) {
 	var emails []Email
 	for rows.Next() {
 		var email Email
-		rows.Scan(&email.ID, &email.From, &email.To, &email.Subject, &email.Body, &email.Date, &email.Read)
+		var messageID int64
+		var raw []byte
+		rows.Scan(&email.ID, &messageID, &email.From, &email.To, &email.Date, &email.Read, &email.Starred, &raw)
+		if msg, err := newStoredMessage(messageID, raw); err == nil {
+			msg.fillEmail(&email)
+		}
 		emails = append(emails, email)
 	}
 
 	tmpl := template.Must(template.New("emails").Parse(`
-<div class="email-list">
+<div class="email-list" data-mailbox="{{if .MailboxID}}{{.MailboxID}}{{end}}" data-refresh="/emails{{.Query}}">
     <div style="display: flex; align-items: center; justify-content: space-between; padding: 16px 20px; border-bottom: 1px solid var(--border-color); background: var(--background-light);">
         <h2 style="font-size: 20px; font-weight: 500; margin: 0; display: flex; align-items: center; gap: 8px;">
-            <span class="material-icons">inbox</span>
-            Inbox
+            <span class="material-icons">{{.Icon}}</span>
+            {{.Title}}
         </h2>
         <div style="display: flex; gap: 8px;">
+            <button class="btn btn-secondary" style="padding: 6px 12px; font-size: 12px;"
+                    hx-post="/emails/delete{{.Query}}" hx-include=".email-checkbox:checked" hx-target="#content">
+                <span class="material-icons" style="font-size: 16px;">delete</span>
+                Delete
+            </button>
+            {{if .Junk}}
+            <button class="btn btn-secondary" style="padding: 6px 12px; font-size: 12px;"
+                    hx-post="/emails/not-spam{{.Query}}" hx-include=".email-checkbox:checked" hx-target="#content">
+                <span class="material-icons" style="font-size: 16px;">report_off</span>
+                Not spam
+            </button>
+            {{else}}
+            <button class="btn btn-secondary" style="padding: 6px 12px; font-size: 12px;"
+                    hx-post="/emails/spam{{.Query}}" hx-include=".email-checkbox:checked" hx-target="#content">
+                <span class="material-icons" style="font-size: 16px;">report</span>
+                Mark as spam
+            </button>
+            {{end}}
             <button class="btn btn-secondary" style="padding: 6px 12px; font-size: 12px;" 
-                    hx-get="/emails" hx-target="#content">
+                    hx-get="/emails{{.Query}}" hx-target="#content">
                 <span class="material-icons" style="font-size: 16px;">refresh</span>
                 Refresh
             </button>
         </div>
     </div>
     
-    {{range .}}
+    {{range .Emails}}
     <div class="email-item {{if not .Read}}unread{{end}}" 
          hx-get="/email/{{.ID}}" hx-target="#content">
         
-        <input type="checkbox" class="email-checkbox">
+        <input type="checkbox" class="email-checkbox" name="id" value="{{.ID}}">
         
-        <span class="email-star material-icons">star_border</span>
+        <span class="email-star material-icons {{if .Starred}}starred{{end}}"
+              hx-post="/email/{{.ID}}/star" hx-swap="outerHTML" onclick="event.stopPropagation()">{{if .Starred}}star{{else}}star_border{{end}}</span>
         
         <div class="email-content">
             <div class="email-header">
@@ -835,7 +1202,7 @@ func (s *EmailServer) emailsHandler(w http.ResponseWriter, r *http.Request) {
         <div style="font-size: 48px; margin-bottom: 16px; color: var(--border-color);">
             <span class="material-icons" style="font-size: inherit;">inbox</span>
         </div>
-        <h3 style="font-weight: 500; margin-bottom: 8px;">Your inbox is empty</h3>
+        <h3 style="font-weight: 500; margin-bottom: 8px;">{{if eq .Title "Inbox"}}Your inbox is empty{{else}}{{.Title}} is empty{{end}}</h3>
         <p style="font-size: 14px;">No emails found. Send yourself a test email to get started!</p>
         <a href="/compose" class="btn btn-primary" style="margin-top: 16px;">
             <span class="material-icons">edit</span>
@@ -847,14 +1214,6 @@ func (s *EmailServer) emailsHandler(w http.ResponseWriter, r *http.Request) {
 
 <script>
     // Add click handlers for email actions
-    document.querySelectorAll('.email-star').forEach(star => {
-        star.addEventListener('click', function(e) {
-            e.stopPropagation();
-            this.textContent = this.textContent === 'star_border' ? 'star' : 'star_border';
-            this.classList.toggle('starred');
-        });
-    });
-    
     document.querySelectorAll('.email-checkbox').forEach(checkbox => {
         checkbox.addEventListener('click', function(e) {
             e.stopPropagation();
@@ -862,7 +1221,154 @@ func (s *EmailServer) emailsHandler(w http.ResponseWriter, r *http.Request) {
     });
 </script>`))
 
-	tmpl.Execute(w, emails)
+	tmpl.Execute(w, struct {
+		Title     string
+		Icon      string
+		Query     string
+		MailboxID int64
+		Junk      bool
+		Emails    []Email
+	}{title, icon, query, mailboxID, junk, emails})
+}
+
+// deleteEmailsHandler moves the selected emails to Trash, or deletes them
+// for good when they are already there, and then shows the folder again.
+func (s *EmailServer) deleteEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserID(r)
+	if userID == 0 {
+		return
+	}
+
+	if err := s.trashEmails(userID, formEmailIDs(r)); err != nil {
+		fmt.Fprint(w, "Error deleting emails")
+		return
+	}
+
+	s.emailsHandler(w, r)
+}
+
+// markSpamHandler moves the selected emails to Junk and trains the user's
+// spam filter on them.
+func (s *EmailServer) markSpamHandler(w http.ResponseWriter, r *http.Request) {
+	s.reportSpamHandler(w, r, true)
+}
+
+// notSpamHandler moves the selected emails from Junk to the inbox and
+// trains the user's spam filter on them.
+func (s *EmailServer) notSpamHandler(w http.ResponseWriter, r *http.Request) {
+	s.reportSpamHandler(w, r, false)
+}
+
+func (s *EmailServer) reportSpamHandler(w http.ResponseWriter, r *http.Request, spam bool) {
+	userID := s.getUserID(r)
+	if userID == 0 {
+		return
+	}
+
+	if err := s.reportSpam(userID, formEmailIDs(r), spam); err != nil {
+		fmt.Fprint(w, "Error updating emails")
+		return
+	}
+
+	s.emailsHandler(w, r)
+}
+
+// formEmailIDs returns the email IDs posted as id fields.
+func formEmailIDs(r *http.Request) []int64 {
+	r.ParseForm()
+	var ids []int64
+	for _, value := range r.PostForm["id"] {
+		if id, err := strconv.ParseInt(value, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// starHandler toggles \Flagged on an email and returns the updated star.
+func (s *EmailServer) starHandler(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserID(r)
+	if userID == 0 {
+		return
+	}
+
+	emailID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	var count int
+	s.db.QueryRow(`SELECT COUNT(*) FROM emails e JOIN mailboxes mb ON mb.id = e.mailbox_id
+		WHERE e.id = ? AND mb.user_id = ?`, emailID, userID).Scan(&count)
+	if count == 0 {
+		http.Error(w, "Email not found", http.StatusNotFound)
+		return
+	}
+
+	starred := !hasFlag(s.db, emailID, imap.FlaggedFlag)
+	if err := setFlag(s.db, emailID, imap.FlaggedFlag, starred); err != nil {
+		http.Error(w, "Error updating email", http.StatusInternalServerError)
+		return
+	}
+	s.events.EmailFlagsChanged(emailID)
+
+	class, icon := "", "star_border"
+	if starred {
+		class, icon = " starred", "star"
+	}
+	fmt.Fprintf(w, `<span class="email-star material-icons%s" hx-post="/email/%d/star" hx-swap="outerHTML" onclick="event.stopPropagation()">%s</span>`,
+		class, emailID, icon)
+}
+
+// folderTypes maps the sidebar's ?type= values to special-use mailboxes.
+var folderTypes = map[string]string{
+	"":        "",
+	"inbox":   "",
+	"sent":    imap.SentAttr,
+	"drafts":  imap.DraftsAttr,
+	"spam":    imap.JunkAttr,
+	"trash":   imap.TrashAttr,
+	"archive": imap.ArchiveAttr,
+}
+
+// folderForRequest resolves the mailbox a list request refers to, either by
+// ?mailbox=<id> or by ?type=<sidebar entry>, along with its display title.
+func (s *EmailServer) folderForRequest(userID int, r *http.Request) (*Mailbox, string, error) {
+	var folder *Mailbox
+	var err error
+	if id, convErr := strconv.ParseInt(r.URL.Query().Get("mailbox"), 10, 64); convErr == nil {
+		folder, err = getMailboxByID(s.db, userID, id)
+	} else {
+		specialUse, ok := folderTypes[r.URL.Query().Get("type")]
+		if !ok {
+			return nil, "", backend.ErrNoSuchMailbox
+		}
+		folder, err = getSpecialMailbox(s.db, userID, specialUse)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	title := folder.DisplayName()
+	if folder.Name == "INBOX" {
+		title = "Inbox"
+	}
+	return folder, title, nil
+}
+
+func folderIcon(m *Mailbox) string {
+	switch m.SpecialUse {
+	case imap.SentAttr:
+		return "send"
+	case imap.DraftsAttr:
+		return "drafts"
+	case imap.JunkAttr:
+		return "report"
+	case imap.TrashAttr:
+		return "delete"
+	case imap.ArchiveAttr:
+		return "archive"
+	}
+	if m.Name == "INBOX" {
+		return "inbox"
+	}
+	return "folder"
 }
 
 func (s *EmailServer) emailDetailHandler(w http.ResponseWriter, r *http.Request) {
@@ -874,37 +1380,148 @@ func (s *EmailServer) emailDetailHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var user User
-	s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&user.Email)
-
+	// The message belongs to whoever owns its mailbox, whatever its
+	// envelope says
 	var email Email
-	err := s.db.QueryRow("SELECT id, from_email, to_email, subject, body, date FROM emails WHERE id = ? AND to_email = ?",
-		emailID, user.Email).Scan(&email.ID, &email.From, &email.To, &email.Subject, &email.Body, &email.Date)
+	var messageID int64
+	err := s.db.QueryRow(`SELECT e.id, e.message_id, e.from_email, e.to_email, e.date, e.mailbox_id
+		FROM emails e JOIN mailboxes mb ON mb.id = e.mailbox_id
+		WHERE e.id = ? AND mb.user_id = ?`,
+		emailID, userID).Scan(&email.ID, &messageID, &email.From, &email.To, &email.Date, &email.MailboxID)
+	if err != nil {
+		fmt.Fprint(w, "Email not found")
+		return
+	}
+
+	msg, err := loadMessage(s.db, messageID)
 	if err != nil {
 		fmt.Fprint(w, "Email not found")
 		return
 	}
+	msg.fillEmail(&email)
+	email.Attachments, _ = listAttachments(s.db, messageID)
+	email.Auth, _ = loadMessageAuth(s.db, messageID)
 
 	// Mark as read
-	s.db.Exec("UPDATE emails SET read = TRUE WHERE id = ?", emailID)
+	if !hasFlag(s.db, int64(email.ID), imap.SeenFlag) {
+		if err := setFlag(s.db, int64(email.ID), imap.SeenFlag, true); err == nil {
+			s.events.EmailFlagsChanged(int64(email.ID))
+		}
+	}
 
 	tmpl := template.Must(template.New("email").Parse(`
 <div class="border-b pb-4 mb-4">
-    <button hx-get="/emails" hx-target="#content" class="text-blue-500 hover:text-blue-600 mb-2">
-        ← Back to Emails
-    </button>
+    <div style="display: flex; justify-content: space-between; align-items: center;">
+        <button hx-get="/emails?mailbox={{.MailboxID}}" hx-target="#content" class="text-blue-500 hover:text-blue-600 mb-2">
+            ← Back to Emails
+        </button>
+        <div style="display: flex; gap: 8px;">
+            {{if .Junk}}
+            <button class="btn btn-secondary" style="padding: 6px 12px; font-size: 12px;"
+                    hx-post="/emails/not-spam?mailbox={{.MailboxID}}" hx-vals='{"id": "{{.ID}}"}' hx-target="#content">
+                <span class="material-icons" style="font-size: 16px;">report_off</span>
+                Not spam
+            </button>
+            {{else}}
+            <button class="btn btn-secondary" style="padding: 6px 12px; font-size: 12px;"
+                    hx-post="/emails/spam?mailbox={{.MailboxID}}" hx-vals='{"id": "{{.ID}}"}' hx-target="#content">
+                <span class="material-icons" style="font-size: 16px;">report</span>
+                Mark as spam
+            </button>
+            {{end}}
+            <button class="btn btn-secondary" style="padding: 6px 12px; font-size: 12px;"
+                    hx-post="/emails/delete?mailbox={{.MailboxID}}" hx-vals='{"id": "{{.ID}}"}' hx-target="#content">
+                <span class="material-icons" style="font-size: 16px;">delete</span>
+                Delete
+            </button>
+        </div>
+    </div>
     <h2 class="text-xl font-bold">{{.Subject}}</h2>
     <div class="text-sm text-gray-600 mt-2">
         <strong>From:</strong> {{.From}}<br>
         <strong>To:</strong> {{.To}}<br>
+        {{if .Cc}}<strong>Cc:</strong> {{.Cc}}<br>{{end}}
+        {{if .ReplyTo}}<strong>Reply-To:</strong> {{.ReplyTo}}<br>{{end}}
         <strong>Date:</strong> {{.Date}}
+        {{if .MessageID}}<br><strong>Message-ID:</strong> {{.MessageID}}{{end}}
+        {{with .Auth}}
+        <div style="margin-top: 6px; display: flex; align-items: center; gap: 6px;">
+            {{if .Passed}}
+            <span class="bg-green-100 text-green-800 px-2 py-1 rounded" style="display: inline-flex; align-items: center; gap: 4px; font-size: 12px;">
+                <span class="material-icons" style="font-size: 14px;">verified_user</span> Verified sender: {{.HeaderFrom}}
+            </span>
+            {{else if .Failed}}
+            <span class="bg-red-100 text-red-800 px-2 py-1 rounded" style="display: inline-flex; align-items: center; gap: 4px; font-size: 12px;">
+                <span class="material-icons" style="font-size: 14px;">gpp_bad</span> Failed authentication: may not be from {{.HeaderFrom}}
+            </span>
+            {{else}}
+            <span class="bg-gray-100 text-gray-700 px-2 py-1 rounded" style="display: inline-flex; align-items: center; gap: 4px; font-size: 12px;">
+                <span class="material-icons" style="font-size: 14px;">help_outline</span> Sender not verified
+            </span>
+            {{end}}
+            <span class="text-gray-500" style="font-size: 12px;">SPF {{.SPF}} · DKIM {{.DKIM}} · DMARC {{.DMARC}}</span>
+        </div>
+        {{end}}
     </div>
 </div>
 <div class="prose max-w-none">
     <div class="whitespace-pre-wrap">{{.Body}}</div>
-</div>`))
+</div>
+{{if .Attachments}}
+<div class="border-t pt-4 mt-4">
+    <h3 style="font-size: 14px; font-weight: 500; margin-bottom: 8px; display: flex; align-items: center; gap: 4px;">
+        <span class="material-icons" style="font-size: 18px;">attach_file</span>
+        {{len .Attachments}} attachment{{if gt (len .Attachments) 1}}s{{end}}
+    </h3>
+    <div style="display: flex; flex-wrap: wrap; gap: 8px;">
+        {{$emailID := .ID}}
+        {{range .Attachments}}
+        <a href="/email/{{$emailID}}/attachments/{{.ID}}" class="btn btn-secondary" style="padding: 6px 12px; font-size: 12px;" download>
+            <span class="material-icons" style="font-size: 16px;">download</span>
+            {{.Filename}} ({{.Size}} bytes)
+        </a>
+        {{end}}
+    </div>
+</div>
+{{end}}`))
+
+	junk := false
+	if folder, err := getMailboxByID(s.db, userID, email.MailboxID); err == nil {
+		junk = folder.SpecialUse == imap.JunkAttr
+	}
+	tmpl.Execute(w, struct {
+		Email
+		Junk bool
+	}{email, junk})
+}
+
+func (s *EmailServer) attachmentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	userID := s.getUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
-	tmpl.Execute(w, email)
+	var filename, contentType string
+	var data []byte
+	err := s.db.QueryRow(`SELECT a.filename, a.content_type, b.data
+		FROM attachments a
+		JOIN blobs b ON b.hash = a.blob_hash
+		JOIN emails e ON e.message_id = a.message_id
+		JOIN mailboxes mb ON mb.id = e.mailbox_id
+		WHERE a.id = ? AND e.id = ? AND mb.user_id = ?`,
+		vars["aid"], vars["id"], userID).Scan(&filename, &contentType, &data)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Write(data)
 }
 
 func (s *EmailServer) composePageHandler(w http.ResponseWriter, r *http.Request) {
@@ -923,8 +1540,10 @@ func (s *EmailServer) composePageHandler(w http.ResponseWriter, r *http.Request)
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="csrf-token" content="{{.CSRFToken}}">
     <title>Compose - Email Server</title>
     <script src="https://unpkg.com/htmx.org@1.9.6"></script>
+    <script src="/static/csrf.js"></script>
     <link rel="stylesheet" href="/static/style.css">
     <link href="https://fonts.googleapis.com/css2?family=Google+Sans:wght@400;500;600&display=swap" rel="stylesheet">
     <link href="https://fonts.googleapis.com/icon?family=Material+Icons" rel="stylesheet">
@@ -1076,7 +1695,10 @@ func (s *EmailServer) composePageHandler(w http.ResponseWriter, r *http.Request)
 </body>
 </html>`))
 
-	tmpl.Execute(w, struct{ Email string }{Email: user.Email})
+	tmpl.Execute(w, struct {
+		Email     string
+		CSRFToken string
+	}{user.Email, s.csrfToken(w, r)})
 }
 
 func (s *EmailServer) sendEmailHandler(w http.ResponseWriter, r *http.Request) {
@@ -1088,13 +1710,47 @@ func (s *EmailServer) sendEmailHandler(w http.ResponseWriter, r *http.Request) {
 	var user User
 	s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&user.Email)
 
-	to := r.FormValue("to")
 	subject := r.FormValue("subject")
 	body := r.FormValue("body")
 
-	// Store email in database
-	_, err := s.db.Exec("INSERT INTO emails (from_email, to_email, subject, body) VALUES (?, ?, ?, ?)",
-		user.Email, to, subject, body)
+	// Only parsed addresses go into the header and to delivery, so the
+	// field can't smuggle in other headers or recipients
+	addrs, err := mail.ParseAddressList(r.FormValue("to"))
+	if err != nil {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<div class="alert alert-error">
+			<span class="material-icons" style="vertical-align: middle; margin-right: 8px;">error</span>
+			Invalid recipient address.
+		</div>`)
+		return
+	}
+	// Local recipients need an account, as on the submission port
+	to := make([]string, len(addrs))
+	for i, addr := range addrs {
+		if to[i], err = s.delivery.Recipient(addr.Address); err != nil {
+			w.Header().Set("Content-Type", "text/html")
+			message := "Error sending email. Please try again."
+			if err == errNoAccount {
+				message = "There is no account for " + addr.Address + "."
+			}
+			fmt.Fprintf(w, `<div class="alert alert-error">
+			<span class="material-icons" style="vertical-align: middle; margin-right: 8px;">error</span>
+			%s
+		</div>`, template.HTMLEscapeString(message))
+			return
+		}
+	}
+
+	// Store email in database. The From header is checked as on the
+	// submission port before the message is signed for its domain
+	raw := composeMessage(user.Email, to, subject, body, time.Now())
+	err = checkHeaderFrom(s.db, userID, raw)
+	if err == nil {
+		raw, err = s.dkim.Sign(raw)
+	}
+	if err == nil {
+		err = s.delivery.Send(userID, user.Email, to, raw)
+	}
 	if err != nil {
 		w.Header().Set("Content-Type", "text/html")
 		fmt.Fprint(w, `<div class="alert alert-error">
@@ -1113,25 +1769,11 @@ func (s *EmailServer) sendEmailHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *EmailServer) logoutHandler(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:   "user_id",
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	})
-	w.Header().Set("HX-Redirect", "/")
-}
-
-func (s *EmailServer) getUserID(r *http.Request) int {
-	cookie, err := r.Cookie("user_id")
-	if err != nil {
-		return 0
-	}
-	userID, err := strconv.Atoi(cookie.Value)
-	if err != nil {
-		return 0
+	if sessionID, _ := s.currentSession(r); sessionID != 0 {
+		s.db.Exec("DELETE FROM sessions WHERE id = ?", sessionID)
 	}
-	return userID
+	http.SetCookie(w, s.sessionCookie(r, "", time.Time{}))
+	w.Header().Set("HX-Redirect", "/")
 }
 
 // Helper function to get available domains
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestDB returns a fresh database with every table created.
+func newTestDB(t *testing.T) *sql.DB {
+	return newTestEmailServer(t).db
+}
+
+// newTestEmailServer returns a server on a fresh database, with delivery
+// and signing set up but no listeners.
+func newTestEmailServer(t *testing.T) *EmailServer {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db")+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	s := &EmailServer{db: db, domains: []string{"localhost.com"}, config: defaultConfig()}
+	if err := s.createTables(); err != nil {
+		t.Fatal(err)
+	}
+	s.events = NewEventBus(db)
+	s.outbound = NewOutboundQueue(db, "localhost.com", s.config.Outbound, nil)
+	s.delivery = NewDelivery(db, s.domains, s.outbound, s.events)
+	s.dkim = NewDKIMSigner(db)
+	return s
+}
+
+// signIn adds a session cookie for the user to r.
+func signIn(t *testing.T, s *EmailServer, r *http.Request, userID int) {
+	rec := httptest.NewRecorder()
+	if err := s.startSession(rec, r, userID); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		r.AddCookie(cookie)
+	}
+}
+
+// newTestUser registers a user and returns their ID.
+func newTestUser(t *testing.T, db *sql.DB, email string) int {
+	if err := createUser(db, email, email, "x"); err != nil {
+		t.Fatal(err)
+	}
+	var id int
+	if err := db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestHomeShowsSubmissionPorts(t *testing.T) {
+	s := &EmailServer{domains: []string{"localhost.com"}, config: defaultConfig()}
+	rec := httptest.NewRecorder()
+	s.homeHandler(rec, httptest.NewRequest("GET", "/", nil))
+
+	body := rec.Body.String()
+	for _, want := range []string{"Port: 587 (STARTTLS)", "Port: 465 (SSL/TLS)", "Port: 993 (SSL/TLS)"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("home page does not show %q", want)
+		}
+	}
+	if strings.Contains(body, "2525") {
+		t.Error("home page points clients at the MX port")
+	}
+}
+
+func TestEmailDetailChecksMailboxOwner(t *testing.T) {
+	s := newTestEmailServer(t)
+	bob := newTestUser(t, s.db, "bob@localhost.com")
+	alice := newTestUser(t, s.db, "alice@localhost.com")
+
+	raw := []byte("From: bob@localhost.com\r\nTo: carol@example.org\r\nSubject: Minutes\r\n" +
+		"MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+		"--b\r\nContent-Type: text/plain\r\nContent-Disposition: attachment; filename=minutes.txt\r\n\r\nitem one\r\n--b--\r\n")
+	if err := s.delivery.Send(bob, "bob@localhost.com", []string{"carol@example.org"}, raw); err != nil {
+		t.Fatal(err)
+	}
+	var emailID, attachmentID string
+	err := s.db.QueryRow(`SELECT e.id, a.id FROM emails e JOIN attachments a ON a.message_id = e.message_id`).
+		Scan(&emailID, &attachmentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		userID int
+		found  bool
+	}{
+		{"sender's Sent copy", bob, true},
+		{"someone else", alice, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/email/"+emailID, nil)
+			signIn(t, s, req, tt.userID)
+			rec := httptest.NewRecorder()
+			s.emailDetailHandler(rec, mux.SetURLVars(req, map[string]string{"id": emailID}))
+			if found := strings.Contains(rec.Body.String(), "Minutes"); found != tt.found {
+				t.Errorf("message shown: %v, want %v", found, tt.found)
+			}
+
+			req = httptest.NewRequest("GET", "/email/"+emailID+"/attachments/"+attachmentID, nil)
+			signIn(t, s, req, tt.userID)
+			rec = httptest.NewRecorder()
+			s.attachmentHandler(rec, mux.SetURLVars(req, map[string]string{"id": emailID, "aid": attachmentID}))
+			if found := rec.Code == http.StatusOK; found != tt.found {
+				t.Errorf("attachment status %d, want found %v", rec.Code, tt.found)
+			}
+		})
+	}
+}
+
+func TestSendEmailChecksLocalRecipients(t *testing.T) {
+	s := newTestEmailServer(t)
+	bob := newTestUser(t, s.db, "bob@localhost.com")
+	alice := newTestUser(t, s.db, "alice@localhost.com")
+
+	tests := []struct {
+		name    string
+		to      string
+		sent    bool
+		inboxTo string
+	}{
+		{"mixed case", "Alice <Alice@LocalHost.com>", true, "alice@localhost.com"},
+		{"no account", "ghost@localhost.com", false, ""},
+		{"one without an account", "alice@localhost.com, ghost@localhost.com", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.db.Exec("DELETE FROM emails")
+
+			form := url.Values{"to": {tt.to}, "subject": {"hi"}, "body": {"hello"}}
+			req := httptest.NewRequest("POST", "/send", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			signIn(t, s, req, bob)
+			rec := httptest.NewRecorder()
+			s.sendEmailHandler(rec, req)
+
+			if sent := strings.Contains(rec.Body.String(), "sent successfully"); sent != tt.sent {
+				t.Fatalf("sent: %v, want %v: %s", sent, tt.sent, rec.Body.String())
+			}
+			var orphans int
+			s.db.QueryRow("SELECT COUNT(*) FROM emails WHERE mailbox_id IS NULL").Scan(&orphans)
+			if orphans != 0 {
+				t.Errorf("%d messages filed in no mailbox", orphans)
+			}
+			var to string
+			s.db.QueryRow(`SELECT e.to_email FROM emails e JOIN mailboxes mb ON mb.id = e.mailbox_id
+				WHERE mb.user_id = ? AND mb.name = 'INBOX'`, alice).Scan(&to)
+			if to != tt.inboxTo {
+				t.Errorf("alice's INBOX has mail to %q, want %q", to, tt.inboxTo)
+			}
+		})
+	}
+}
+
+// TestCollectDeliveredMessage deletes a message whose outbound delivery has
+// finished, which the enforced foreign key from outbound_queue must allow.
+func TestCollectDeliveredMessage(t *testing.T) {
+	db := newTestDB(t)
+	newTestUser(t, db, "bob@localhost.com")
+
+	var enforced bool
+	if err := db.QueryRow("PRAGMA foreign_keys").Scan(&enforced); err != nil || !enforced {
+		t.Fatalf("foreign keys not enforced: %v", err)
+	}
+
+	raw := []byte("From: bob@localhost.com\r\nTo: x@remote.example\r\nSubject: hi\r\n\r\nhello\r\n")
+	messageID, err := storeMessage(db, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emailID, err := fileInInbox(db, messageID, "bob@localhost.com", "bob@localhost.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`INSERT INTO outbound_queue (message_id, sender, recipient, domain, status, next_attempt, created)
+		VALUES (?, 'bob@localhost.com', 'x@remote.example', 'remote.example', 'sent', datetime('now'), datetime('now'))`, messageID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mailboxID int64
+	db.QueryRow("SELECT mailbox_id FROM emails WHERE id = ?", emailID).Scan(&mailboxID)
+	if _, err := removeEmails(db, mailboxID, []int64{emailID}); err != nil {
+		t.Fatal(err)
+	}
+	var left int
+	db.QueryRow("SELECT COUNT(*) FROM messages WHERE id = ?", messageID).Scan(&left)
+	if left != 0 {
+		t.Error("message not collected")
+	}
+}
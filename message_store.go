@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-message/textproto"
+)
+
+// StoredMessage is a message exactly as it was received, together with its
+// parsed header. Mailbox entries in the emails table point at one of these.
+type StoredMessage struct {
+	ID     int64
+	Raw    []byte
+	Header textproto.Header
+	Body   []byte // everything after the header block, still encoded
+}
+
+var wordDecoder = &mime.WordDecoder{}
+
+func (s *EmailServer) createMessageTables() error {
+	messageTable := `
+	CREATE TABLE IF NOT EXISTS messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		raw BLOB NOT NULL,
+		size INTEGER NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	headerTable := `
+	CREATE TABLE IF NOT EXISTS message_headers (
+		message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (message_id, position)
+	);
+	CREATE INDEX IF NOT EXISTS idx_message_headers_name ON message_headers(name, value);`
+
+	if _, err := s.db.Exec(messageTable); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(headerTable); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrateLegacyEmails converts an emails table from the old layout, which
+// kept only a subject and body per row, into rows that reference a stored
+// message. The original text is wrapped into a minimal RFC 5322 message.
+func (s *EmailServer) migrateLegacyEmails() error {
+	hasBody, err := tableHasColumn(s.db, "emails", "body")
+	if err != nil || !hasBody {
+		return err
+	}
+
+	log.Println("Migrating emails table to stored messages")
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("ALTER TABLE emails RENAME TO emails_legacy"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(emailTableSchema); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT id, from_email, to_email, subject, body, date, read FROM emails_legacy ORDER BY id")
+	if err != nil {
+		return err
+	}
+
+	type legacyEmail struct {
+		id                      int64
+		from, to, subject, body string
+		date                    string
+		read                    bool
+	}
+	var legacy []legacyEmail
+	for rows.Next() {
+		var e legacyEmail
+		if err := rows.Scan(&e.id, &e.from, &e.to, &e.subject, &e.body, &e.date, &e.read); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, e := range legacy {
+		date := parseTimestamp(e.date)
+		raw := composeMessage(e.from, []string{e.to}, e.subject, e.body, date)
+		messageID, err := storeMessage(tx, raw)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO emails (id, message_id, from_email, to_email, date, read) VALUES (?, ?, ?, ?, ?, ?)",
+			e.id, messageID, e.from, e.to, date.UTC().Format(sqliteTimeLayout), e.read)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DROP TABLE emails_legacy"); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func tableHasColumn(db execer, table, column string) (bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+func addColumnIfMissing(db execer, table, column, decl string) error {
+	found, err := tableHasColumn(db, table, column)
+	if err != nil || found {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + decl)
+	return err
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// storeMessage saves the raw bytes of a message and indexes its header
+// fields. It returns the id of the new messages row.
+func storeMessage(db execer, raw []byte) (int64, error) {
+	header, _, err := parseMessage(raw)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := db.Exec("INSERT INTO messages (raw, size) VALUES (?, ?)", raw, len(raw))
+	if err != nil {
+		return 0, err
+	}
+	messageID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	position := 0
+	fields := header.Fields()
+	for fields.Next() {
+		value, err := wordDecoder.DecodeHeader(fields.Value())
+		if err != nil {
+			value = fields.Value()
+		}
+		_, err = db.Exec("INSERT INTO message_headers (message_id, position, name, value) VALUES (?, ?, ?, ?)",
+			messageID, position, strings.ToLower(fields.Key()), value)
+		if err != nil {
+			return 0, err
+		}
+		position++
+	}
+
+	msg, err := newStoredMessage(messageID, raw)
+	if err != nil {
+		return 0, err
+	}
+	content, err := msg.MIME()
+	if err != nil {
+		// Keep a message with a broken MIME structure rather than refuse
+		// it: it is stored without attachments, and its body is indexed
+		// undecoded, as it is displayed
+		log.Printf("Storing message %d without attachments: %v", messageID, err)
+		content = &MIMEContent{Text: string(msg.Body)}
+		if _, err := db.Exec("UPDATE messages SET mime_parsed = TRUE WHERE id = ?", messageID); err != nil {
+			return 0, err
+		}
+	} else if err := storeAttachments(db, msg, content); err != nil {
+		return 0, err
+	}
+	if err := indexMessage(db, msg, content); err != nil {
+		return 0, err
+	}
+
+	return messageID, nil
+}
+
+// fileMessage adds a copy of a stored message to a mailbox under the next
+// free UID. owner is the address of the mailbox's user.
+func fileMessage(db execer, messageID int64, from, owner string, mailboxID int64) error {
+	_, _, err := addToMailbox(db, messageID, from, owner, mailboxID, time.Now())
+	return err
+}
+
+// addToMailbox is fileMessage with an explicit internal date. It returns
+// the new email's id and UID.
+func addToMailbox(db execer, messageID int64, from, owner string, mailboxID int64, date time.Time) (int64, uint32, error) {
+	uid, err := allocateUID(db, mailboxID)
+	if err != nil {
+		return 0, 0, err
+	}
+	res, err := db.Exec("INSERT INTO emails (message_id, from_email, to_email, mailbox_id, uid, date) VALUES (?, ?, ?, ?, ?, ?)",
+		messageID, from, owner, mailboxID, uid, date.UTC().Format(sqliteTimeLayout))
+	if err != nil {
+		return 0, 0, err
+	}
+	emailID, err := res.LastInsertId()
+	return emailID, uid, err
+}
+
+// fileInInbox delivers a stored message to the INBOX of the user that owns
+// the address and returns the mailbox's id. An address without an account
+// gets errNoAccount; callers check recipients with Delivery.Recipient first.
+func fileInInbox(db execer, messageID int64, from, to string) (int64, error) {
+	var mailboxID int64
+	err := db.QueryRow(`SELECT m.id FROM mailboxes m JOIN users u ON u.id = m.user_id
+		WHERE u.email = lower(?) AND m.name = 'INBOX'`, to).Scan(&mailboxID)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("delivering to %s: %w", to, errNoAccount)
+	} else if err != nil {
+		return 0, err
+	}
+	return mailboxID, fileMessage(db, messageID, from, to, mailboxID)
+}
+
+// fileInJunk files a copy in the Junk mailbox of the local user to, or in
+// their inbox if they have no Junk mailbox.
+func fileInJunk(db execer, messageID int64, from, to string) (int64, error) {
+	var userID int
+	err := db.QueryRow("SELECT id FROM users WHERE email = lower(?)", to).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return fileInInbox(db, messageID, from, to)
+	} else if err != nil {
+		return 0, err
+	}
+
+	junk, err := getSpecialMailbox(db, userID, imap.JunkAttr)
+	if err == backend.ErrNoSuchMailbox {
+		return fileInInbox(db, messageID, from, to)
+	} else if err != nil {
+		return 0, err
+	}
+	return junk.ID, fileMessage(db, messageID, from, to, junk.ID)
+}
+
+// loadMessage reads a stored message and parses its header.
+func loadMessage(db execer, messageID int64) (*StoredMessage, error) {
+	var raw []byte
+	if err := db.QueryRow("SELECT raw FROM messages WHERE id = ?", messageID).Scan(&raw); err != nil {
+		return nil, err
+	}
+	return newStoredMessage(messageID, raw)
+}
+
+func newStoredMessage(id int64, raw []byte) (*StoredMessage, error) {
+	header, body, err := parseMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &StoredMessage{ID: id, Raw: raw, Header: header, Body: body}, nil
+}
+
+func parseMessage(raw []byte) (textproto.Header, []byte, error) {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return textproto.Header{}, nil, fmt.Errorf("malformed message header: %v", err)
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	return header, body, nil
+}
+
+// HeaderText returns the named header field with any RFC 2047 encoded words
+// decoded.
+func (m *StoredMessage) HeaderText(name string) string {
+	value := m.Header.Get(name)
+	if decoded, err := wordDecoder.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// Date returns the parsed Date header, or the zero time if it is missing.
+func (m *StoredMessage) Date() time.Time {
+	date, err := mail.ParseDate(m.Header.Get("Date"))
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+// fillEmail copies the display fields of a stored message into e.
+func (m *StoredMessage) fillEmail(e *Email) {
+	e.Subject = m.HeaderText("Subject")
+	e.Cc = m.HeaderText("Cc")
+	e.ReplyTo = m.HeaderText("Reply-To")
+	e.MessageID = m.Header.Get("Message-Id")
+	if content, err := m.MIME(); err == nil {
+		e.Body = content.Text
+	} else {
+		// Fall back to the undecoded body if the MIME structure is broken
+		e.Body = string(m.Body)
+	}
+	if from := m.HeaderText("From"); from != "" {
+		e.From = from
+	}
+	if to := m.HeaderText("To"); to != "" {
+		e.To = to
+	}
+	if date := m.Date(); !date.IsZero() {
+		e.Date = date.Format(time.RFC1123Z)
+	}
+}
+
+// headerLineBreaks removes line breaks from header values, which would
+// otherwise start new header fields.
+var headerLineBreaks = strings.NewReplacer("\r", " ", "\n", " ")
+
+// composeMessage builds a plain text RFC 5322 message.
+func composeMessage(from string, to []string, subject, body string, date time.Time) []byte {
+	var buf bytes.Buffer
+
+	fields := [][2]string{
+		{"From", headerLineBreaks.Replace(from)},
+		{"To", headerLineBreaks.Replace(strings.Join(to, ", "))},
+		{"Subject", mime.QEncoding.Encode("utf-8", subject)},
+		{"Date", date.Format(time.RFC1123Z)},
+		{"Message-Id", newMessageID(from)},
+		{"Mime-Version", "1.0"},
+		{"Content-Type", "text/plain; charset=utf-8"},
+		{"Content-Transfer-Encoding", "quoted-printable"},
+	}
+
+	// Header.Add prepends, so add the fields back to front.
+	var header textproto.Header
+	for i := len(fields) - 1; i >= 0; i-- {
+		header.Add(fields[i][0], fields[i][1])
+	}
+	textproto.WriteHeader(&buf, header)
+
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(strings.ReplaceAll(body, "\r\n", "\n")))
+	qp.Close()
+
+	return bytes.ReplaceAll(bytes.ReplaceAll(buf.Bytes(), []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
+
+func newMessageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("<%s.%d@%s>", hex.EncodeToString(b), time.Now().UnixNano(), domain)
+}
+
+// sqliteTimeLayout matches the format of CURRENT_TIMESTAMP.
+const sqliteTimeLayout = "2006-01-02 15:04:05"
+
+// parseTimestamp parses a DATETIME value as returned by the SQLite driver.
+func parseTimestamp(value string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, sqliteTimeLayout} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
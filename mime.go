@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"html"
+	"io"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+)
+
+// MIMEContent is the decoded view of a message: its readable text and the
+// parts that should be offered as attachments.
+type MIMEContent struct {
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+// Attachment describes a non-inline body part. The decoded bytes live in the
+// blobs table under Hash.
+type Attachment struct {
+	ID          int64  `json:"id"`
+	Part        string `json:"part"` // IMAP section number, e.g. "2" or "1.3"
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Size        int64  `json:"size"`
+	Hash        string `json:"-"`
+	data        []byte
+}
+
+func (s *EmailServer) createMIMETables() error {
+	blobTable := `
+	CREATE TABLE IF NOT EXISTS blobs (
+		hash TEXT PRIMARY KEY,
+		data BLOB NOT NULL,
+		size INTEGER NOT NULL
+	);`
+
+	attachmentTable := `
+	CREATE TABLE IF NOT EXISTS attachments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+		part TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		content_id TEXT,
+		size INTEGER NOT NULL,
+		blob_hash TEXT NOT NULL REFERENCES blobs(hash)
+	);
+	CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments(message_id);
+	CREATE INDEX IF NOT EXISTS idx_attachments_blob ON attachments(blob_hash);`
+
+	if _, err := s.db.Exec(blobTable); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(attachmentTable); err != nil {
+		return err
+	}
+
+	if err := addColumnIfMissing(s.db, "messages", "mime_parsed", "BOOLEAN DEFAULT FALSE"); err != nil {
+		return err
+	}
+
+	return s.backfillAttachments()
+}
+
+// backfillAttachments extracts attachments from messages that were stored
+// before MIME parsing existed.
+func (s *EmailServer) backfillAttachments() error {
+	rows, err := s.db.Query("SELECT id FROM messages WHERE mime_parsed = FALSE")
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		msg, err := loadMessage(s.db, id)
+		if err != nil {
+			return err
+		}
+		content, err := msg.MIME()
+		if err == nil {
+			err = storeAttachments(s.db, msg, content)
+		}
+		if err != nil {
+			log.Printf("Skipping attachments of message %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// storeAttachments saves each attachment found in the MIME tree of msg as a
+// content-addressed blob, so identical files are kept only once.
+func storeAttachments(db execer, msg *StoredMessage, content *MIMEContent) error {
+	for _, a := range content.Attachments {
+		_, err := db.Exec("INSERT OR IGNORE INTO blobs (hash, data, size) VALUES (?, ?, ?)",
+			a.Hash, a.data, len(a.data))
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`INSERT INTO attachments (message_id, part, filename, content_type, content_id, size, blob_hash)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			msg.ID, a.Part, a.Filename, a.ContentType, a.ContentID, a.Size, a.Hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec("UPDATE messages SET mime_parsed = TRUE WHERE id = ?", msg.ID)
+	return err
+}
+
+// listAttachments returns the attachments recorded for a stored message.
+func listAttachments(db execer, messageID int64) ([]Attachment, error) {
+	rows, err := db.Query(`SELECT id, part, filename, content_type, COALESCE(content_id, ''), size, blob_hash
+		FROM attachments WHERE message_id = ? ORDER BY id`, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []Attachment
+	for rows.Next() {
+		var a Attachment
+		if err := rows.Scan(&a.ID, &a.Part, &a.Filename, &a.ContentType, &a.ContentID, &a.Size, &a.Hash); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// MIME walks the message's multipart tree, decoding transfer encodings and
+// charsets along the way.
+func (m *StoredMessage) MIME() (*MIMEContent, error) {
+	entity, err := message.Read(bytes.NewReader(m.Raw))
+	if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+		return nil, err
+	}
+
+	content := &MIMEContent{}
+	err = entity.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil && !message.IsUnknownCharset(err) && !message.IsUnknownEncoding(err) {
+			return err
+		}
+		if part.MultipartReader() != nil {
+			return nil
+		}
+
+		mediaType, params, _ := part.Header.ContentType()
+		if mediaType == "" {
+			mediaType = "text/plain"
+		}
+		disposition, dispParams, _ := part.Header.ContentDisposition()
+
+		filename := dispParams["filename"]
+		if filename == "" {
+			filename = params["name"]
+		}
+
+		inlineText := disposition != "attachment" && filename == "" &&
+			(mediaType == "text/plain" || mediaType == "text/html")
+
+		data, err := io.ReadAll(part.Body)
+		if err != nil {
+			return err
+		}
+
+		if inlineText {
+			if mediaType == "text/html" {
+				if content.HTML == "" {
+					content.HTML = string(data)
+				}
+			} else if content.Text == "" {
+				content.Text = string(data)
+			}
+			return nil
+		}
+
+		if filename == "" {
+			filename = "attachment-" + imapPartPath(path)
+		}
+		sum := sha256.Sum256(data)
+		content.Attachments = append(content.Attachments, Attachment{
+			Part:        imapPartPath(path),
+			Filename:    filename,
+			ContentType: mediaType,
+			ContentID:   strings.Trim(part.Header.Get("Content-Id"), "<>"),
+			Size:        int64(len(data)),
+			Hash:        hex.EncodeToString(sum[:]),
+			data:        data,
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if content.Text == "" && content.HTML != "" {
+		content.Text = htmlToText(content.HTML)
+	}
+
+	return content, nil
+}
+
+// imapPartPath converts a go-message walk path, which counts from zero and
+// is empty for a single-part message, into an IMAP section number.
+func imapPartPath(path []int) string {
+	if len(path) == 0 {
+		return "1"
+	}
+	parts := make([]string, len(path))
+	for i, n := range path {
+		parts[i] = strconv.Itoa(n + 1)
+	}
+	return strings.Join(parts, ".")
+}
+
+var (
+	htmlBlockRE = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	htmlBreakRE = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/h[1-6]|/li)[^>]*>`)
+	htmlTagRE   = regexp.MustCompile(`<[^>]*>`)
+	blankRunRE  = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText produces a rough plain text rendering of an HTML body for
+// previews and for messages that carry no text/plain alternative.
+func htmlToText(s string) string {
+	s = htmlBlockRE.ReplaceAllString(s, "")
+	s = htmlBreakRE.ReplaceAllString(s, "\n")
+	s = htmlTagRE.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = strings.ReplaceAll(s, "\r", "")
+	s = blankRunRE.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// MXResolver looks up mail exchangers. *net.Resolver satisfies it; tests
+// can point a net.Resolver at a fake DNS server or supply their own.
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Dialer opens network connections to remote SMTP peers. *net.Dialer
+// satisfies it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Transport hands a message to the next hop for one destination domain.
+// It reports a result per recipient; a nil entry means accepted.
+type Transport interface {
+	Send(ctx context.Context, domain, from string, to []string, raw []byte) map[string]error
+}
+
+// OutboundQueue persists mail for non-local recipients and delivers it in
+// the background, retrying with exponential backoff and bouncing the
+// message once the retry window runs out.
+type OutboundQueue struct {
+	db        *sql.DB
+	hostname  string
+	config    OutboundConfig
+	transport Transport
+
+	// bounce delivers delivery status notifications back to the sender.
+	bounce func(from string, to []string, raw []byte) error
+	now    func() time.Time
+	wake   chan struct{}
+}
+
+func NewOutboundQueue(db *sql.DB, hostname string, config OutboundConfig, transport Transport) *OutboundQueue {
+	return &OutboundQueue{
+		db:        db,
+		hostname:  hostname,
+		config:    config,
+		transport: transport,
+		now:       time.Now,
+		wake:      make(chan struct{}, 1),
+	}
+}
+
+func (s *EmailServer) createOutboundTables() error {
+	queueTable := `
+	CREATE TABLE IF NOT EXISTS outbound_queue (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id INTEGER NOT NULL REFERENCES messages(id),
+		sender TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		domain TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt DATETIME NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		created DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_outbound_queue_due ON outbound_queue(status, next_attempt);`
+
+	_, err := s.db.Exec(queueTable)
+	return err
+}
+
+// enqueue schedules a stored message for immediate delivery to each of the
+// recipients. The caller commits tx and then calls Wake.
+func (q *OutboundQueue) enqueue(tx execer, messageID int64, from string, recipients []string) error {
+	now := q.now().UTC().Format(sqliteTimeLayout)
+	for _, to := range recipients {
+		_, err := tx.Exec(`INSERT INTO outbound_queue (message_id, sender, recipient, domain, next_attempt, created)
+			VALUES (?, ?, ?, ?, ?, ?)`, messageID, from, to, addressDomain(to), now, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Wake makes the delivery loop look at the queue right away.
+func (q *OutboundQueue) Wake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers queued mail until ctx is cancelled.
+func (q *OutboundQueue) Run(ctx context.Context) {
+	for {
+		if err := q.ProcessDue(ctx); err != nil {
+			log.Printf("Outbound queue error: %v", err)
+		}
+
+		wait := time.Minute
+		var next string
+		err := q.db.QueryRow("SELECT MIN(next_attempt) FROM outbound_queue WHERE status = 'pending'").Scan(&next)
+		if err == nil && next != "" {
+			if d := parseTimestamp(next).Sub(q.now()); d < wait {
+				wait = d
+			}
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+type queueEntry struct {
+	id        int64
+	messageID int64
+	sender    string
+	recipient string
+	domain    string
+	attempts  int
+	created   time.Time
+}
+
+// ProcessDue attempts delivery of every queue entry whose retry time has
+// come. Entries for the same message and domain share one SMTP transaction.
+func (q *OutboundQueue) ProcessDue(ctx context.Context) error {
+	now := q.now().UTC().Format(sqliteTimeLayout)
+	rows, err := q.db.Query(`SELECT id, message_id, sender, recipient, domain, attempts, created
+		FROM outbound_queue WHERE status = 'pending' AND next_attempt <= ?
+		ORDER BY message_id, domain, id`, now)
+	if err != nil {
+		return err
+	}
+
+	type groupKey struct {
+		messageID int64
+		sender    string
+		domain    string
+	}
+	groups := make(map[groupKey][]queueEntry)
+	var order []groupKey
+	for rows.Next() {
+		var e queueEntry
+		var created string
+		if err := rows.Scan(&e.id, &e.messageID, &e.sender, &e.recipient, &e.domain, &e.attempts, &created); err != nil {
+			rows.Close()
+			return err
+		}
+		e.created = parseTimestamp(created)
+		key := groupKey{e.messageID, e.sender, e.domain}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, key := range order {
+		if err := q.deliverGroup(ctx, groups[key]); err != nil {
+			log.Printf("Outbound delivery to %s failed: %v", key.domain, err)
+		}
+	}
+	return nil
+}
+
+func (q *OutboundQueue) deliverGroup(ctx context.Context, entries []queueEntry) error {
+	first := entries[0]
+
+	msg, err := loadMessage(q.db, first.messageID)
+	if err != nil {
+		return err
+	}
+
+	recipients := make([]string, len(entries))
+	for i, e := range entries {
+		recipients[i] = e.recipient
+	}
+
+	results := q.transport.Send(ctx, first.domain, first.sender, recipients, msg.Raw)
+
+	var failed []queueEntry
+	var failures []error
+	for _, e := range entries {
+		err, ok := results[e.recipient]
+		if !ok {
+			err = errors.New("no delivery result")
+		}
+
+		switch {
+		case err == nil:
+			_, err = q.db.Exec("UPDATE outbound_queue SET status = 'sent', attempts = attempts + 1, last_error = '' WHERE id = ?", e.id)
+		case isPermanentError(err) || q.now().Sub(e.created) >= time.Duration(q.config.GiveUpAfter):
+			failed = append(failed, e)
+			failures = append(failures, err)
+			_, err = q.db.Exec("UPDATE outbound_queue SET status = 'failed', attempts = attempts + 1, last_error = ? WHERE id = ?", err.Error(), e.id)
+		default:
+			next := q.now().Add(q.backoff(e.attempts + 1)).UTC().Format(sqliteTimeLayout)
+			_, err = q.db.Exec("UPDATE outbound_queue SET attempts = attempts + 1, next_attempt = ?, last_error = ? WHERE id = ?",
+				next, err.Error(), e.id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(failed) > 0 {
+		if err := q.sendBounce(msg, failed, failures); err != nil {
+			return err
+		}
+	}
+
+	// Relayed mail has no local copy once its last delivery is settled.
+	return collectMessages(q.db, []int64{msg.ID})
+}
+
+// backoff returns the delay before the given attempt number.
+func (q *OutboundQueue) backoff(attempt int) time.Duration {
+	d := time.Duration(q.config.RetryInterval)
+	for i := 1; i < attempt; i++ {
+		d *= 2
+		if d >= time.Duration(q.config.MaxRetryInterval) {
+			return time.Duration(q.config.MaxRetryInterval)
+		}
+	}
+	return d
+}
+
+// isPermanentError reports whether a delivery error should not be retried.
+func isPermanentError(err error) bool {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 500
+	}
+	var permErr *permanentError
+	return errors.As(err, &permErr)
+}
+
+// permanentError marks a failure that no amount of retrying will fix, such
+// as a domain that does not exist.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// sendBounce returns an RFC 3464 delivery status notification to the
+// sender of msg. Bounces themselves (empty sender) are never bounced.
+func (q *OutboundQueue) sendBounce(msg *StoredMessage, failed []queueEntry, failures []error) error {
+	sender := failed[0].sender
+	if sender == "" || q.bounce == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	postmaster := "MAILER-DAEMON@" + q.hostname
+	fmt.Fprintf(&buf, "From: Mail Delivery System <%s>\r\n", postmaster)
+	fmt.Fprintf(&buf, "To: %s\r\n", sender)
+	fmt.Fprintf(&buf, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&buf, "Date: %s\r\n", q.now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-Id: %s\r\n", newMessageID(postmaster))
+	fmt.Fprintf(&buf, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&buf, "Mime-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n\r\n", mw.Boundary())
+
+	part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	fmt.Fprintf(part, "This is the mail system at host %s.\r\n\r\n", q.hostname)
+	fmt.Fprintf(part, "Your message could not be delivered to one or more recipients.\r\n\r\n")
+	for i, e := range failed {
+		fmt.Fprintf(part, "<%s>: %v\r\n", e.recipient, failures[i])
+	}
+
+	part, _ = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	fmt.Fprintf(part, "Reporting-MTA: dns; %s\r\n", q.hostname)
+	fmt.Fprintf(part, "Arrival-Date: %s\r\n", failed[0].created.Format(time.RFC1123Z))
+	for i, e := range failed {
+		status := "5.0.0"
+		var smtpErr *smtp.SMTPError
+		if errors.As(failures[i], &smtpErr) && smtpErr.EnhancedCode[0] == 5 {
+			status = fmt.Sprintf("%d.%d.%d", smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2])
+		} else if !isPermanentError(failures[i]) {
+			status = "4.4.7" // delivery time expired
+		}
+		fmt.Fprintf(part, "\r\nFinal-Recipient: rfc822; %s\r\n", e.recipient)
+		fmt.Fprintf(part, "Action: failed\r\n")
+		fmt.Fprintf(part, "Status: %s\r\n", status)
+		fmt.Fprintf(part, "Diagnostic-Code: smtp; %s\r\n", strings.ReplaceAll(failures[i].Error(), "\n", " "))
+		fmt.Fprintf(part, "Last-Attempt-Date: %s\r\n", q.now().Format(time.RFC1123Z))
+	}
+
+	part, _ = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+	headerEnd := bytes.Index(msg.Raw, []byte("\r\n\r\n"))
+	if headerEnd < 0 {
+		headerEnd = len(msg.Raw)
+	}
+	part.Write(msg.Raw[:headerEnd])
+	part.Write([]byte("\r\n"))
+
+	mw.Close()
+
+	err := q.bounce("", []string{sender}, buf.Bytes())
+	if errors.Is(err, errNoAccount) {
+		// A local sender without an account of its own, such as an
+		// address granted through send_as, has no mailbox to bounce to
+		log.Printf("Bounce for %s dropped: %v", sender, err)
+		return nil
+	}
+	return err
+}
+
+// MXTransport delivers directly to the mail exchangers of each domain.
+type MXTransport struct {
+	hostname string
+	port     string
+	resolver MXResolver
+	dialer   Dialer
+	timeout  time.Duration // limit on one SMTP conversation
+}
+
+func NewMXTransport(hostname, port string, resolver MXResolver, dialer Dialer) *MXTransport {
+	return &MXTransport{hostname: hostname, port: port, resolver: resolver, dialer: dialer, timeout: smtpSessionTimeout}
+}
+
+func (t *MXTransport) Send(ctx context.Context, domain, from string, to []string, raw []byte) map[string]error {
+	hosts, err := t.lookupHosts(ctx, domain)
+	if err != nil {
+		return failAll(to, err)
+	}
+
+	var results map[string]error
+	for _, host := range hosts {
+		var connErr error
+		results, connErr = t.sendTo(ctx, host, from, to, raw)
+		if connErr == nil {
+			return results
+		}
+		err = fmt.Errorf("%s: %v", host, connErr)
+		// A permanent rejection of the whole transaction is final; anything
+		// else is worth trying on the next exchanger.
+		if isPermanentError(connErr) {
+			return failAll(to, connErr)
+		}
+	}
+	return failAll(to, err)
+}
+
+// lookupHosts returns the exchangers for domain in preference order,
+// falling back to the domain itself when it has no MX records.
+func (t *MXTransport) lookupHosts(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := t.resolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, err
+	}
+
+	if len(mxs) == 0 {
+		if _, err := t.resolver.LookupHost(ctx, domain); err != nil {
+			if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				return nil, &permanentError{fmt.Errorf("domain %s does not exist", domain)}
+			}
+			return nil, err
+		}
+		return []string{domain}, nil
+	}
+
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+
+	var hosts []string
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// RFC 7505 null MX: the domain accepts no mail
+			return nil, &permanentError{fmt.Errorf("domain %s does not accept mail", domain)}
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// sendTo runs one SMTP transaction against host. The returned error is
+// set when the transaction as a whole failed.
+func (t *MXTransport) sendTo(ctx context.Context, host, from string, to []string, raw []byte) (map[string]error, error) {
+	conn, err := t.dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, t.port))
+	if err != nil {
+		return nil, err
+	}
+	defer limitSession(ctx, conn, t.timeout)()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer c.Close()
+
+	if err := c.Hello(t.hostname); err != nil {
+		return nil, err
+	}
+
+	// Opportunistic TLS (RFC 7435): encrypt when offered, but MX
+	// certificates are not expected to be verifiable.
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host, InsecureSkipVerify: true}); err != nil {
+			return nil, err
+		}
+	}
+
+	return smtpTransaction(c, from, to, raw)
+}
+
+// smtpSessionTimeout bounds a whole conversation with a remote server, so
+// one that accepts the connection and then stalls can't hold up the queue.
+// The SMTP client already limits each command to 5 minutes and DATA to 12;
+// the conn deadlines it uses for that are reset after every command, so
+// the overall limit closes the connection instead.
+const smtpSessionTimeout = 15 * time.Minute
+
+// limitSession closes conn once timeout has passed or ctx is done. Call
+// the returned function when the conversation is over.
+func limitSession(ctx context.Context, conn net.Conn, timeout time.Duration) (stop func()) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	stopClose := context.AfterFunc(ctx, func() { conn.Close() })
+	return func() {
+		stopClose()
+		cancel()
+	}
+}
+
+// smtpTransaction sends MAIL, RCPT and DATA on an established session.
+func smtpTransaction(c *smtp.Client, from string, to []string, raw []byte) (map[string]error, error) {
+	if err := c.Mail(from, nil); err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]error, len(to))
+	var accepted []string
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			results[rcpt] = err
+			continue
+		}
+		accepted = append(accepted, rcpt)
+	}
+	if len(accepted) == 0 {
+		c.Reset()
+		return results, nil
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	c.Quit()
+
+	for _, rcpt := range accepted {
+		results[rcpt] = nil
+	}
+	return results, nil
+}
+
+func failAll(to []string, err error) map[string]error {
+	results := make(map[string]error, len(to))
+	for _, rcpt := range to {
+		results[rcpt] = err
+	}
+	return results
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// fakeMX answers MX and host lookups from memory.
+type fakeMX struct {
+	mx    map[string][]*net.MX
+	hosts map[string]bool
+}
+
+func (r fakeMX) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if mxs, ok := r.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeMX) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if r.hosts[host] {
+		return []string{"192.0.2.1"}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// fakeDialer connects host names to local listeners; other hosts refuse
+// the connection.
+type fakeDialer map[string]string
+
+func (d fakeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	target, ok := d[host]
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, target)
+}
+
+// recordingBackend is an SMTP server that keeps the recipients it accepted.
+type recordingBackend struct {
+	received chan []string
+}
+
+func (b *recordingBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &recordingSession{backend: b}, nil
+}
+
+type recordingSession struct {
+	backend *recordingBackend
+	to      []string
+}
+
+func (s *recordingSession) AuthPlain(username, password string) error      { return nil }
+func (s *recordingSession) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (s *recordingSession) Rcpt(to string) error {
+	s.to = append(s.to, to)
+	return nil
+}
+func (s *recordingSession) Data(r io.Reader) error {
+	io.Copy(io.Discard, r)
+	s.backend.received <- s.to
+	return nil
+}
+func (s *recordingSession) Reset()        {}
+func (s *recordingSession) Logout() error { return nil }
+
+func startRecordingServer(t *testing.T) (string, chan []string) {
+	backend := &recordingBackend{received: make(chan []string, 1)}
+	srv := smtp.NewServer(backend)
+	srv.Domain = "mx.test"
+	srv.AuthDisabled = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String(), backend.received
+}
+
+var testMessage = []byte("From: a@localhost.com\r\nTo: b@example.org\r\nSubject: hi\r\n\r\nhello\r\n")
+
+func TestMXTransportFallsBackToNextExchanger(t *testing.T) {
+	addr, received := startRecordingServer(t)
+	resolver := fakeMX{mx: map[string][]*net.MX{
+		"example.org": {{Host: "backup.example.org.", Pref: 20}, {Host: "primary.example.org.", Pref: 10}},
+	}}
+	transport := NewMXTransport("h", "25", resolver, fakeDialer{"backup.example.org": addr})
+
+	results := transport.Send(context.Background(), "example.org", "a@localhost.com", []string{"b@example.org"}, testMessage)
+	if err := results["b@example.org"]; err != nil {
+		t.Fatalf("delivery failed: %v", err)
+	}
+	if to := <-received; len(to) != 1 || to[0] != "b@example.org" {
+		t.Errorf("backup exchanger got %v", to)
+	}
+}
+
+func TestMXTransportPermanentFailures(t *testing.T) {
+	resolver := fakeMX{mx: map[string][]*net.MX{
+		"nullmx.example": {{Host: ".", Pref: 0}},
+	}}
+	transport := NewMXTransport("h", "25", resolver, fakeDialer{})
+
+	for _, domain := range []string{"nullmx.example", "missing.example"} {
+		results := transport.Send(context.Background(), domain, "a@localhost.com", []string{"b@" + domain}, testMessage)
+		if err := results["b@"+domain]; !isPermanentError(err) {
+			t.Errorf("%s: got %v, want a permanent error", domain, err)
+		}
+	}
+}
+
+func TestMXTransportStalledServer(t *testing.T) {
+	// The server accepts the connection and never greets
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	resolver := fakeMX{hosts: map[string]bool{"stall.example": true}}
+	transport := NewMXTransport("h", "25", resolver, fakeDialer{"stall.example": l.Addr().String()})
+	transport.timeout = 200 * time.Millisecond
+
+	done := make(chan map[string]error, 1)
+	go func() {
+		done <- transport.Send(context.Background(), "stall.example", "a@localhost.com", []string{"b@stall.example"}, testMessage)
+	}()
+	select {
+	case results := <-done:
+		if results["b@stall.example"] == nil {
+			t.Error("delivery to a stalled server succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery to a stalled server did not time out")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// SmarthostTransport hands every message to a single relay server,
+// whatever the destination domain.
+type SmarthostTransport struct {
+	hostname string
+	config   SmarthostConfig
+	dialer   Dialer
+	timeout  time.Duration // limit on one SMTP conversation
+}
+
+func NewSmarthostTransport(hostname string, config SmarthostConfig, dialer Dialer) *SmarthostTransport {
+	if config.TLS == "" {
+		config.TLS = "starttls"
+	}
+	if config.Port == "" {
+		if config.TLS == "implicit" {
+			config.Port = "465"
+		} else {
+			config.Port = "587"
+		}
+	}
+	return &SmarthostTransport{hostname: hostname, config: config, dialer: dialer, timeout: smtpSessionTimeout}
+}
+
+func (t *SmarthostTransport) Send(ctx context.Context, domain, from string, to []string, raw []byte) map[string]error {
+	results, err := t.send(ctx, from, to, raw)
+	if err != nil {
+		return failAll(to, fmt.Errorf("relay %s: %v", t.config.Host, err))
+	}
+	return results
+}
+
+func (t *SmarthostTransport) send(ctx context.Context, from string, to []string, raw []byte) (map[string]error, error) {
+	conn, err := t.dialer.DialContext(ctx, "tcp", net.JoinHostPort(t.config.Host, t.config.Port))
+	if err != nil {
+		return nil, err
+	}
+	defer limitSession(ctx, conn, t.timeout)()
+
+	tlsConfig := &tls.Config{
+		ServerName:         t.config.Host,
+		InsecureSkipVerify: t.config.InsecureSkipVerify,
+	}
+	if t.config.TLS == "implicit" {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	c, err := smtp.NewClient(conn, t.config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	defer c.Close()
+
+	if err := c.Hello(t.hostname); err != nil {
+		return nil, err
+	}
+
+	if t.config.TLS == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return nil, fmt.Errorf("server does not offer STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if t.config.Username != "" {
+		var auth sasl.Client
+		switch t.config.Auth {
+		case "login":
+			auth = sasl.NewLoginClient(t.config.Username, t.config.Password)
+		default:
+			auth = sasl.NewPlainClient("", t.config.Username, t.config.Password)
+		}
+		if err := c.Auth(auth); err != nil {
+			return nil, err
+		}
+	}
+
+	return smtpTransaction(c, from, to, raw)
+}
+
+// RoutingTransport picks a transport by the sender's domain.
+type RoutingTransport struct {
+	routes   map[string]Transport
+	fallback Transport
+}
+
+func (t *RoutingTransport) Send(ctx context.Context, domain, from string, to []string, raw []byte) map[string]error {
+	transport := t.fallback
+	if routed, ok := t.routes[addressDomain(from)]; ok {
+		transport = routed
+	}
+	return transport.Send(ctx, domain, from, to, raw)
+}
+
+// newTransport builds the outbound transport described by config: direct
+// MX delivery, a smarthost, or per-sender-domain routing between them.
+func newTransport(config *Config, resolver MXResolver, dialer Dialer) (Transport, error) {
+	direct := NewMXTransport(config.Hostname, config.Outbound.Port, resolver, dialer)
+
+	relay := config.Relay
+	smarthosts := make(map[string]Transport)
+	for name, host := range relay.Smarthosts {
+		if host.Host == "" {
+			return nil, fmt.Errorf("smarthost %q has no host", name)
+		}
+		switch host.TLS {
+		case "", "starttls", "implicit", "none":
+		default:
+			return nil, fmt.Errorf("smarthost %q: unknown tls mode %q", name, host.TLS)
+		}
+		switch host.Auth {
+		case "", "plain", "login":
+		default:
+			return nil, fmt.Errorf("smarthost %q: unknown auth mechanism %q", name, host.Auth)
+		}
+		smarthosts[name] = NewSmarthostTransport(config.Hostname, host, dialer)
+	}
+
+	lookup := func(name string) (Transport, error) {
+		if name == "" || name == "direct" {
+			return direct, nil
+		}
+		transport, ok := smarthosts[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown smarthost %q", name)
+		}
+		return transport, nil
+	}
+
+	fallback, err := lookup(relay.Default)
+	if err != nil {
+		return nil, err
+	}
+	if len(relay.Routes) == 0 {
+		return fallback, nil
+	}
+
+	routing := &RoutingTransport{routes: make(map[string]Transport), fallback: fallback}
+	for _, route := range relay.Routes {
+		transport, err := lookup(route.Smarthost)
+		if err != nil {
+			return nil, fmt.Errorf("route for %s: %v", route.SenderDomain, err)
+		}
+		routing.routes[strings.ToLower(route.SenderDomain)] = transport
+	}
+	return routing, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewTransportRejectsUnknownSettings(t *testing.T) {
+	tests := []struct {
+		name      string
+		smarthost SmarthostConfig
+		wantErr   string
+	}{
+		{"defaults", SmarthostConfig{Host: "relay.example"}, ""},
+		{"login", SmarthostConfig{Host: "relay.example", TLS: "implicit", Auth: "login"}, ""},
+		{"no host", SmarthostConfig{}, "has no host"},
+		{"tls typo", SmarthostConfig{Host: "relay.example", TLS: "startls"}, "unknown tls mode"},
+		{"auth case", SmarthostConfig{Host: "relay.example", Auth: "Plain"}, "unknown auth mechanism"},
+		{"auth typo", SmarthostConfig{Host: "relay.example", Auth: "cram-md5"}, "unknown auth mechanism"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := defaultConfig()
+			config.Relay = RelayConfig{
+				Smarthosts: map[string]SmarthostConfig{"relay": tt.smarthost},
+				Default:    "relay",
+			}
+			_, err := newTransport(config, fakeMX{}, fakeDialer{})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+)
+
+// IMAP SEARCH is translated into SQL over the emails of one mailbox, with
+// BODY and TEXT answered from the full-text index. Keys that SQL cannot
+// evaluate exactly (SENTSINCE/SENTBEFORE, which need the parsed Date header,
+// and non-ASCII strings where SQLite only folds ASCII case) are left out of
+// the query, and the rows it returns are then checked against the complete
+// criteria in Go.
+
+// searchCandidate is a row returned by the SQL part of a search.
+type searchCandidate struct {
+	mailboxMessage
+	size int64
+}
+
+// searchMailbox returns the messages of a mailbox that match c. Sequence
+// sets in c must already have "*" resolved.
+func searchMailbox(db execer, mailboxID int64, c *imap.SearchCriteria) ([]mailboxMessage, error) {
+	cond, args, exact := searchCondition(c)
+	if cond == "" {
+		cond = "1"
+	}
+	candidates, err := searchCandidates(db, mailboxID, cond, args)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []mailboxMessage
+	for _, cand := range candidates {
+		if !exact {
+			ok, err := matchCandidate(db, &cand, c)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		matches = append(matches, cand.mailboxMessage)
+	}
+	return matches, nil
+}
+
+// searchCandidates returns the messages of a mailbox that satisfy a
+// condition from searchCondition, in UID order.
+func searchCandidates(db execer, mailboxID int64, cond string, args []interface{}) ([]searchCandidate, error) {
+	rows, err := db.Query(`SELECT e.id, e.uid, e.seq, e.message_id, e.date, e.size FROM (
+			SELECT e.id, e.uid, ROW_NUMBER() OVER (ORDER BY e.uid) AS seq, e.message_id, e.date, m.size
+			FROM emails e JOIN messages m ON m.id = e.message_id
+			WHERE e.mailbox_id = ?
+		) e WHERE `+cond+` ORDER BY e.uid`, append([]interface{}{mailboxID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var candidates []searchCandidate
+	for rows.Next() {
+		var cand searchCandidate
+		var date string
+		if err := rows.Scan(&cand.emailID, &cand.uid, &cand.seqNum, &cand.messageID, &date, &cand.size); err != nil {
+			return nil, err
+		}
+		cand.date = parseTimestamp(date)
+		candidates = append(candidates, cand)
+	}
+	return candidates, rows.Err()
+}
+
+// searchCondition builds a WHERE clause for c over the columns of the
+// search subquery. exact is false if some keys could not be expressed; the
+// clause then matches a superset of the messages.
+func searchCondition(c *imap.SearchCriteria) (cond string, args []interface{}, exact bool) {
+	var conds []string
+	exact = true
+
+	add := func(cond string, condArgs ...interface{}) {
+		conds = append(conds, cond)
+		args = append(args, condArgs...)
+	}
+	addText := func(cond string, condArgs []interface{}) {
+		add(cond, condArgs...)
+	}
+
+	if c.SeqNum != nil {
+		cond, seqArgs := seqSetCondition("e.seq", c.SeqNum)
+		add(cond, seqArgs...)
+	}
+	if c.Uid != nil {
+		cond, seqArgs := seqSetCondition("e.uid", c.Uid)
+		add(cond, seqArgs...)
+	}
+
+	// Internal date comparisons ignore the time of day (RFC 3501 6.4.4).
+	if !c.Since.IsZero() {
+		add("date(e.date) >= ?", c.Since.Format("2006-01-02"))
+	}
+	if !c.Before.IsZero() {
+		add("date(e.date) < ?", c.Before.Format("2006-01-02"))
+	}
+	if !c.SentSince.IsZero() || !c.SentBefore.IsZero() {
+		exact = false
+	}
+
+	for key, values := range c.Header {
+		name := strings.ToLower(key)
+		for _, value := range values {
+			switch {
+			case value == "":
+				add("EXISTS (SELECT 1 FROM message_headers h WHERE h.message_id = e.message_id AND h.name = ?)", name)
+			case isASCII(value):
+				add(`EXISTS (SELECT 1 FROM message_headers h WHERE h.message_id = e.message_id AND h.name = ?
+					AND instr(lower(h.value), lower(?)) > 0)`, name, value)
+			default:
+				exact = false
+			}
+		}
+	}
+	for _, value := range c.Body {
+		if utf8.RuneCountInString(value) < 3 && !isASCII(value) {
+			exact = false
+			continue
+		}
+		addText(textCondition(value, "body"))
+	}
+	for _, value := range c.Text {
+		if !isASCII(value) {
+			exact = false
+			continue
+		}
+		body, bodyArgs := textCondition(value)
+		add(`(`+body+` OR EXISTS (SELECT 1 FROM message_headers h WHERE h.message_id = e.message_id
+			AND instr(lower(h.name || ': ' || h.value), lower(?)) > 0))`, append(bodyArgs, value)...)
+	}
+
+	for _, flag := range c.WithFlags {
+		flag = imap.CanonicalFlag(flag)
+		if flag == imap.RecentFlag {
+			add("0")
+			continue
+		}
+		add("EXISTS (SELECT 1 FROM email_flags f WHERE f.email_id = e.id AND f.flag = ?)", flag)
+	}
+	for _, flag := range c.WithoutFlags {
+		flag = imap.CanonicalFlag(flag)
+		if flag == imap.RecentFlag {
+			continue
+		}
+		add("NOT EXISTS (SELECT 1 FROM email_flags f WHERE f.email_id = e.id AND f.flag = ?)", flag)
+	}
+
+	if c.Larger > 0 {
+		add("e.size > ?", c.Larger)
+	}
+	if c.Smaller > 0 {
+		add("e.size < ?", c.Smaller)
+	}
+
+	// A negation or disjunction can only be pushed down whole; dropping a
+	// part of one would no longer give a superset.
+	for _, not := range c.Not {
+		sub, subArgs, ok := searchCondition(not)
+		if !ok {
+			exact = false
+			continue
+		}
+		if sub == "" {
+			sub = "1"
+		}
+		add("NOT ("+sub+")", subArgs...)
+	}
+	for _, or := range c.Or {
+		left, leftArgs, ok1 := searchCondition(or[0])
+		right, rightArgs, ok2 := searchCondition(or[1])
+		if !ok1 || !ok2 {
+			exact = false
+			continue
+		}
+		if left == "" || right == "" {
+			continue
+		}
+		add("(("+left+") OR ("+right+"))", append(leftArgs, rightArgs...)...)
+	}
+
+	return strings.Join(conds, " AND "), args, exact
+}
+
+func seqSetCondition(column string, set *imap.SeqSet) (string, []interface{}) {
+	if len(set.Set) == 0 {
+		return "0", nil
+	}
+	var conds []string
+	var args []interface{}
+	for _, seq := range set.Set {
+		conds = append(conds, column+" BETWEEN ? AND ?")
+		args = append(args, seq.Start, seq.Stop)
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// matchCandidate evaluates the complete criteria against one message in Go.
+func matchCandidate(db execer, cand *searchCandidate, c *imap.SearchCriteria) (bool, error) {
+	flags, err := listFlags(db, cand.emailID)
+	if err != nil {
+		return false, err
+	}
+	msg, err := loadMessage(db, cand.messageID)
+	if err != nil {
+		return false, err
+	}
+	return matchCriteria(&searchTarget{searchCandidate: cand, flags: flags, msg: msg}, c), nil
+}
+
+// searchTarget holds everything the in-memory matcher looks at. The decoded
+// body is built on first use.
+type searchTarget struct {
+	*searchCandidate
+	flags []string
+	msg   *StoredMessage
+
+	body    string
+	decoded bool
+}
+
+func (t *searchTarget) bodyText() string {
+	if !t.decoded {
+		t.decoded = true
+		if content, err := t.msg.MIME(); err == nil {
+			t.body = content.Text
+		} else {
+			t.body = string(t.msg.Body)
+		}
+	}
+	return t.body
+}
+
+func (t *searchTarget) headerText() string {
+	var b strings.Builder
+	fields := t.msg.Header.Fields()
+	for fields.Next() {
+		value, err := wordDecoder.DecodeHeader(fields.Value())
+		if err != nil {
+			value = fields.Value()
+		}
+		b.WriteString(fields.Key() + ": " + value + "\n")
+	}
+	return b.String()
+}
+
+func (t *searchTarget) hasFlag(flag string) bool {
+	for _, f := range t.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// dateOnly drops the time of day and zone, as SEARCH date keys require.
+func dateOnly(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func matchCriteria(t *searchTarget, c *imap.SearchCriteria) bool {
+	if c.SeqNum != nil && !c.SeqNum.Contains(t.seqNum) {
+		return false
+	}
+	if c.Uid != nil && !c.Uid.Contains(t.uid) {
+		return false
+	}
+
+	date := dateOnly(t.date)
+	if !c.Since.IsZero() && date.Before(dateOnly(c.Since)) {
+		return false
+	}
+	if !c.Before.IsZero() && !date.Before(dateOnly(c.Before)) {
+		return false
+	}
+	if !c.SentSince.IsZero() || !c.SentBefore.IsZero() {
+		sent := t.msg.Date()
+		if sent.IsZero() {
+			return false
+		}
+		sent = dateOnly(sent)
+		if !c.SentSince.IsZero() && sent.Before(dateOnly(c.SentSince)) {
+			return false
+		}
+		if !c.SentBefore.IsZero() && !sent.Before(dateOnly(c.SentBefore)) {
+			return false
+		}
+	}
+
+	for key, values := range c.Header {
+		for _, value := range values {
+			found := false
+			fields := t.msg.Header.FieldsByKey(key)
+			for fields.Next() {
+				decoded, err := wordDecoder.DecodeHeader(fields.Value())
+				if err != nil {
+					decoded = fields.Value()
+				}
+				if containsFold(decoded, value) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	for _, value := range c.Body {
+		if !containsFold(t.bodyText(), value) {
+			return false
+		}
+	}
+	for _, value := range c.Text {
+		if !containsFold(t.headerText(), value) && !containsFold(t.bodyText(), value) {
+			return false
+		}
+	}
+
+	for _, flag := range c.WithFlags {
+		if !t.hasFlag(imap.CanonicalFlag(flag)) {
+			return false
+		}
+	}
+	for _, flag := range c.WithoutFlags {
+		if t.hasFlag(imap.CanonicalFlag(flag)) {
+			return false
+		}
+	}
+
+	if c.Larger > 0 && t.size <= int64(c.Larger) {
+		return false
+	}
+	if c.Smaller > 0 && t.size >= int64(c.Smaller) {
+		return false
+	}
+
+	for _, not := range c.Not {
+		if matchCriteria(t, not) {
+			return false
+		}
+	}
+	for _, or := range c.Or {
+		if !matchCriteria(t, or[0]) && !matchCriteria(t, or[1]) {
+			return false
+		}
+	}
+	return true
+}
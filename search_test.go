@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// searchFixture delivers three messages to a user's INBOX and returns the
+// mailbox.
+func searchFixture(t *testing.T) (*Mailbox, *sql.DB) {
+	db := newTestDB(t)
+	userID := newTestUser(t, db, "bob@localhost.com")
+
+	messages := []string{
+		"From: Alice <alice@x.example>\r\nTo: bob@localhost.com\r\nCc: carol@y.example\r\nSubject: Quarterly report\r\n" +
+			"Date: Mon, 02 Jan 2023 10:00:00 +0000\r\nX-Tag: red\r\n\r\nnumbers attached\r\n",
+		"From: dave@z.example\r\nTo: bob@localhost.com\r\nSubject: =?utf-8?q?R=C3=A9sum=C3=A9?=\r\n" +
+			"Date: Tue, 10 Jan 2023 10:00:00 +0000\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\nCaf=C3=A9 meeting tomorrow\r\n",
+		"From: alice@x.example\r\nTo: bob@localhost.com\r\nSubject: lunch\r\n" +
+			"Date: Fri, 20 Jan 2023 10:00:00 +0000\r\n\r\n" + strings.Repeat("long ", 400) + "\r\n",
+	}
+	queue := NewOutboundQueue(db, "localhost.com", defaultConfig().Outbound, nil)
+	delivery := NewDelivery(db, []string{"localhost.com"}, queue, NewEventBus(db))
+	for _, raw := range messages {
+		if err := delivery.Deliver("sender@x.example", []string{"bob@localhost.com"}, []byte(raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inbox, err := getMailbox(db, userID, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emailIDs, err := queryIDs(db, "SELECT id FROM emails WHERE mailbox_id = ? ORDER BY uid", inbox.ID)
+	if err != nil || len(emailIDs) != len(messages) {
+		t.Fatalf("got emails %v, %v", emailIDs, err)
+	}
+	dates := []string{"2023-01-05 23:30:00", "2023-01-10 00:00:00", "2023-01-20 12:00:00"}
+	flags := []string{imap.SeenFlag, imap.FlaggedFlag, "$todo"}
+	for i, id := range emailIDs {
+		if _, err := db.Exec("UPDATE emails SET date = ? WHERE id = ?", dates[i], id); err != nil {
+			t.Fatal(err)
+		}
+		if err := setFlag(db, id, flags[i], true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return inbox, db
+}
+
+// TestSearchPushdownMatchesFallback runs each search through the SQL
+// pushdown and through the in-memory matcher alone, which must agree with
+// each other and with the expected UIDs.
+func TestSearchPushdownMatchesFallback(t *testing.T) {
+	inbox, db := searchFixture(t)
+
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+	seqSet := func(s string) *imap.SeqSet {
+		set, _ := imap.ParseSeqSet(s)
+		return set
+	}
+	criteria := func(f func(c *imap.SearchCriteria)) *imap.SearchCriteria {
+		c := imap.NewSearchCriteria()
+		f(c)
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		criteria *imap.SearchCriteria
+		want     []uint32
+	}{
+		{"all", criteria(func(c *imap.SearchCriteria) {}), []uint32{1, 2, 3}},
+		{"from", criteria(func(c *imap.SearchCriteria) { c.Header.Add("From", "ALICE") }), []uint32{1, 3}},
+		{"cc", criteria(func(c *imap.SearchCriteria) { c.Header.Add("Cc", "carol") }), []uint32{1}},
+		{"encoded subject", criteria(func(c *imap.SearchCriteria) { c.Header.Add("Subject", "rÉsumé") }), []uint32{2}},
+		{"header present", criteria(func(c *imap.SearchCriteria) { c.Header.Add("X-Tag", "") }), []uint32{1}},
+		{"body", criteria(func(c *imap.SearchCriteria) { c.Body = []string{"numbers"} }), []uint32{1}},
+		{"decoded body", criteria(func(c *imap.SearchCriteria) { c.Body = []string{"café"} }), []uint32{2}},
+		{"text in header", criteria(func(c *imap.SearchCriteria) { c.Text = []string{"quarterly"} }), []uint32{1}},
+		{"text in body", criteria(func(c *imap.SearchCriteria) { c.Text = []string{"meeting"} }), []uint32{2}},
+		{"since", criteria(func(c *imap.SearchCriteria) { c.Since = day("2023-01-10") }), []uint32{2, 3}},
+		{"before", criteria(func(c *imap.SearchCriteria) { c.Before = day("2023-01-10") }), []uint32{1}},
+		{"on", criteria(func(c *imap.SearchCriteria) { c.Since, c.Before = day("2023-01-05"), day("2023-01-06") }), []uint32{1}},
+		{"sent since", criteria(func(c *imap.SearchCriteria) { c.SentSince = day("2023-01-10") }), []uint32{2, 3}},
+		{"sent before", criteria(func(c *imap.SearchCriteria) { c.SentBefore = day("2023-01-10") }), []uint32{1}},
+		{"larger", criteria(func(c *imap.SearchCriteria) { c.Larger = 1000 }), []uint32{3}},
+		{"smaller", criteria(func(c *imap.SearchCriteria) { c.Smaller = 1000 }), []uint32{1, 2}},
+		{"seen", criteria(func(c *imap.SearchCriteria) { c.WithFlags = []string{imap.SeenFlag} }), []uint32{1}},
+		{"unseen", criteria(func(c *imap.SearchCriteria) { c.WithoutFlags = []string{imap.SeenFlag} }), []uint32{2, 3}},
+		{"keyword", criteria(func(c *imap.SearchCriteria) { c.WithFlags = []string{"$TODO"} }), []uint32{3}},
+		{"recent", criteria(func(c *imap.SearchCriteria) { c.WithFlags = []string{imap.RecentFlag} }), nil},
+		{"uid", criteria(func(c *imap.SearchCriteria) { c.Uid = seqSet("2:*") }), []uint32{2, 3}},
+		{"seq", criteria(func(c *imap.SearchCriteria) { c.SeqNum = seqSet("*") }), []uint32{3}},
+		{"not", criteria(func(c *imap.SearchCriteria) {
+			not := imap.NewSearchCriteria()
+			not.Header.Add("From", "alice")
+			c.Not = append(c.Not, not)
+		}), []uint32{2}},
+		{"not non-ascii", criteria(func(c *imap.SearchCriteria) {
+			not := imap.NewSearchCriteria()
+			not.Body = []string{"CAFÉ"}
+			c.Not = append(c.Not, not)
+		}), []uint32{1, 3}},
+		{"or", criteria(func(c *imap.SearchCriteria) {
+			left := imap.NewSearchCriteria()
+			left.WithFlags = []string{imap.FlaggedFlag}
+			right := imap.NewSearchCriteria()
+			right.Body = []string{"numbers"}
+			c.Or = append(c.Or, [2]*imap.SearchCriteria{left, right})
+		}), []uint32{1, 2}},
+		{"or sent date", criteria(func(c *imap.SearchCriteria) {
+			left := imap.NewSearchCriteria()
+			left.SentBefore = day("2023-01-03")
+			right := imap.NewSearchCriteria()
+			right.WithFlags = []string{"$todo"}
+			c.Or = append(c.Or, [2]*imap.SearchCriteria{left, right})
+		}), []uint32{1, 3}},
+	}
+
+	all, err := searchCandidates(db, inbox.ID, "1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := resolveCriteria(tt.criteria, uint32(len(all)), all[len(all)-1].uid)
+
+			matches, err := searchMailbox(db, inbox.ID, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pushdown []uint32
+			for _, msg := range matches {
+				pushdown = append(pushdown, msg.uid)
+			}
+
+			var fallback []uint32
+			for _, cand := range all {
+				ok, err := matchCandidate(db, &cand, c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok {
+					fallback = append(fallback, cand.uid)
+				}
+			}
+
+			if !reflect.DeepEqual(pushdown, tt.want) {
+				t.Errorf("pushdown got %v, want %v", pushdown, tt.want)
+			}
+			if !reflect.DeepEqual(fallback, tt.want) {
+				t.Errorf("in-memory got %v, want %v", fallback, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Web logins are kept in the sessions table. The browser holds a random
+// token and the table only stores its SHA-256 hash, so the database alone
+// is not enough to take over a session.
+
+const sessionCookieName = "session"
+
+func (s *EmailServer) createSessionTables() error {
+	sessionTable := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_hash TEXT UNIQUE NOT NULL,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		ip TEXT NOT NULL,
+		user_agent TEXT NOT NULL,
+		created DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_seen DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);`
+
+	if _, err := s.db.Exec(sessionTable); err != nil {
+		return err
+	}
+	return addColumnIfMissing(s.db, "sessions", "csrf_token", "TEXT NOT NULL DEFAULT ''")
+}
+
+// Session is one active web login, as listed on the sessions page.
+type Session struct {
+	ID        int64
+	IP        string
+	UserAgent string
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+	Current   bool
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientIP returns the address the request came from. Forwarding headers
+// are ignored since any client can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// randomToken returns 32 random bytes, base64url encoded.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// startSession records a new login for the user and sets its cookie.
+func (s *EmailServer) startSession(w http.ResponseWriter, r *http.Request, userID int) error {
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	expires := now.Add(time.Duration(s.config.Sessions.Lifetime))
+
+	// Expired sessions are never used again; clear them out on each login.
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE expires <= ?", now.Format(sqliteTimeLayout)); err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO sessions (token_hash, user_id, ip, user_agent, created, last_seen, expires, csrf_token)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashSessionToken(token), userID, clientIP(r), r.UserAgent(),
+		now.Format(sqliteTimeLayout), now.Format(sqliteTimeLayout), expires.Format(sqliteTimeLayout), csrfToken)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, s.sessionCookie(r, token, expires))
+	return nil
+}
+
+// sessionCookie builds the session cookie; an empty token deletes it.
+func (s *EmailServer) sessionCookie(r *http.Request, token string, expires time.Time) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || s.config.Sessions.SecureCookie,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if token == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = expires
+	}
+	return cookie
+}
+
+// currentSession looks up the session the request's cookie refers to. It
+// returns zeros if there is no cookie or the session is unknown or expired.
+func (s *EmailServer) currentSession(r *http.Request) (sessionID int64, userID int) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return 0, 0
+	}
+
+	var lastSeen, expires string
+	err = s.db.QueryRow("SELECT id, user_id, last_seen, expires FROM sessions WHERE token_hash = ?",
+		hashSessionToken(cookie.Value)).Scan(&sessionID, &userID, &lastSeen, &expires)
+	if err != nil {
+		return 0, 0
+	}
+
+	now := time.Now().UTC()
+	if !now.Before(parseTimestamp(expires)) {
+		s.db.Exec("DELETE FROM sessions WHERE id = ?", sessionID)
+		return 0, 0
+	}
+
+	// Keep the sessions page current without a write on every request.
+	if now.Sub(parseTimestamp(lastSeen)) > time.Minute {
+		s.db.Exec("UPDATE sessions SET last_seen = ?, ip = ?, user_agent = ? WHERE id = ?",
+			now.Format(sqliteTimeLayout), clientIP(r), r.UserAgent(), sessionID)
+	}
+	return sessionID, userID
+}
+
+func (s *EmailServer) getUserID(r *http.Request) int {
+	_, userID := s.currentSession(r)
+	return userID
+}
+
+// listSessions returns the user's unexpired sessions, most recently used
+// first.
+func (s *EmailServer) listSessions(userID int, currentID int64) ([]Session, error) {
+	rows, err := s.db.Query(`SELECT id, ip, user_agent, created, last_seen, expires FROM sessions
+		WHERE user_id = ? AND expires > ? ORDER BY last_seen DESC`,
+		userID, time.Now().UTC().Format(sqliteTimeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var session Session
+		var created, lastSeen, expires string
+		if err := rows.Scan(&session.ID, &session.IP, &session.UserAgent, &created, &lastSeen, &expires); err != nil {
+			return nil, err
+		}
+		session.Created = parseTimestamp(created)
+		session.LastSeen = parseTimestamp(lastSeen)
+		session.Expires = parseTimestamp(expires)
+		session.Current = session.ID == currentID
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *EmailServer) sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, userID := s.currentSession(r)
+	if userID == 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	var user User
+	s.db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&user.Email)
+
+	sessions, err := s.listSessions(userID, sessionID)
+	if err != nil {
+		http.Error(w, "Error loading sessions", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl := template.Must(template.New("sessions").Funcs(template.FuncMap{
+		"when": func(t time.Time) string { return t.Local().Format("Jan 2, 2006 15:04") },
+	}).Parse(`
+<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="csrf-token" content="{{.CSRFToken}}">
+    <title>Sessions - Email Server</title>
+    <script src="https://unpkg.com/htmx.org@1.9.6"></script>
+    <script src="/static/csrf.js"></script>
+    <link rel="stylesheet" href="/static/style.css">
+    <link href="https://fonts.googleapis.com/css2?family=Google+Sans:wght@400;500;600&display=swap" rel="stylesheet">
+    <link href="https://fonts.googleapis.com/icon?family=Material+Icons" rel="stylesheet">
+</head>
+<body>
+    <!-- Header -->
+    <div class="header">
+        <div class="header-content">
+            <a href="/dashboard" class="logo">
+                <span class="material-icons">email</span>
+                Email
+            </a>
+            <div class="user-info">
+                <span>{{.Email}}</span>
+                <a href="/dashboard" class="btn btn-secondary">
+                    <span class="material-icons">arrow_back</span>
+                    <span class="hidden-mobile">Back to Inbox</span>
+                </a>
+            </div>
+        </div>
+    </div>
+
+    <!-- Main Content -->
+    <div class="container" style="margin-top: 20px;">
+        <div class="card">
+            <div class="card-body">
+                <div style="display: flex; align-items: center; justify-content: space-between; margin-bottom: 16px;">
+                    <h1 style="font-size: 22px; font-weight: 500; margin: 0; display: flex; align-items: center; gap: 8px;">
+                        <span class="material-icons">devices</span>
+                        Active sessions
+                    </h1>
+                    <button class="btn btn-danger" hx-post="/sessions/revoke-all"
+                            hx-confirm="Sign out of every device, including this one?">
+                        <span class="material-icons">logout</span>
+                        Log out all devices
+                    </button>
+                </div>
+
+                {{range .Sessions}}
+                <div style="display: flex; align-items: center; justify-content: space-between; padding: 12px 0; border-top: 1px solid var(--border-color);">
+                    <div>
+                        <div style="font-weight: 500;">
+                            {{.IP}}
+                            {{if .Current}}<span class="unread-badge">This device</span>{{end}}
+                        </div>
+                        <div style="font-size: 13px; color: var(--text-secondary);">{{if .UserAgent}}{{.UserAgent}}{{else}}Unknown browser{{end}}</div>
+                        <div style="font-size: 12px; color: var(--text-secondary);">
+                            Signed in {{when .Created}} &middot; last active {{when .LastSeen}} &middot; expires {{when .Expires}}
+                        </div>
+                    </div>
+                    <button class="btn btn-secondary" hx-post="/sessions/{{.ID}}/revoke">
+                        <span class="material-icons" style="font-size: 16px;">close</span>
+                        {{if .Current}}Log out{{else}}Revoke{{end}}
+                    </button>
+                </div>
+                {{end}}
+            </div>
+        </div>
+    </div>
+</body>
+</html>`))
+
+	tmpl.Execute(w, struct {
+		Email     string
+		Sessions  []Session
+		CSRFToken string
+	}{user.Email, sessions, s.csrfToken(w, r)})
+}
+
+// revokeSessionHandler ends one of the user's sessions. Ending the current
+// one is the same as logging out.
+func (s *EmailServer) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	sessionID, userID := s.currentSession(r)
+	if userID == 0 {
+		w.Header().Set("HX-Redirect", "/login")
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid session", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", id, userID); err != nil {
+		http.Error(w, "Error revoking session", http.StatusInternalServerError)
+		return
+	}
+
+	if id == sessionID {
+		http.SetCookie(w, s.sessionCookie(r, "", time.Time{}))
+		w.Header().Set("HX-Redirect", "/login")
+		return
+	}
+	w.Header().Set("HX-Redirect", "/sessions")
+}
+
+// revokeAllSessionsHandler logs the user out everywhere, this browser
+// included.
+func (s *EmailServer) revokeAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserID(r)
+	if userID != 0 {
+		if _, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+			http.Error(w, "Error revoking sessions", http.StatusInternalServerError)
+			return
+		}
+	}
+	http.SetCookie(w, s.sessionCookie(r, "", time.Time{}))
+	w.Header().Set("HX-Redirect", "/login")
+}
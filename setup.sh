@@ -31,7 +31,8 @@ if [ $? -eq 0 ]; then
     echo ""
     echo "The server will start on:"
     echo "  Web interface: http://localhost:8080"
-    echo "  SMTP server: localhost:2525"
+    echo "  SMTP server: localhost:2525 (incoming mail)"
+    echo "  SMTP submission: localhost:587 (sending, login required)"
     echo "  IMAP server: localhost:1143"
     echo ""
     echo "You can now create accounts and send/receive emails!"
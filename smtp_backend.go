@@ -2,52 +2,171 @@ package main
 
 import (
 	"database/sql"
-	"errors"
 	"io"
+	"net"
+	"net/mail"
 	"strings"
 
+	"github.com/emersion/go-msgauth/dmarc"
 	"github.com/emersion/go-smtp"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// The SMTP backend serves two listeners. The MX listener takes mail from
+// other servers and only for our own domains; the submission listener is
+// where our users send from, and requires them to log in and to use an
+// address they may send as.
+
+func (s *EmailServer) createSubmissionTables() error {
+	// send_as lists addresses a user may use as sender besides their own.
+	// An address of the form "@domain" allows any address in that domain.
+	sendAsTable := `
+	CREATE TABLE IF NOT EXISTS send_as (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		address TEXT NOT NULL,
+		PRIMARY KEY (user_id, address)
+	);`
+
+	_, err := s.db.Exec(sendAsTable)
+	return err
+}
+
+// Rejections on the SMTP listeners. go-smtp's own ErrAuthRequired uses
+// 502, but RFC 4954 asks for 530.
+var (
+	errAuthRequired = &smtp.SMTPError{
+		Code:         530,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+		Message:      "Authentication required",
+	}
+	errAuthFailed = &smtp.SMTPError{
+		Code:         535,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+		Message:      "Authentication credentials invalid",
+	}
+	errRelayDenied = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Relaying denied: we do not accept mail for that domain",
+	}
+	errUnknownUser = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "No such user here",
+	}
+	errTooManyRecipients = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+		Message:      "Too many recipients; send the rest in another message",
+	}
+	errSenderNotOwned = &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender address not owned by the authenticated user",
+	}
+)
+
 type SMTPBackend struct {
-	db *sql.DB
+	db         *sql.DB
+	delivery   *Delivery
+	config     SMTPConfig
+	submission bool
+	dkim       *DKIMSigner    // signs submitted mail
+	auth       *Authenticator // checks mail received on the MX listener
+	spam       *SpamFilter    // scores mail received on the MX listener
+	blocklists *Blocklists    // refuses clients of the MX listener
+}
+
+// NewSMTPBackend returns the backend of the MX listener.
+func NewSMTPBackend(db *sql.DB, delivery *Delivery, config SMTPConfig, auth *Authenticator, spam *SpamFilter, blocklists *Blocklists) *SMTPBackend {
+	return &SMTPBackend{db: db, delivery: delivery, config: config, auth: auth, spam: spam, blocklists: blocklists}
 }
 
-func NewSMTPBackend(db *sql.DB) *SMTPBackend {
-	return &SMTPBackend{db: db}
+// NewSubmissionBackend returns the backend of the submission listener.
+func NewSubmissionBackend(db *sql.DB, delivery *Delivery, config SMTPConfig, dkim *DKIMSigner) *SMTPBackend {
+	return &SMTPBackend{db: db, delivery: delivery, config: config, submission: true, dkim: dkim}
 }
 
-func (b *SMTPBackend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
-	return &SMTPSession{db: b.db}, nil
+// NewSession is called on HELO or EHLO, which is where clients the
+// blocklists refuse are turned away.
+func (b *SMTPBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	if !b.submission {
+		if err := b.blocklists.CheckClient(connIP(c)); err != nil {
+			return nil, err
+		}
+	}
+	return &SMTPSession{db: b.db, delivery: b.delivery, config: b.config, submission: b.submission,
+		dkim: b.dkim, auth: b.auth, spam: b.spam, blocklists: b.blocklists, conn: c}, nil
 }
 
 type SMTPSession struct {
-	db   *sql.DB
-	from string
-	to   []string
+	db         *sql.DB
+	delivery   *Delivery
+	config     SMTPConfig
+	submission bool
+	dkim       *DKIMSigner
+	auth       *Authenticator
+	spam       *SpamFilter
+	blocklists *Blocklists
+	conn       *smtp.Conn
+	userID     int // the authenticated user on the submission listener
+	from       string
+	to         []string
 }
 
 func (s *SMTPSession) AuthPlain(username, password string) error {
 	var hashedPassword string
-	err := s.db.QueryRow("SELECT password FROM users WHERE email = ?", username).Scan(&hashedPassword)
+	var userID int
+	err := s.db.QueryRow("SELECT id, password FROM users WHERE email = ?", username).Scan(&userID, &hashedPassword)
 	if err != nil {
-		return errors.New("authentication failed")
+		return errAuthFailed
 	}
 
 	if bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) != nil {
-		return errors.New("authentication failed")
+		return errAuthFailed
 	}
 
+	s.userID = userID
 	return nil
 }
 
 func (s *SMTPSession) Mail(from string, opts *smtp.MailOptions) error {
+	if s.submission {
+		if s.userID == 0 {
+			return errAuthRequired
+		}
+		ok, err := maySendAs(s.db, s.userID, from)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errSenderNotOwned
+		}
+	} else if err := s.blocklists.CheckSender(s.remoteIP(), from); err != nil {
+		return err
+	}
 	s.from = from
 	return nil
 }
 
 func (s *SMTPSession) Rcpt(to string) error {
+	if s.submission && s.userID == 0 {
+		return errAuthRequired
+	}
+	if s.config.MaxRecipients > 0 && len(s.to) >= s.config.MaxRecipients {
+		return errTooManyRecipients
+	}
+
+	if !s.submission && !s.delivery.IsLocal(to) {
+		return errRelayDenied
+	}
+	to, err := s.delivery.Recipient(to)
+	if err == errNoAccount {
+		return errUnknownUser
+	} else if err != nil {
+		return err
+	}
+
 	s.to = append(s.to, to)
 	return nil
 }
@@ -59,38 +178,51 @@ func (s *SMTPSession) Data(r io.Reader) error {
 		return err
 	}
 
-	content := string(data)
-
-	// Extract subject from headers
-	subject := ""
-	lines := strings.Split(content, "\n")
-	bodyStart := 0
-
-	for i, line := range lines {
-		if strings.HasPrefix(strings.ToLower(line), "subject:") {
-			subject = strings.TrimSpace(line[8:])
+	// Our users' mail is signed for its From domain, which has to be one
+	// they may send as
+	if s.submission {
+		if err := checkHeaderFrom(s.db, s.userID, data); err != nil {
+			return err
 		}
-		if line == "" || line == "\r" {
-			bodyStart = i + 1
-			break
+		if data, err = s.dkim.Sign(data); err != nil {
+			return err
 		}
-	}
 
-	// Extract body
-	body := ""
-	if bodyStart < len(lines) {
-		body = strings.Join(lines[bodyStart:], "\n")
+		// Keep the message exactly as received; local recipients get it
+		// filed right away and the rest go to the outbound queue
+		return s.delivery.Deliver(s.from, s.to, data)
 	}
 
-	// Store email for each recipient
-	for _, to := range s.to {
-		_, err := s.db.Exec("INSERT INTO emails (from_email, to_email, subject, body) VALUES (?, ?, ?, ?)",
-			s.from, to, subject, body)
-		if err != nil {
-			return err
+	// Mail from other servers has to authenticate as its From domain, as
+	// far as that domain's DMARC policy demands
+	auth := s.auth.Check(s.remoteIP(), s.conn.Hostname(), s.from, data)
+	if auth.Disposition == string(dmarc.PolicyReject) {
+		s.auth.Collect(auth)
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Message rejected by the DMARC policy of " + auth.HeaderFrom,
 		}
 	}
 
+	// Recipients the spam filter scores it as junk for get it in Junk
+	junk := s.spam.Classify(data, auth, s.to)
+	if err := s.delivery.Receive(s.from, s.to, s.auth.Stamp(data, auth), auth, junk); err != nil {
+		return err
+	}
+	s.auth.Collect(auth)
+	return nil
+}
+
+// remoteIP returns the address of the connected client.
+func (s *SMTPSession) remoteIP() net.IP {
+	return connIP(s.conn)
+}
+
+func connIP(c *smtp.Conn) net.IP {
+	if addr, ok := c.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
 	return nil
 }
 
@@ -102,3 +234,54 @@ func (s *SMTPSession) Reset() {
 func (s *SMTPSession) Logout() error {
 	return nil
 }
+
+// maySendAs reports whether the user may use from as the envelope sender:
+// it is their own address or one send_as grants them.
+func maySendAs(db *sql.DB, userID int, from string) (bool, error) {
+	if from == "" {
+		return false, nil
+	}
+
+	var email string
+	if err := db.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email); err != nil {
+		return false, err
+	}
+	if strings.EqualFold(email, from) {
+		return true, nil
+	}
+
+	var granted int
+	err := db.QueryRow("SELECT COUNT(*) FROM send_as WHERE user_id = ? AND LOWER(address) IN (?, ?)",
+		userID, strings.ToLower(from), "@"+addressDomain(from)).Scan(&granted)
+	return granted > 0, err
+}
+
+// checkHeaderFrom returns errSenderNotOwned unless the user may send as
+// every address in the message's From header, which is what picks the
+// DKIM key the message gets signed with. A message without a From header
+// is not signed.
+func checkHeaderFrom(db *sql.DB, userID int, raw []byte) error {
+	header, _, err := parseMessage(raw)
+	if err != nil {
+		return err
+	}
+	value := header.Get("From")
+	if value == "" {
+		return nil
+	}
+	parser := mail.AddressParser{WordDecoder: wordDecoder}
+	addrs, err := parser.ParseList(value)
+	if err != nil {
+		return errSenderNotOwned
+	}
+	for _, addr := range addrs {
+		ok, err := maySendAs(db, userID, addr.Address)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errSenderNotOwned
+		}
+	}
+	return nil
+}
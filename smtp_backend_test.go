@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckHeaderFrom(t *testing.T) {
+	db := newTestDB(t)
+	userID := newTestUser(t, db, "bob@localhost.com")
+	newTestUser(t, db, "alice@localhost.com")
+	if _, err := db.Exec("INSERT INTO send_as (user_id, address) VALUES (?, ?)", userID, "@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		from string
+		ok   bool
+	}{
+		{"own address", "From: Bob <bob@localhost.com>\r\n", true},
+		{"case", "From: BOB@localhost.com\r\n", true},
+		{"granted domain", "From: info@example.org\r\n", true},
+		{"encoded name", "From: =?utf-8?q?B=C3=B6b?= <bob@localhost.com>\r\n", true},
+		{"no from", "", true},
+		{"other user", "From: alice@localhost.com\r\n", false},
+		{"other domain", "From: bob@example.com\r\n", false},
+		{"one of several", "From: bob@localhost.com, alice@localhost.com\r\n", false},
+		{"unparseable", "From: bob@localhost.com <\r\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := []byte(tt.from + "To: carol@example.net\r\nSubject: hi\r\n\r\nhello\r\n")
+			err := checkHeaderFrom(db, userID, raw)
+			switch {
+			case tt.ok && err != nil:
+				t.Errorf("got %v, want the From header accepted", err)
+			case !tt.ok && err != errSenderNotOwned:
+				t.Errorf("got %v, want errSenderNotOwned", err)
+			}
+		})
+	}
+}
+
+func TestRcpt(t *testing.T) {
+	s := newTestEmailServer(t)
+	bobID := newTestUser(t, s.db, "bob@localhost.com")
+	newTestUser(t, s.db, "alice@localhost.com")
+
+	type rcpt struct {
+		to  string
+		err error
+	}
+	tests := []struct {
+		name       string
+		submission bool
+		userID     int
+		rcpts      []rcpt
+		want       []string
+	}{
+		{"local user", false, 0, []rcpt{{"alice@localhost.com", nil}}, []string{"alice@localhost.com"}},
+		{"case folded", false, 0, []rcpt{{"Alice@LOCALHOST.com", nil}}, []string{"alice@localhost.com"}},
+		{"unknown user", false, 0, []rcpt{{"nobody@localhost.com", errUnknownUser}}, nil},
+		{"relay denied", false, 0, []rcpt{{"carol@example.net", errRelayDenied}}, nil},
+		{"submission without login", true, 0, []rcpt{{"carol@example.net", errAuthRequired}}, nil},
+		{"submission to remote", true, bobID, []rcpt{{"carol@example.net", nil}}, []string{"carol@example.net"}},
+		{"submission to unknown local user", true, bobID, []rcpt{{"nobody@localhost.com", errUnknownUser}}, nil},
+		{"recipient cap", false, 0, []rcpt{
+			{"alice@localhost.com", nil},
+			{"nobody@localhost.com", errUnknownUser},
+			{"bob@localhost.com", nil},
+			{"alice@localhost.com", errTooManyRecipients},
+		}, []string{"alice@localhost.com", "bob@localhost.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := s.config.SMTP
+			config.MaxRecipients = 2
+			session := &SMTPSession{db: s.db, delivery: s.delivery, config: config, submission: tt.submission, userID: tt.userID}
+			for _, r := range tt.rcpts {
+				if err := session.Rcpt(r.to); err != r.err {
+					t.Errorf("RCPT TO:<%s>: got %v, want %v", r.to, err, r.err)
+				}
+			}
+			if !reflect.DeepEqual(session.to, tt.want) {
+				t.Errorf("recipients %v, want %v", session.to, tt.want)
+			}
+		})
+	}
+
+	if code := errTooManyRecipients.Code; code != 452 {
+		t.Errorf("too many recipients answered with %d, want 452", code)
+	}
+}
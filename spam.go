@@ -0,0 +1,663 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+)
+
+// Mail arriving on the MX listener is scored before it is filed. Each
+// SpamRule looks at one aspect of the message and reports hits; positive
+// scores point to spam and negative ones to wanted mail. Recipients for
+// whom the total reaches the threshold find the message in Junk. The last
+// rule is a Bayesian classifier kept per user, which learns whenever the
+// user moves mail into or out of Junk.
+
+func (s *EmailServer) createSpamTables() error {
+	// spam_tokens counts, per user, the spam and ham messages each token
+	// was seen in; spam_corpus counts the messages learned.
+	tokenTable := `
+	CREATE TABLE IF NOT EXISTS spam_tokens (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		token TEXT NOT NULL,
+		spam INTEGER NOT NULL DEFAULT 0,
+		ham INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, token)
+	);`
+
+	corpusTable := `
+	CREATE TABLE IF NOT EXISTS spam_corpus (
+		user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		spam INTEGER NOT NULL DEFAULT 0,
+		ham INTEGER NOT NULL DEFAULT 0
+	);`
+
+	// spam_trained remembers how each message was learned, so that a
+	// message reported the other way is unlearned first.
+	trainedTable := `
+	CREATE TABLE IF NOT EXISTS spam_trained (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+		spam BOOLEAN NOT NULL,
+		PRIMARY KEY (user_id, message_id)
+	);`
+
+	for _, table := range []string{tokenTable, corpusTable, trainedTable} {
+		if _, err := s.db.Exec(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SpamHit is one finding of a rule.
+type SpamHit struct {
+	Rule   string  `json:"rule"`
+	Score  float64 `json:"score"`
+	Detail string  `json:"detail"`
+}
+
+// SpamMessage is what the rules look at. It is parsed once per message;
+// UserID is set to each recipient in turn.
+type SpamMessage struct {
+	Header   textproto.Header
+	Subject  string
+	Text     string
+	HTML     string
+	Auth     *MessageAuth // nil if the message was not checked
+	Received time.Time
+	UserID   int
+
+	tokens []string
+}
+
+// SpamRule is one stage of the scoring pipeline.
+type SpamRule interface {
+	Check(m *SpamMessage) ([]SpamHit, error)
+}
+
+// SpamVerdict is the outcome of scoring a message for one recipient.
+type SpamVerdict struct {
+	Score float64   `json:"score"`
+	Hits  []SpamHit `json:"hits"`
+	Spam  bool      `json:"spam"`
+}
+
+// SpamFilter runs the rules and compares the total with the threshold.
+type SpamFilter struct {
+	db     *sql.DB
+	config SpamConfig
+	rules  []SpamRule
+}
+
+func NewSpamFilter(db *sql.DB, config SpamConfig) *SpamFilter {
+	return &SpamFilter{db: db, config: config, rules: []SpamRule{
+		headerRule{}, authRule{}, urlRule{}, keywordRule{}, bayesRule{db: db},
+	}}
+}
+
+// AddRule appends a rule to the pipeline.
+func (f *SpamFilter) AddRule(rule SpamRule) {
+	f.rules = append(f.rules, rule)
+}
+
+// Classify scores raw for each local recipient and returns the ones it
+// should be filed as junk for. Failures are logged and count as not spam,
+// so a broken rule never costs a message.
+func (f *SpamFilter) Classify(raw []byte, auth *MessageAuth, recipients []string) map[string]bool {
+	if f == nil || !f.config.Enabled {
+		return nil
+	}
+	m, err := newSpamMessage(raw, auth)
+	if err != nil {
+		log.Printf("Spam filter: %v", err)
+		return nil
+	}
+
+	junk := make(map[string]bool)
+	for _, to := range recipients {
+		var userID int
+		if err := f.db.QueryRow("SELECT id FROM users WHERE email = lower(?)", to).Scan(&userID); err != nil {
+			continue
+		}
+		m.UserID = userID
+		verdict := f.Score(m)
+		if verdict.Spam {
+			junk[strings.ToLower(to)] = true
+			log.Printf("Spam filter: message for %s scored %.1f: %s", to, verdict.Score, formatHits(verdict.Hits))
+		}
+	}
+	return junk
+}
+
+// Score runs every rule on m.
+func (f *SpamFilter) Score(m *SpamMessage) *SpamVerdict {
+	verdict := &SpamVerdict{}
+	for _, rule := range f.rules {
+		hits, err := rule.Check(m)
+		if err != nil {
+			log.Printf("Spam filter: rule %T: %v", rule, err)
+			continue
+		}
+		for _, hit := range hits {
+			verdict.Score += hit.Score
+		}
+		verdict.Hits = append(verdict.Hits, hits...)
+	}
+	verdict.Spam = verdict.Score >= f.config.Threshold
+	return verdict
+}
+
+func formatHits(hits []SpamHit) string {
+	parts := make([]string, len(hits))
+	for i, hit := range hits {
+		parts[i] = fmt.Sprintf("%s %+.1f (%s)", hit.Rule, hit.Score, hit.Detail)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func newSpamMessage(raw []byte, auth *MessageAuth) (*SpamMessage, error) {
+	msg, err := newStoredMessage(0, raw)
+	if err != nil {
+		return nil, err
+	}
+	m := &SpamMessage{
+		Header:   msg.Header,
+		Subject:  msg.HeaderText("Subject"),
+		Auth:     auth,
+		Received: time.Now(),
+	}
+	if content, err := msg.MIME(); err == nil {
+		m.Text, m.HTML = content.Text, content.HTML
+	} else {
+		m.Text = string(msg.Body)
+	}
+	return m, nil
+}
+
+// headerRule flags header fields that legitimate mail software fills in
+// properly.
+type headerRule struct{}
+
+func (headerRule) Check(m *SpamMessage) ([]SpamHit, error) {
+	var hits []SpamHit
+	hit := func(score float64, detail string) {
+		hits = append(hits, SpamHit{Rule: "header", Score: score, Detail: detail})
+	}
+
+	if from := m.Header.Get("From"); from == "" {
+		hit(2, "no From header")
+	} else if addrs, err := mail.ParseAddressList(from); err != nil {
+		hit(1.5, "malformed From header")
+	} else {
+		for _, addr := range addrs {
+			// A display name holding some other address is a favourite
+			// of phishers
+			shown := addressDomain(addr.Name)
+			if strings.Contains(addr.Name, "@") && shown != addressDomain(addr.Address) {
+				hit(2, "From name shows an address at "+shown)
+				break
+			}
+		}
+	}
+
+	if m.Header.Get("Message-Id") == "" {
+		hit(1, "no Message-ID header")
+	}
+	if value := m.Header.Get("Date"); value == "" {
+		hit(1, "no Date header")
+	} else if date, err := mail.ParseDate(value); err != nil {
+		hit(1, "malformed Date header")
+	} else if date.After(m.Received.Add(24 * time.Hour)) {
+		hit(1.5, "Date in the future")
+	}
+	if m.Header.Get("To") == "" && m.Header.Get("Cc") == "" {
+		hit(0.5, "no To or Cc header")
+	}
+
+	if m.Subject == "" {
+		hit(0.5, "no Subject")
+	} else if isShouting(m.Subject) {
+		hit(1, "Subject in capitals")
+	}
+	return hits, nil
+}
+
+// isShouting reports whether s has at least ten letters, all of them
+// upper case.
+func isShouting(s string) bool {
+	letters := 0
+	for _, r := range s {
+		if unicode.IsLower(r) {
+			return false
+		}
+		if unicode.IsUpper(r) {
+			letters++
+		}
+	}
+	return letters >= 10
+}
+
+// authRule turns the SPF, DKIM and DMARC results into scores. Failures
+// the From domain's policy already acted on count here too, since a
+// policy of none is common even for domains that are forged a lot.
+type authRule struct{}
+
+func (authRule) Check(m *SpamMessage) ([]SpamHit, error) {
+	a := m.Auth
+	if a == nil {
+		return nil, nil
+	}
+
+	var hits []SpamHit
+	switch a.SPF {
+	case "fail":
+		hits = append(hits, SpamHit{Rule: "auth", Score: 1.5, Detail: "SPF fail"})
+	case "softfail":
+		hits = append(hits, SpamHit{Rule: "auth", Score: 0.5, Detail: "SPF softfail"})
+	}
+	if a.DKIM == "fail" {
+		hits = append(hits, SpamHit{Rule: "auth", Score: 1, Detail: "DKIM fail"})
+	}
+	if a.Failed() {
+		hits = append(hits, SpamHit{Rule: "auth", Score: 2, Detail: "DMARC fail for " + a.HeaderFrom})
+	} else if a.Passed() {
+		hits = append(hits, SpamHit{Rule: "auth", Score: -1, Detail: "DMARC pass for " + a.HeaderFrom})
+	}
+	return hits, nil
+}
+
+var (
+	urlRE  = regexp.MustCompile(`(?i)\bhttps?://[^\s"'<>()]+`)
+	linkRE = regexp.MustCompile(`(?is)<a\s[^>]*href\s*=\s*["']?([^"'\s>]+)[^>]*>(.*?)</a>`)
+)
+
+// urlShorteners hide where a link goes.
+var urlShorteners = map[string]bool{
+	"bit.ly": true, "tinyurl.com": true, "goo.gl": true, "t.co": true, "ow.ly": true,
+	"is.gd": true, "buff.ly": true, "rebrand.ly": true, "cutt.ly": true, "shorturl.at": true,
+}
+
+// urlRule looks at the links in the body: hosts given as IP addresses,
+// link shorteners, and HTML links whose text shows a different site than
+// they lead to.
+type urlRule struct{}
+
+func (urlRule) Check(m *SpamMessage) ([]SpamHit, error) {
+	var hits []SpamHit
+	found := make(map[string]bool)
+	hit := func(kind string, score float64, detail string) {
+		if !found[kind] {
+			found[kind] = true
+			hits = append(hits, SpamHit{Rule: "url", Score: score, Detail: detail})
+		}
+	}
+
+	for _, link := range messageURLs(m) {
+		host := urlHost(link)
+		switch {
+		case net.ParseIP(strings.Trim(host, "[]")) != nil:
+			hit("ip", 2, "link to an IP address")
+		case urlShorteners[host]:
+			hit("shortener", 1, "link through "+host)
+		}
+	}
+
+	for _, match := range linkRE.FindAllStringSubmatch(m.HTML, -1) {
+		text := strings.TrimSpace(htmlToText(match[2]))
+		if !urlRE.MatchString(text) && !strings.HasPrefix(strings.ToLower(text), "www.") {
+			continue
+		}
+		if !strings.Contains(text, "://") {
+			text = "http://" + text
+		}
+		shown, target := urlHost(text), urlHost(match[1])
+		if shown != "" && target != "" && organizationalDomain(shown) != organizationalDomain(target) {
+			hit("mismatch", 2.5, "link text shows "+shown+" but leads to "+target)
+		}
+	}
+	return hits, nil
+}
+
+// messageURLs returns the web links in the text and the HTML of m.
+func messageURLs(m *SpamMessage) []string {
+	links := urlRE.FindAllString(m.Text, -1)
+	for _, match := range linkRE.FindAllStringSubmatch(m.HTML, -1) {
+		links = append(links, match[1])
+	}
+	return links
+}
+
+// urlHost returns the lowercased host of a link, or "" if it has none.
+func urlHost(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// spamPhrases are phrases common in spam, with their scores.
+var spamPhrases = []struct {
+	phrase string
+	score  float64
+}{
+	{"viagra", 1.5},
+	{"cialis", 1.5},
+	{"you have won", 1.5},
+	{"lottery", 1},
+	{"winner", 0.5},
+	{"wire transfer", 1},
+	{"western union", 1},
+	{"inheritance", 1},
+	{"million dollars", 1},
+	{"100% free", 1},
+	{"risk-free", 0.5},
+	{"act now", 0.5},
+	{"limited time offer", 0.5},
+	{"click here", 0.5},
+	{"verify your account", 1.5},
+	{"confirm your password", 1.5},
+	{"account will be suspended", 1.5},
+	{"urgent response", 1},
+	{"crypto investment", 1},
+	{"double your money", 1.5},
+}
+
+// maxKeywordScore caps the keyword rule, so that a newsletter using a few
+// of the phrases is not junked for that alone.
+const maxKeywordScore = 3
+
+// keywordRule scores phrases common in spam in the subject and body.
+type keywordRule struct{}
+
+func (keywordRule) Check(m *SpamMessage) ([]SpamHit, error) {
+	text := strings.ToLower(m.Subject + "\n" + m.Text)
+	var hits []SpamHit
+	total := 0.0
+	for _, p := range spamPhrases {
+		if total >= maxKeywordScore {
+			break
+		}
+		if strings.Contains(text, p.phrase) {
+			score := math.Min(p.score, maxKeywordScore-total)
+			hits = append(hits, SpamHit{Rule: "keyword", Score: score, Detail: fmt.Sprintf("contains %q", p.phrase)})
+			total += score
+		}
+	}
+	return hits, nil
+}
+
+const (
+	// bayesMinTrained is how many spam and how many ham messages a user
+	// must have reported before their classifier is consulted.
+	bayesMinTrained = 5
+	// bayesTokens is how many of the most telling tokens are combined.
+	bayesTokens = 15
+	// maxSpamTokens limits the tokens taken from one message.
+	maxSpamTokens = 1000
+)
+
+// bayesRule is the recipient's own classifier. It combines the spam
+// probabilities of the message's most telling tokens as in Graham's "A
+// Plan for Spam", with Robinson's adjustment for rarely seen tokens.
+type bayesRule struct {
+	db *sql.DB
+}
+
+func (b bayesRule) Check(m *SpamMessage) ([]SpamHit, error) {
+	if m.UserID == 0 {
+		return nil, nil
+	}
+	var nspam, nham int
+	err := b.db.QueryRow("SELECT spam, ham FROM spam_corpus WHERE user_id = ?", m.UserID).Scan(&nspam, &nham)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if nspam < bayesMinTrained || nham < bayesMinTrained {
+		return nil, nil
+	}
+
+	var probs []float64
+	for _, token := range m.Tokens() {
+		var spam, ham int
+		err := b.db.QueryRow("SELECT spam, ham FROM spam_tokens WHERE user_id = ? AND token = ?",
+			m.UserID, token).Scan(&spam, &ham)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		spamRate, hamRate := float64(spam)/float64(nspam), float64(ham)/float64(nham)
+		if spamRate+hamRate == 0 {
+			continue
+		}
+		// Pull tokens seen only a few times towards 0.5
+		n := float64(spam + ham)
+		p := (0.5 + n*spamRate/(spamRate+hamRate)) / (1 + n)
+		probs = append(probs, math.Min(math.Max(p, 0.01), 0.99))
+	}
+	if len(probs) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(probs, func(i, j int) bool { return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5) })
+	if len(probs) > bayesTokens {
+		probs = probs[:bayesTokens]
+	}
+	var logSpam, logHam float64
+	for _, p := range probs {
+		logSpam += math.Log(p)
+		logHam += math.Log(1 - p)
+	}
+	prob := 1 / (1 + math.Exp(logHam-logSpam))
+
+	var score float64
+	switch {
+	case prob >= 0.99:
+		score = 4
+	case prob >= 0.95:
+		score = 3
+	case prob >= 0.8:
+		score = 1.5
+	case prob <= 0.01:
+		score = -3
+	case prob <= 0.05:
+		score = -1.5
+	default:
+		return nil, nil
+	}
+	return []SpamHit{{Rule: "bayes", Score: score, Detail: fmt.Sprintf("%.0f%% spam", prob*100)}}, nil
+}
+
+var tokenRE = regexp.MustCompile(`[\p{L}\p{N}$'-]+`)
+
+// Tokens returns the distinct words of the message for the classifier,
+// with those of the subject, the From domain and link hosts marked as
+// such.
+func (m *SpamMessage) Tokens() []string {
+	if m.tokens != nil {
+		return m.tokens
+	}
+
+	seen := make(map[string]bool)
+	m.tokens = []string{}
+	add := func(token string) {
+		if !seen[token] && len(m.tokens) < maxSpamTokens {
+			seen[token] = true
+			m.tokens = append(m.tokens, token)
+		}
+	}
+	words := func(prefix, text string) {
+		for _, word := range tokenRE.FindAllString(strings.ToLower(text), -1) {
+			word = strings.Trim(word, "'-")
+			if n := utf8.RuneCountInString(word); n < 3 || n > 20 || strings.IndexFunc(word, unicode.IsLetter) < 0 {
+				continue
+			}
+			add(prefix + word)
+		}
+	}
+
+	words("subject:", m.Subject)
+	if addr, err := mail.ParseAddress(m.Header.Get("From")); err == nil {
+		add("from:" + addressDomain(addr.Address))
+	}
+	for _, link := range messageURLs(m) {
+		if host := urlHost(link); host != "" {
+			add("url:" + host)
+		}
+	}
+	words("", m.Text)
+	return m.tokens
+}
+
+// trainSpam teaches the user's classifier that the messages of emailIDs
+// are spam, or are not. Messages learned the other way before are
+// unlearned first; ones already learned this way are left as they are.
+func trainSpam(db *sql.DB, userID int, emailIDs []int64, spam bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range emailIDs {
+		var messageID int64
+		err := tx.QueryRow(`SELECT e.message_id FROM emails e JOIN mailboxes m ON m.id = e.mailbox_id
+			WHERE e.id = ? AND m.user_id = ?`, id, userID).Scan(&messageID)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := learnMessage(tx, userID, messageID, spam); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func learnMessage(db execer, userID int, messageID int64, spam bool) error {
+	var learned bool
+	err := db.QueryRow("SELECT spam FROM spam_trained WHERE user_id = ? AND message_id = ?", userID, messageID).Scan(&learned)
+	if err == nil && learned == spam {
+		return nil
+	} else if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	relearn := err == nil
+
+	msg, err := loadMessage(db, messageID)
+	if err != nil {
+		return err
+	}
+	m, err := newSpamMessage(msg.Raw, nil)
+	if err != nil {
+		return err
+	}
+	tokens := m.Tokens()
+
+	if relearn {
+		if err := countTokens(db, userID, tokens, learned, -1); err != nil {
+			return err
+		}
+	}
+	if err := countTokens(db, userID, tokens, spam, 1); err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO spam_trained (user_id, message_id, spam) VALUES (?, ?, ?)",
+		userID, messageID, spam)
+	return err
+}
+
+// countTokens adds delta to the spam or ham counts of a message's tokens
+// and of the user's corpus.
+func countTokens(db execer, userID int, tokens []string, spam bool, delta int) error {
+	column := "ham"
+	if spam {
+		column = "spam"
+	}
+
+	_, err := db.Exec(`INSERT INTO spam_corpus (user_id, `+column+`) VALUES (?, MAX(?, 0))
+		ON CONFLICT (user_id) DO UPDATE SET `+column+` = MAX(`+column+` + ?, 0)`, userID, delta, delta)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		_, err := db.Exec(`INSERT INTO spam_tokens (user_id, token, `+column+`) VALUES (?, ?, MAX(?, 0))
+			ON CONFLICT (user_id, token) DO UPDATE SET `+column+` = MAX(`+column+` + ?, 0)`, userID, token, delta, delta)
+		if err != nil {
+			return err
+		}
+	}
+	if delta < 0 {
+		_, err = db.Exec("DELETE FROM spam_tokens WHERE user_id = ? AND spam = 0 AND ham = 0", userID)
+	}
+	return err
+}
+
+// spamTraining tells what a move or copy between two mailboxes says about
+// the messages: into Junk means spam, and out of Junk to anywhere but
+// Trash means not spam. ok is false for any other move.
+func spamTraining(from, to *Mailbox) (spam, ok bool) {
+	switch {
+	case to.SpecialUse == imap.JunkAttr && from.SpecialUse != imap.JunkAttr:
+		return true, true
+	case from.SpecialUse == imap.JunkAttr && to.SpecialUse != imap.JunkAttr && to.SpecialUse != imap.TrashAttr:
+		return false, true
+	}
+	return false, false
+}
+
+// reportSpam handles the web UI's "Mark as spam" and "Not spam": the
+// user's classifier learns from the emails, and they are moved into Junk,
+// or out of Junk back to the inbox.
+func (s *EmailServer) reportSpam(userID int, emailIDs []int64, spam bool) error {
+	if err := trainSpam(s.db, userID, emailIDs, spam); err != nil {
+		return err
+	}
+
+	junk, err := getSpecialMailbox(s.db, userID, imap.JunkAttr)
+	if err != nil {
+		return err
+	}
+	dest := junk
+	if !spam {
+		if dest, err = getMailbox(s.db, userID, "INBOX"); err != nil {
+			return err
+		}
+	}
+
+	byMailbox, err := s.emailsByMailbox(userID, emailIDs)
+	if err != nil {
+		return err
+	}
+	for mailboxID, ids := range byMailbox {
+		// Only spam outside Junk and mistakes inside it need to move
+		if (mailboxID == junk.ID) == spam {
+			continue
+		}
+		seqNums, err := s.refileEmails(ids, mailboxID, dest.ID)
+		if err != nil {
+			return err
+		}
+		s.events.MessagesExpunged(mailboxID, seqNums, false)
+		s.events.MessagesAdded(dest.ID, false)
+	}
+	return nil
+}
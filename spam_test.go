@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// brokenRule fails on every message.
+type brokenRule struct{}
+
+func (brokenRule) Check(m *SpamMessage) ([]SpamHit, error) {
+	return []SpamHit{{Rule: "broken", Score: 10}}, errors.New("out of order")
+}
+
+func TestSpamFilterScore(t *testing.T) {
+	db := newTestDB(t)
+	userID := newTestUser(t, db, "bob@localhost.com")
+	filter := NewSpamFilter(db, SpamConfig{Enabled: true, Threshold: 5})
+	filter.AddRule(brokenRule{})
+
+	const headers = "From: Alice <alice@x.example>\r\nTo: bob@localhost.com\r\n" +
+		"Date: Mon, 02 Jan 2023 10:00:00 +0000\r\nMessage-Id: <1@x.example>\r\n"
+	spamBody := headers + "Subject: offer\r\n\r\ncheap pills from our online pharmacy\r\n"
+	hamBody := headers + "Subject: agenda\r\n\r\nnotes for the quarterly planning meeting\r\n"
+
+	// Teach bob's classifier the two messages above
+	for raw, spam := range map[string]bool{spamBody: true, hamBody: false} {
+		m, err := newSpamMessage([]byte(raw), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < bayesMinTrained; i++ {
+			if err := countTokens(db, userID, m.Tokens(), spam, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	phishing := headers + "Subject: Security notice\r\nMIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nPlease verify your account at https://www.mybank.com/login\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>Please verify your account at " +
+		"<a href=\"http://192.0.2.7/login\">https://www.mybank.com/login</a></p>\r\n--b--\r\n"
+
+	tests := []struct {
+		name   string
+		raw    string
+		auth   *MessageAuth
+		userID int
+		score  float64
+		spam   bool
+	}{
+		{"clean", headers + "Subject: Lunch\r\n\r\nSee you at noon.\r\n", nil, 0, 0, false},
+		{"dmarc pass", headers + "Subject: Lunch\r\n\r\nSee you at noon.\r\n",
+			&MessageAuth{DMARC: "pass", HeaderFrom: "x.example"}, 0, -1, false},
+		{"bare headers", "From: alice@x.example\r\n\r\nhi\r\n", nil, 0, 3, false},
+		{"subject in capitals", headers + "Subject: WIN A FREE CRUISE\r\n\r\nhi\r\n", nil, 0, 1, false},
+		{"authentication failures", headers + "Subject: Lunch\r\n\r\nhi\r\n",
+			&MessageAuth{SPF: "fail", DKIM: "fail", DMARC: "fail", HeaderFrom: "x.example"}, 0, 4.5, false},
+		{"keywords capped", headers + "Subject: Lunch\r\n\r\nViagra! You have won the lottery, claim it by wire transfer.\r\n",
+			nil, 0, maxKeywordScore, false},
+		{"shortened link", headers + "Subject: Lunch\r\n\r\nMenu: https://bit.ly/abc\r\n", nil, 0, 1, false},
+		{"phishing", phishing, nil, 0, 6, true},
+		{"trained spam", spamBody, nil, userID, 4, false},
+		{"trained spam with failed dmarc", spamBody,
+			&MessageAuth{DMARC: "fail", HeaderFrom: "x.example"}, userID, 6, true},
+		{"trained ham", hamBody, nil, userID, -3, false},
+		{"untrained user", spamBody, nil, newTestUser(t, db, "carol@localhost.com"), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := newSpamMessage([]byte(tt.raw), tt.auth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m.UserID = tt.userID
+			verdict := filter.Score(m)
+			if math.Abs(verdict.Score-tt.score) > 0.001 || verdict.Spam != tt.spam {
+				t.Errorf("scored %.1f spam=%v (%s), want %.1f spam=%v",
+					verdict.Score, verdict.Spam, formatHits(verdict.Hits), tt.score, tt.spam)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+// Sends the page's CSRF token with every htmx request to this server, and
+// swaps in the error fragment the server returns when it rejects one.
+document.addEventListener('htmx:configRequest', function(evt) {
+    const meta = document.querySelector('meta[name="csrf-token"]');
+    if (meta && !/^[a-z]+:|^\/\//i.test(evt.detail.path)) {
+        evt.detail.headers['X-CSRF-Token'] = meta.content;
+    }
+});
+
+document.addEventListener('htmx:beforeSwap', function(evt) {
+    if (evt.detail.xhr.status === 403) {
+        evt.detail.shouldSwap = true;
+        evt.detail.isError = false;
+    }
+});
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certStore holds the certificate served by every TLS listener: STARTTLS
+// on SMTP and IMAP, the implicit TLS ports and HTTPS. The listeners ask it
+// for the certificate on each handshake, so reloading it on SIGHUP takes
+// effect without restarting them.
+type certStore struct {
+	certFile string
+	keyFile  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+
+	// acme is set when certificates are issued by an ACME CA; see acme.go.
+	acme     *autocert.Manager
+	hostname string
+}
+
+// newCertStore loads the configured certificate. If neither file exists
+// yet, a self-signed certificate for hostname is generated and saved there
+// first.
+func newCertStore(config TLSConfig, hostname string) (*certStore, error) {
+	c := &certStore{certFile: config.CertFile, keyFile: config.KeyFile}
+
+	_, certErr := os.Stat(c.certFile)
+	_, keyErr := os.Stat(c.keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		log.Printf("No TLS certificate found, generating a self-signed one for %s in %s", hostname, c.certFile)
+		if err := writeSelfSignedCert(c.certFile, c.keyFile, hostname); err != nil {
+			return nil, fmt.Errorf("generating self-signed certificate: %v", err)
+		}
+	}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the certificate files again. The old certificate stays in
+// use if they cannot be loaded.
+func (c *certStore) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %v", err)
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return fmt.Errorf("loading TLS certificate: %v", err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if c.acme != nil {
+		if cert, ok, err := c.acmeCertificate(hello); ok {
+			return cert, err
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// tlsConfig returns a server configuration that always uses the current
+// certificate.
+func (c *certStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// webTLSConfig is tlsConfig for HTTPS, which also answers ACME TLS-ALPN-01
+// challenges.
+func (c *certStore) webTLSConfig() *tls.Config {
+	config := c.tlsConfig()
+	if c.acme != nil {
+		config.NextProtos = []string{"http/1.1", acme.ALPNProto}
+	}
+	return config
+}
+
+// reloadOnSIGHUP reloads the certificate every time the process receives
+// SIGHUP, for example after a renewal.
+func (c *certStore) reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := c.Reload(); err != nil {
+			log.Printf("TLS certificate not reloaded: %v", err)
+			continue
+		}
+		c.mu.RLock()
+		log.Printf("Reloaded TLS certificate for %v, valid until %s",
+			c.cert.Leaf.DNSNames, c.cert.Leaf.NotAfter.Format(time.RFC3339))
+		c.mu.RUnlock()
+	}
+}
+
+// writeSelfSignedCert creates a key and a self-signed certificate valid for
+// hostname and localhost, and writes them as PEM.
+func writeSelfSignedCert(certFile, keyFile, hostname string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if ip := net.ParseIP(hostname); ip != nil {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	} else if hostname != "localhost" {
+		template.DNSNames = append([]string{hostname}, template.DNSNames...)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+	}
+	if err := writePEM(keyFile, "PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(file, blockType string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// listen opens the plain listener on addr and, if tlsAddr is set, an
+// implicit TLS one using config, and merges them so a server runs a single Serve loop for
+// both. go-imap in particular starts an update dispatcher per Serve call,
+// and two of them could deliver mailbox updates out of order. A TLS port
+// that cannot be opened, such as a privileged one, is logged and skipped.
+func (s *EmailServer) listen(name, addr, tlsAddr string, config *tls.Config) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tlsAddr == "" {
+		log.Printf("Starting %s server on %s", name, addr)
+		return l, nil
+	}
+
+	tl, err := tls.Listen("tcp", tlsAddr, config)
+	if err != nil {
+		log.Printf("%s server: implicit TLS disabled: %v", name, err)
+		log.Printf("Starting %s server on %s", name, addr)
+		return l, nil
+	}
+	log.Printf("Starting %s server on %s and %s (TLS)", name, addr, tlsAddr)
+	return mergeListeners(l, tl), nil
+}
+
+// serveWeb serves handler over HTTPS and redirects plain HTTP on addr to
+// it, so passwords and session cookies never cross the network in clear.
+// Only ACME HTTP-01 challenges are answered over plain HTTP. Without an
+// HTTPS listener the web UI is served on addr as it is.
+func (s *EmailServer) serveWeb(addr string, handler http.Handler) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	var tl net.Listener
+	if s.config.TLS.HTTPSAddr != "" {
+		tl, err = tls.Listen("tcp", s.config.TLS.HTTPSAddr, s.certs.webTLSConfig())
+		if err != nil {
+			log.Printf("web server: HTTPS disabled: %v", err)
+		}
+	}
+	if tl == nil {
+		if s.certs.acme != nil {
+			handler = s.certs.acme.HTTPHandler(handler)
+		}
+		log.Printf("Starting web server on %s", addr)
+		return http.Serve(l, handler)
+	}
+
+	redirect := redirectToHTTPS(tl.Addr().String())
+	if s.certs.acme != nil {
+		redirect = s.certs.acme.HTTPHandler(redirect)
+	}
+	log.Printf("Starting web server on %s (TLS), redirecting %s", s.config.TLS.HTTPSAddr, addr)
+	go func() {
+		log.Fatal(http.Serve(l, redirect))
+	}()
+	return http.Serve(tl, handler)
+}
+
+// redirectToHTTPS redirects every request to the same host, path and query
+// on the port of httpsAddr.
+func redirectToHTTPS(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "443" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	})
+}
+
+// multiListener accepts connections from several listeners at once.
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func mergeListeners(listeners ...net.Listener) net.Listener {
+	m := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error),
+		done:      make(chan struct{}),
+	}
+	for _, l := range listeners {
+		go m.accept(l)
+	}
+	return m
+}
+
+func (m *multiListener) accept(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			select {
+			case m.errs <- err:
+			case <-m.done:
+				return
+			}
+			// Temporary errors are retried by the server, which calls
+			// Accept again; anything else ends this listener.
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		select {
+		case m.conns <- c:
+		case <-m.done:
+			c.Close()
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-m.conns:
+		return c, nil
+	case err := <-m.errs:
+		return nil, err
+	case <-m.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, l := range m.listeners {
+			if cerr := l.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		httpsAddr string
+		method    string
+		target    string
+		want      string
+	}{
+		{":8443", "GET", "http://mail.example.com:8585/login?next=%2Finbox", "https://mail.example.com:8443/login?next=%2Finbox"},
+		{":8443", "POST", "http://mail.example.com:8585/login", "https://mail.example.com:8443/login"},
+		{":443", "GET", "http://mail.example.com/", "https://mail.example.com/"},
+		{"[::]:8443", "GET", "http://[::1]:8585/dashboard", "https://[::1]:8443/dashboard"},
+		{":8443", "GET", "http://[::1]/", "https://[::1]:8443/"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		redirectToHTTPS(tt.httpsAddr).ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != http.StatusFound || w.Header().Get("Location") != tt.want {
+			t.Errorf("%s %s: got %d to %q, want a redirect to %q", tt.method, tt.target, w.Code, w.Header().Get("Location"), tt.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// webEventNames are the SSE event names the dashboard listens for.
+var webEventNames = map[MailboxEventType]string{
+	MessagesAdded:    "new",
+	FlagsChanged:     "flags",
+	MessagesExpunged: "deleted",
+}
+
+// eventsHandler streams the logged-in user's mailbox events to the
+// dashboard as Server-Sent Events. Every event names the mailbox that
+// changed and carries the number of unread messages in the inbox; an
+// "unread" event with the current count is sent on connect.
+func (s *EmailServer) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	userID := s.getUserID(r)
+	if userID == 0 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := make(chan *MailboxEvent, 16)
+	unsubscribe := s.events.Subscribe(func(ev *MailboxEvent) {
+		if ev.UserID != userID {
+			return
+		}
+		select {
+		case events <- ev:
+		default:
+			// The browser is not keeping up; the next event reloads the
+			// list anyway.
+		}
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	fmt.Fprintf(w, "retry: 5000\nevent: unread\ndata: {\"mailbox\":0,\"unread\":%d}\n\n", s.unreadCount(userID))
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-events:
+			// Stop streaming once the session is logged out or revoked.
+			if s.getUserID(r) != userID {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: {\"mailbox\":%d,\"unread\":%d}\n\n",
+				webEventNames[ev.Type], ev.MailboxID, s.unreadCount(userID))
+		}
+		flusher.Flush()
+	}
+}
+
+// unreadCount returns the number of messages in the user's inbox without
+// \Seen.
+func (s *EmailServer) unreadCount(userID int) int {
+	var count int
+	s.db.QueryRow(`SELECT COUNT(*) FROM emails e JOIN mailboxes m ON m.id = e.mailbox_id
+		WHERE m.user_id = ? AND m.name = 'INBOX'
+		AND NOT EXISTS (SELECT 1 FROM email_flags f WHERE f.email_id = e.id AND f.flag = ?)`,
+		userID, imap.SeenFlag).Scan(&count)
+	return count
+}